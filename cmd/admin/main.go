@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+)
+
+const usage = `usage: admin [-host URL] <command>
+
+commands:
+  drain <storage-id>   stop placing parts on the storage and move its parts away
+  status <storage-id>  show the state of the storage and whether it's safe to remove
+  rebalance            show the progress of rebalancing
+  locks                list the held locks with their owners and ages
+`
+
+func main() {
+	host := flag.String("host", "http://127.0.0.1:19091", "admin API of the uploader")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var method, path string
+	switch args := flag.Args(); {
+	case len(args) == 2 && args[0] == "drain":
+		method, path = http.MethodPost, "/api/v1/admin/storages/"+args[1]+"/drain"
+	case len(args) == 2 && args[0] == "status":
+		method, path = http.MethodGet, "/api/v1/admin/storages/"+args[1]
+	case len(args) == 1 && args[0] == "rebalance":
+		method, path = http.MethodGet, "/api/v1/admin/rebalance"
+	case len(args) == 1 && args[0] == "locks":
+		method, path = http.MethodGet, "/api/v1/admin/locks"
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	req, err := http.NewRequest(method, *host+path, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		log.Fatal("storage is not found")
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		log.Fatalf("request failed: %s", resp.Status)
+	}
+
+	if _, err = io.Copy(os.Stdout, resp.Body); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println()
+}
@@ -112,28 +112,41 @@ func sendFile(ctx context.Context, fileName, uploadLink string) error {
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 
-	var buffer bytes.Buffer
-	body := multipart.NewWriter(&buffer)
-
-	writer, err := body.CreateFormFile("file", file.Name())
+	info, err := file.Stat()
 	if err != nil {
 		return err
 	}
 
-	_, err = io.Copy(writer, file)
-	if err != nil {
-		return err
-	}
-	_ = body.Close()
+	// the body is written while it's being sent, the size goes before the file
+	pr, pw := io.Pipe()
+	body := multipart.NewWriter(pw)
+	go func() {
+		if err := body.WriteField("size", strconv.FormatInt(info.Size(), 10)); err != nil {
+			_ = pw.CloseWithError(err)
+			return
+		}
+
+		writer, err := body.CreateFormFile("file", file.Name())
+		if err != nil {
+			_ = pw.CloseWithError(err)
+			return
+		}
+
+		if _, err = io.Copy(writer, file); err != nil {
+			_ = pw.CloseWithError(err)
+			return
+		}
+		_ = pw.CloseWithError(body.Close())
+	}()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uploadLink, &buffer)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uploadLink, pr)
 	if err != nil {
 		return err
 	}
 
 	req.Header.Set("Content-Type", body.FormDataContentType())
-	req.Header.Set("Content-Length", strconv.Itoa(buffer.Len()))
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
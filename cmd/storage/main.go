@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net"
 
@@ -42,6 +43,18 @@ func main() {
 		log.Fatal(err)
 	}
 
+	go func() {
+		if err := fStorage.RunHeartbeats(context.Background()); err != nil {
+			log.Printf("heartbeats stopped: %v", err)
+		}
+	}()
+
+	go func() {
+		if err := fStorage.RunExpiry(context.Background()); err != nil {
+			log.Printf("expiry stopped: %v", err)
+		}
+	}()
+
 	server := grpc.NewServer()
 	protocol.RegisterStorageServer(server, fStorage)
 
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+
 	"go.uber.org/zap"
 
 	"github.com/blkmlk/file-storage/internal/services/repository"
@@ -22,22 +24,88 @@ func main() {
 	container.Provide(repository.New)
 	container.Provide(controllers2.NewUploadController)
 	container.Provide(controllers2.NewProtocolController)
+	container.Provide(controllers2.NewS3Controller)
+	container.Provide(controllers2.NewAdminController)
 	container.Provide(api.New)
 	container.Provide(manager.New)
+	container.Provide(manager.NewDeleter)
+	container.Provide(manager.NewScrubber)
+	container.Provide(manager.NewRepairer)
+	container.Provide(manager.NewMonitor)
+	container.Provide(manager.NewRebalancer)
+	container.Provide(manager.NewGarbageCollector)
 	container.Provide(manager.NewGRPCClientFactory)
-	container.Provide(cache.NewMapCache)
+	container.Provide(manager.NewPlacementPolicy)
+	container.Provide(cache.NewPostgresCache)
 	container.Provide(deps.NewZapLogger)
 
 	var listener api.API
+	var deleter manager.Deleter
+	var scrubber manager.Scrubber
+	var repairer manager.Repairer
+	var monitor manager.Monitor
+	var rebalancer manager.Rebalancer
+	var collector manager.GarbageCollector
 	var log *zap.SugaredLogger
-	err := container.Invoke(func(a api.API, l *zap.SugaredLogger) {
+	err := container.Invoke(func(
+		a api.API,
+		d manager.Deleter,
+		s manager.Scrubber,
+		r manager.Repairer,
+		mon manager.Monitor,
+		rb manager.Rebalancer,
+		gc manager.GarbageCollector,
+		l *zap.SugaredLogger,
+	) {
 		listener = a
+		deleter = d
+		scrubber = s
+		repairer = r
+		monitor = mon
+		rebalancer = rb
+		collector = gc
 		log = l
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	go func() {
+		if err := deleter.Run(context.Background()); err != nil {
+			log.With("err", err).Error("deleter stopped")
+		}
+	}()
+
+	go func() {
+		if err := scrubber.Run(context.Background()); err != nil {
+			log.With("err", err).Error("scrubber stopped")
+		}
+	}()
+
+	go func() {
+		if err := repairer.Run(context.Background()); err != nil {
+			log.With("err", err).Error("repairer stopped")
+		}
+	}()
+
+	go func() {
+		if err := monitor.Run(context.Background()); err != nil {
+			log.With("err", err).Error("monitor stopped")
+		}
+	}()
+
+	go func() {
+		if err := rebalancer.Run(context.Background()); err != nil {
+			log.With("err", err).Error("rebalancer stopped")
+		}
+	}()
+
+	go func() {
+		if err := collector.Run(context.Background()); err != nil {
+			log.With("err", err).Error("garbage collector stopped")
+		}
+	}()
+
 	restHost, err := env.Get(env.RestHost)
 	if err != nil {
 		log.Fatal(err)
@@ -48,7 +116,10 @@ func main() {
 		log.Fatal(err)
 	}
 
-	if err = listener.Start(restHost, protocolHost); err != nil {
+	s3Host := env.GetOptional(env.S3Host, "")
+	adminHost := env.GetOptional(env.AdminHost, "")
+
+	if err = listener.Start(restHost, protocolHost, s3Host, adminHost); err != nil {
 		log.Fatal(err)
 	}
 }
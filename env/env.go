@@ -6,15 +6,50 @@ import (
 )
 
 const (
-	DatabaseURL    = "DATABASE_URL"
-	UploadFileHost = "UPLOAD_FILE_HOST"
-	RestHost       = "REST_HOST"
-	ProtocolHost   = "PROTOCOL_HOST"
-	FSRootPath     = "FS_ROOT_PATH"
-	StorageID      = "STORAGE_ID"
-	StorageHost    = "STORAGE_HOST"
-	RegistryHost   = "REGISTRY_HOST"
-	MinStorages    = "MIN_STORAGES"
+	DatabaseURL         = "DATABASE_URL"
+	UploadFileHost      = "UPLOAD_FILE_HOST"
+	RestHost            = "REST_HOST"
+	ProtocolHost        = "PROTOCOL_HOST"
+	FSRootPath          = "FS_ROOT_PATH"
+	StorageID           = "STORAGE_ID"
+	StorageHost         = "STORAGE_HOST"
+	RegistryHost        = "REGISTRY_HOST"
+	MinStorages         = "MIN_STORAGES"
+	ReplicationFactor   = "REPLICATION_FACTOR"
+	FileEncoding        = "FILE_ENCODING"
+	ErasureDataShards   = "ERASURE_DATA_SHARDS"
+	ErasureParityShards = "ERASURE_PARITY_SHARDS"
+	StreamPartSize      = "STREAM_PART_SIZE"
+	UploadParallelism   = "UPLOAD_PARALLELISM"
+	UploadRetries       = "UPLOAD_RETRIES"
+	UploadRetryBackoff  = "UPLOAD_RETRY_BACKOFF"
+	S3Host              = "S3_HOST"
+	AdminHost           = "ADMIN_HOST"
+	S3AccessKey         = "S3_ACCESS_KEY"
+	S3SecretKey         = "S3_SECRET_KEY"
+	S3Region            = "S3_REGION"
+	ScrubInterval       = "SCRUB_INTERVAL"
+	ScrubRate           = "SCRUB_RATE"
+	HeartbeatInterval   = "HEARTBEAT_INTERVAL"
+	StorageSuspectAfter = "STORAGE_SUSPECT_AFTER"
+	StorageDeadAfter    = "STORAGE_DEAD_AFTER"
+	HighWaterMark       = "HIGH_WATER_MARK"
+	PlacementPolicy     = "PLACEMENT_POLICY"
+	PlacementSpan       = "PLACEMENT_SPAN"
+	StorageZone         = "STORAGE_ZONE"
+	RebalanceInterval   = "REBALANCE_INTERVAL"
+	RebalanceThreshold  = "REBALANCE_THRESHOLD"
+	RebalanceRate       = "REBALANCE_RATE"
+	PreparedTTL         = "PREPARED_TTL"
+	GCInterval          = "GC_INTERVAL"
+	GCUploadTTL         = "GC_UPLOAD_TTL"
+	GCOrphanAge         = "GC_ORPHAN_AGE"
+	GCDryRun            = "GC_DRY_RUN"
+	LockTTL             = "LOCK_TTL"
+	LockWait            = "LOCK_WAIT"
+	ReadCacheSize       = "READ_CACHE_SIZE"
+	ReadCacheMaxObject  = "READ_CACHE_MAX_OBJECT"
+	Versioning          = "VERSIONING"
 )
 
 func NewErrNotSet(env string) error {
@@ -7,7 +7,9 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"sort"
 	"sync"
+	"time"
 
 	"google.golang.org/grpc/metadata"
 
@@ -19,9 +21,10 @@ import (
 )
 
 type FilePart struct {
-	ID   string
-	Size int64
-	Data bytes.Buffer
+	ID         string
+	Size       int64
+	Data       bytes.Buffer
+	ModifiedAt time.Time
 }
 
 func NewStorage(ctx context.Context) *Storage {
@@ -34,6 +37,8 @@ func NewStorage(ctx context.Context) *Storage {
 type Storage struct {
 	Ctx  context.Context
 	Size int64
+	// UploadErr makes every upload to the storage fail
+	UploadErr error
 
 	locker    sync.RWMutex
 	fileParts map[string]*FilePart
@@ -50,6 +55,16 @@ func (s *Storage) GetFileParts() []FilePart {
 	return result
 }
 
+// Corrupt flips the first byte of the file part, as if the disk went bad.
+func (s *Storage) Corrupt(id string) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if fp, ok := s.fileParts[id]; ok && fp.Data.Len() > 0 {
+		fp.Data.Bytes()[0] ^= 0xff
+	}
+}
+
 func (s *Storage) CheckReadiness(ctx context.Context, in *protocol.CheckReadinessRequest, opts ...grpc.CallOption) (*protocol.CheckReadinessResponse, error) {
 	if s.Size > 0 && in.Size > s.Size {
 		return &protocol.CheckReadinessResponse{Ready: false}, nil
@@ -75,6 +90,8 @@ func (s *Storage) CheckFilePartExistence(ctx context.Context, in *protocol.Check
 
 func (s *Storage) UploadFile(ctx context.Context, opts ...grpc.CallOption) (protocol.Storage_UploadFileClient, error) {
 	return &storageUploadStream{
+		ctx:       ctx,
+		err:       s.UploadErr,
 		locker:    &s.locker,
 		fileParts: s.fileParts,
 	}, nil
@@ -88,19 +105,86 @@ func (s *Storage) GetFile(ctx context.Context, in *protocol.GetFileRequest, opts
 		return nil, fmt.Errorf("not found")
 	}
 
+	end := fp.Data.Len()
+	if in.Length > 0 && int(in.Offset+in.Length) < end {
+		end = int(in.Offset + in.Length)
+	}
+
 	return &storageGetFileStream{
 		fp:        *fp,
 		chunkSize: in.ChunkSize,
+		offset:    int(in.Offset),
+		end:       end,
+	}, nil
+}
+
+func (s *Storage) VerifyFilePart(ctx context.Context, in *protocol.VerifyFilePartRequest, opts ...grpc.CallOption) (*protocol.VerifyFilePartResponse, error) {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+
+	fp, ok := s.fileParts[in.Id]
+	if !ok {
+		return &protocol.VerifyFilePartResponse{Exists: false}, nil
+	}
+
+	h := sha256.Sum256(fp.Data.Bytes())
+	return &protocol.VerifyFilePartResponse{
+		Exists: true,
+		Hash:   hex.EncodeToString(h[:]),
+		Size:   int64(fp.Data.Len()),
 	}, nil
 }
 
+func (s *Storage) DeleteFilePart(ctx context.Context, in *protocol.DeleteFilePartRequest, opts ...grpc.CallOption) (*protocol.DeleteFilePartResponse, error) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	delete(s.fileParts, in.Id)
+	return &protocol.DeleteFilePartResponse{}, nil
+}
+
+// ListFileParts lists the parts which have any data, as only they have files on disk.
+func (s *Storage) ListFileParts(ctx context.Context, in *protocol.ListFilePartsRequest, opts ...grpc.CallOption) (*protocol.ListFilePartsResponse, error) {
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+
+	var parts []*protocol.StoredFilePart
+	for _, fp := range s.fileParts {
+		if fp.Data.Len() == 0 || fp.ID <= in.StartAfter {
+			continue
+		}
+		parts = append(parts, &protocol.StoredFilePart{
+			Id:         fp.ID,
+			Size:       int64(fp.Data.Len()),
+			ModifiedAt: fp.ModifiedAt.Unix(),
+		})
+	}
+
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].Id < parts[j].Id
+	})
+	if in.Limit > 0 && len(parts) > int(in.Limit) {
+		parts = parts[:in.Limit]
+	}
+	return &protocol.ListFilePartsResponse{Parts: parts}, nil
+}
+
 type storageUploadStream struct {
+	ctx       context.Context
+	err       error
 	lastID    string
 	locker    *sync.RWMutex
 	fileParts map[string]*FilePart
 }
 
 func (s *storageUploadStream) Send(request *protocol.UploadFileRequest) error {
+	if s.err != nil {
+		return s.err
+	}
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
 	s.locker.Lock()
 	defer s.locker.Unlock()
 
@@ -110,6 +194,7 @@ func (s *storageUploadStream) Send(request *protocol.UploadFileRequest) error {
 	}
 	s.lastID = request.Id
 	fp.Data.Write(request.Data)
+	fp.ModifiedAt = time.Now()
 
 	return nil
 }
@@ -170,16 +255,17 @@ type storageGetFileStream struct {
 	fp        FilePart
 	chunkSize int64
 	offset    int
+	end       int
 }
 
 func (s *storageGetFileStream) Recv() (*protocol.GetFileResponse, error) {
-	if int64(s.offset) >= s.fp.Size {
+	if s.offset >= s.end {
 		return nil, io.EOF
 	}
 
 	chunkSize := int(s.chunkSize)
-	if s.offset+int(s.chunkSize) > s.fp.Data.Len() {
-		chunkSize = s.fp.Data.Len() - s.offset
+	if s.offset+int(s.chunkSize) > s.end {
+		chunkSize = s.end - s.offset
 	}
 
 	resp := &protocol.GetFileResponse{
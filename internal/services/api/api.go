@@ -1,6 +1,7 @@
 package api
 
 import (
+	"expvar"
 	"net"
 
 	controllers2 "github.com/blkmlk/file-storage/internal/services/api/controllers"
@@ -11,36 +12,68 @@ import (
 )
 
 type API interface {
-	Start(restHost, protocolHost string) error
+	Start(restHost, protocolHost, s3Host, adminHost string) error
 	Stop() error
 }
 
 const (
 	PathGetUploadFile   = "/api/v1/upload"
 	PathPostUploadFile  = "/api/v1/upload/:id"
+	PathPutUploadFile   = "/api/v1/upload/:id"
 	PathGetDownloadFile = "/api/v1/download/:name"
+	PathDeleteFile      = "/api/v1/files/:name"
+	PathGetFileVersions = "/api/v1/versions/:name"
+
+	PathPostInitiateUpload = "/api/v1/multipart"
+	PathPutUploadPart      = "/api/v1/multipart/:id/parts/:number"
+	PathGetUploadParts     = "/api/v1/multipart/:id/parts"
+	PathPostCompleteUpload = "/api/v1/multipart/:id/complete"
+	PathDeleteUpload       = "/api/v1/multipart/:id"
+
+	PathGetRebalance     = "/api/v1/admin/rebalance"
+	PathGetStorage       = "/api/v1/admin/storages/:id"
+	PathPostDrainStorage = "/api/v1/admin/storages/:id/drain"
+	PathGetLocks         = "/api/v1/admin/locks"
+
+	PathDebugVars = "/debug/vars"
+
+	PathS3Buckets = "/"
+	PathS3Bucket  = "/:bucket"
+	PathS3Object  = "/:bucket/*key"
 )
 
 type api struct {
 	restController     *controllers2.RestController
 	protocolController *controllers2.ProtocolController
+	s3Controller       *controllers2.S3Controller
+	adminController    *controllers2.AdminController
 	restServer         *gin.Engine
 	grpcServer         *grpc.Server
+	s3Server           *gin.Engine
+	adminServer        *gin.Engine
 }
 
 func New(
 	restController *controllers2.RestController,
 	protocolController *controllers2.ProtocolController,
+	s3Controller *controllers2.S3Controller,
+	adminController *controllers2.AdminController,
 ) (API, error) {
 
 	a := api{
 		restController:     restController,
 		protocolController: protocolController,
+		s3Controller:       s3Controller,
+		adminController:    adminController,
 		restServer:         gin.Default(),
+		s3Server:           gin.Default(),
+		adminServer:        gin.Default(),
 	}
 
 	a.initRest()
 	a.initGrpc()
+	a.initS3()
+	a.initAdmin()
 
 	return &a, nil
 }
@@ -48,7 +81,28 @@ func New(
 func (a *api) initRest() {
 	a.restServer.GET(PathGetUploadFile, a.restController.GetUploadLink)
 	a.restServer.POST(PathPostUploadFile, a.restController.PostUploadFile)
+	a.restServer.PUT(PathPutUploadFile, a.restController.PutUploadFile)
 	a.restServer.GET(PathGetDownloadFile, a.restController.GetDownloadFile)
+	a.restServer.DELETE(PathDeleteFile, a.restController.DeleteFile)
+	a.restServer.GET(PathGetFileVersions, a.restController.GetFileVersions)
+
+	a.restServer.POST(PathPostInitiateUpload, a.restController.PostInitiateUpload)
+	a.restServer.PUT(PathPutUploadPart, a.restController.PutUploadPart)
+	a.restServer.GET(PathGetUploadParts, a.restController.GetUploadParts)
+	a.restServer.POST(PathPostCompleteUpload, a.restController.PostCompleteUpload)
+	a.restServer.DELETE(PathDeleteUpload, a.restController.DeleteUpload)
+}
+
+// initAdmin sets up the routes which control the cluster. They have no authentication,
+// so they are served on their own host which must not be reachable by clients.
+func (a *api) initAdmin() {
+	a.adminServer.GET(PathGetRebalance, a.adminController.GetRebalance)
+	a.adminServer.GET(PathGetStorage, a.adminController.GetStorage)
+	a.adminServer.POST(PathPostDrainStorage, a.adminController.PostDrainStorage)
+	a.adminServer.GET(PathGetLocks, a.adminController.GetLocks)
+
+	// metrics of background jobs
+	a.adminServer.GET(PathDebugVars, gin.WrapH(expvar.Handler()))
 }
 
 func (a *api) initGrpc() {
@@ -56,7 +110,27 @@ func (a *api) initGrpc() {
 	protocol.RegisterUploaderServer(a.grpcServer, a.protocolController)
 }
 
-func (a *api) Start(restHost, protocolHost string) error {
+func (a *api) initS3() {
+	// keys may end with a slash, so they must not be redirected
+	a.s3Server.RedirectTrailingSlash = false
+	a.s3Server.Use(a.s3Controller.Authenticate)
+
+	a.s3Server.GET(PathS3Buckets, a.s3Controller.ListBuckets)
+
+	a.s3Server.PUT(PathS3Bucket, a.s3Controller.PutBucket)
+	a.s3Server.HEAD(PathS3Bucket, a.s3Controller.HeadBucket)
+	a.s3Server.GET(PathS3Bucket, a.s3Controller.GetBucket)
+	a.s3Server.DELETE(PathS3Bucket, a.s3Controller.DeleteBucket)
+
+	a.s3Server.PUT(PathS3Object, a.s3Controller.PutObject)
+	a.s3Server.GET(PathS3Object, a.s3Controller.GetObject)
+	a.s3Server.HEAD(PathS3Object, a.s3Controller.HeadObject)
+	a.s3Server.DELETE(PathS3Object, a.s3Controller.DeleteObject)
+	a.s3Server.POST(PathS3Object, a.s3Controller.PostObject)
+}
+
+// Start serves the S3 gateway and the admin API only when their hosts are set.
+func (a *api) Start(restHost, protocolHost, s3Host, adminHost string) error {
 	listener, err := net.Listen("tcp", protocolHost)
 	if err != nil {
 		return err
@@ -72,6 +146,18 @@ func (a *api) Start(restHost, protocolHost string) error {
 		errs <- a.restServer.Run(restHost)
 	}()
 
+	if s3Host != "" {
+		go func() {
+			errs <- a.s3Server.Run(s3Host)
+		}()
+	}
+
+	if adminHost != "" {
+		go func() {
+			errs <- a.adminServer.Run(adminHost)
+		}()
+	}
+
 	return <-errs
 }
 
@@ -0,0 +1,163 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/blkmlk/file-storage/internal/services/cache"
+	"github.com/blkmlk/file-storage/internal/services/manager"
+	"github.com/blkmlk/file-storage/internal/services/repository"
+)
+
+// AdminController lets operators drain storages and see the state of background jobs and locks.
+type AdminController struct {
+	repo       repository.Repository
+	log        *zap.SugaredLogger
+	cache      cache.Cache
+	rebalancer manager.Rebalancer
+}
+
+type StorageStatusResponse struct {
+	ID       string `json:"id"`
+	Host     string `json:"host"`
+	Zone     string `json:"zone,omitempty"`
+	State    string `json:"state"`
+	Draining bool   `json:"draining"`
+	Parts    int64  `json:"parts"`
+	// SafeToRemove is set once a drained storage keeps no parts
+	SafeToRemove bool `json:"safe_to_remove"`
+}
+
+type RebalanceProgressResponse struct {
+	Running      bool       `json:"running"`
+	StartedAt    *time.Time `json:"started_at,omitempty"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+	PlannedBytes int64      `json:"planned_bytes"`
+	MovedParts   int        `json:"moved_parts"`
+	MovedBytes   int64      `json:"moved_bytes"`
+	FailedParts  int        `json:"failed_parts"`
+	LastError    string     `json:"last_error,omitempty"`
+}
+
+type LockResponse struct {
+	Key        string    `json:"key"`
+	Owner      string    `json:"owner"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// Age is how long the lock is held, e.g. 1m30s
+	Age string `json:"age"`
+}
+
+func NewAdminController(
+	repo repository.Repository,
+	log *zap.SugaredLogger,
+	cache cache.Cache,
+	rebalancer manager.Rebalancer,
+) *AdminController {
+	return &AdminController{
+		repo:       repo,
+		log:        log,
+		cache:      cache,
+		rebalancer: rebalancer,
+	}
+}
+
+func (c *AdminController) GetStorage(ctx *gin.Context) {
+	c.writeStorageStatus(ctx, ctx.Param("id"), http.StatusOK)
+}
+
+// PostDrainStorage stops placing new parts on the storage. Its parts are moved
+// to other storages by the rebalancer.
+func (c *AdminController) PostDrainStorage(ctx *gin.Context) {
+	id := ctx.Param("id")
+	if err := c.repo.DrainStorage(ctx, id); err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		c.log.With("err", err).Error("failed to drain storage")
+		ctx.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.log.Infof("storage %s is draining", id)
+	c.writeStorageStatus(ctx, id, http.StatusAccepted)
+}
+
+func (c *AdminController) writeStorageStatus(ctx *gin.Context, id string, code int) {
+	storage, err := c.repo.GetStorage(ctx, id)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			ctx.Status(http.StatusNotFound)
+			return
+		}
+		c.log.With("err", err).Error("failed to get storage")
+		ctx.Status(http.StatusInternalServerError)
+		return
+	}
+
+	parts, err := c.repo.CountStorageParts(ctx, id)
+	if err != nil {
+		c.log.With("err", err).Error("failed to count storage parts")
+		ctx.Status(http.StatusInternalServerError)
+		return
+	}
+
+	ctx.JSON(code, StorageStatusResponse{
+		ID:           storage.ID,
+		Host:         storage.Host,
+		Zone:         storage.Zone,
+		State:        string(storage.State),
+		Draining:     storage.DrainingAt != nil && storage.RetiredAt == nil,
+		Parts:        parts,
+		SafeToRemove: storage.RetiredAt != nil,
+	})
+}
+
+func (c *AdminController) GetRebalance(ctx *gin.Context) {
+	progress := c.rebalancer.Progress()
+
+	resp := RebalanceProgressResponse{
+		Running:      progress.Running,
+		PlannedBytes: progress.PlannedBytes,
+		MovedParts:   progress.MovedParts,
+		MovedBytes:   progress.MovedBytes,
+		FailedParts:  progress.FailedParts,
+		LastError:    progress.LastError,
+	}
+	if !progress.StartedAt.IsZero() {
+		resp.StartedAt = &progress.StartedAt
+	}
+	if !progress.FinishedAt.IsZero() {
+		resp.FinishedAt = &progress.FinishedAt
+	}
+
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// GetLocks lists the locks held by all uploaders, the oldest first.
+func (c *AdminController) GetLocks(ctx *gin.Context) {
+	locks, err := c.cache.Locks(ctx)
+	if err != nil {
+		c.log.With("err", err).Error("failed to list locks")
+		ctx.Status(http.StatusInternalServerError)
+		return
+	}
+
+	resp := make([]LockResponse, 0, len(locks))
+	for _, l := range locks {
+		resp = append(resp, LockResponse{
+			Key:        l.Key,
+			Owner:      l.Owner,
+			AcquiredAt: l.AcquiredAt,
+			ExpiresAt:  l.ExpiresAt,
+			Age:        time.Since(l.AcquiredAt).Round(time.Second).String(),
+		})
+	}
+
+	ctx.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,85 @@
+package controllers
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/blkmlk/file-storage/internal/services/manager"
+	"github.com/blkmlk/file-storage/internal/services/repository"
+)
+
+var errInvalidChecksum = errors.New("invalid checksum")
+
+// parseChecksums reads the checksums the client expects the body to have. Content-MD5
+// is base64-encoded, the SHA-256 is either hex or base64 as S3 clients send it.
+func parseChecksums(header http.Header) (manager.Checksums, error) {
+	var sums manager.Checksums
+
+	if value := header.Get("Content-MD5"); value != "" {
+		digest, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(digest) != md5.Size {
+			return sums, errInvalidChecksum
+		}
+		sums.MD5 = digest
+	}
+
+	for _, name := range []string{"X-Checksum-Sha256", "X-Amz-Checksum-Sha256"} {
+		value := header.Get(name)
+		if value == "" {
+			continue
+		}
+		digest, err := decodeSHA256(value)
+		if err != nil {
+			return sums, err
+		}
+		sums.SHA256 = digest
+	}
+
+	return sums, nil
+}
+
+func decodeSHA256(value string) ([]byte, error) {
+	if len(value) == hex.EncodedLen(sha256.Size) {
+		if digest, err := hex.DecodeString(value); err == nil {
+			return digest, nil
+		}
+	}
+	digest, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(digest) != sha256.Size {
+		return nil, errInvalidChecksum
+	}
+	return digest, nil
+}
+
+// fileETag is the quoted hash of the file or an empty string when it isn't known.
+func fileETag(file *repository.File) string {
+	if file.Hash == "" {
+		return ""
+	}
+	return strconv.Quote(file.Hash)
+}
+
+// fileDigest is the Digest header of the file. Files assembled from parts
+// have no SHA-256 of the whole content, so they have no digest.
+func fileDigest(file *repository.File) string {
+	digest, err := hex.DecodeString(file.Hash)
+	if err != nil || len(digest) != sha256.Size {
+		return ""
+	}
+	return "sha-256=" + base64.StdEncoding.EncodeToString(digest)
+}
+
+// setFileHeaders adds the ETag and Digest of the file when they're known.
+func setFileHeaders(headers map[string]string, file *repository.File) {
+	if etag := fileETag(file); etag != "" {
+		headers["ETag"] = etag
+	}
+	if digest := fileDigest(file); digest != "" {
+		headers["Digest"] = digest
+	}
+}
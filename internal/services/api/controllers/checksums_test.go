@@ -0,0 +1,59 @@
+package controllers
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseChecksums(t *testing.T) {
+	data := []byte("hello")
+	md5Sum := md5.Sum(data)
+	sha256Sum := sha256.Sum256(data)
+
+	tests := []struct {
+		name   string
+		header http.Header
+		md5    []byte
+		sha256 []byte
+		err    bool
+	}{
+		{name: "none", header: http.Header{}},
+		{
+			name:   "content md5",
+			header: http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(md5Sum[:])}},
+			md5:    md5Sum[:],
+		},
+		{
+			name:   "hex sha256",
+			header: http.Header{"X-Checksum-Sha256": {hex.EncodeToString(sha256Sum[:])}},
+			sha256: sha256Sum[:],
+		},
+		{
+			name:   "base64 sha256",
+			header: http.Header{"X-Amz-Checksum-Sha256": {base64.StdEncoding.EncodeToString(sha256Sum[:])}},
+			sha256: sha256Sum[:],
+		},
+		{name: "invalid md5", header: http.Header{"Content-Md5": {"invalid"}}, err: true},
+		{name: "short md5", header: http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(data)}}, err: true},
+		{name: "invalid sha256", header: http.Header{"X-Checksum-Sha256": {hex.EncodeToString(md5Sum[:])}}, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sums, err := parseChecksums(tt.header)
+			if tt.err {
+				require.ErrorIs(t, err, errInvalidChecksum)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.md5, sums.MD5)
+			require.Equal(t, tt.sha256, sums.SHA256)
+		})
+	}
+}
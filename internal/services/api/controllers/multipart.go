@@ -0,0 +1,156 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/blkmlk/file-storage/internal/services/manager"
+)
+
+type PostInitiateUploadRequest struct {
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Replicas    int    `json:"replicas"`
+}
+
+type PostInitiateUploadResponse struct {
+	UploadID string `json:"upload_id"`
+}
+
+type UploadedPartResponse struct {
+	Number int    `json:"number"`
+	Size   int64  `json:"size"`
+	Hash   string `json:"hash"`
+}
+
+type GetUploadPartsResponse struct {
+	Parts []UploadedPartResponse `json:"parts"`
+}
+
+type PostCompleteUploadRequest struct {
+	Parts []int `json:"parts"`
+}
+
+func (c *RestController) PostInitiateUpload(ctx *gin.Context) {
+	var req PostInitiateUploadRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil || req.Name == "" || req.Replicas < 0 {
+		ctx.String(http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	uploadID, err := c.fileManager.InitiateUpload(ctx, manager.FileInfo{
+		Name:        req.Name,
+		ContentType: req.ContentType,
+		Replicas:    req.Replicas,
+	})
+	if err != nil {
+		if errors.Is(err, manager.ErrExists) {
+			ctx.String(http.StatusForbidden, "file is stored")
+			return
+		}
+		c.log.With("err", err).Error("failed to initiate upload")
+		ctx.Status(http.StatusInternalServerError)
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, &PostInitiateUploadResponse{
+		UploadID: uploadID,
+	})
+}
+
+func (c *RestController) PutUploadPart(ctx *gin.Context) {
+	number, err := strconv.Atoi(ctx.Param("number"))
+	if err != nil {
+		ctx.String(http.StatusBadRequest, "invalid part number")
+		return
+	}
+
+	size := ctx.Request.ContentLength
+	if size < 0 {
+		ctx.Status(http.StatusLengthRequired)
+		return
+	}
+	if size == 0 {
+		ctx.String(http.StatusBadRequest, "empty part")
+		return
+	}
+
+	part, err := c.fileManager.UploadPart(ctx, ctx.Param("id"), number, size, ctx.Request.Body)
+	if err != nil {
+		c.handleUploadError(ctx, err, "failed to upload part")
+		return
+	}
+
+	ctx.Header("ETag", strconv.Quote(part.Hash))
+	ctx.JSON(http.StatusOK, newUploadedPartResponse(*part))
+}
+
+func (c *RestController) GetUploadParts(ctx *gin.Context) {
+	parts, err := c.fileManager.ListParts(ctx, ctx.Param("id"))
+	if err != nil {
+		c.handleUploadError(ctx, err, "failed to list parts")
+		return
+	}
+
+	resp := GetUploadPartsResponse{
+		Parts: make([]UploadedPartResponse, 0, len(parts)),
+	}
+	for _, p := range parts {
+		resp.Parts = append(resp.Parts, newUploadedPartResponse(p))
+	}
+
+	ctx.JSON(http.StatusOK, &resp)
+}
+
+func (c *RestController) PostCompleteUpload(ctx *gin.Context) {
+	var req PostCompleteUploadRequest
+	if ctx.Request.ContentLength != 0 {
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.String(http.StatusBadRequest, "invalid request")
+			return
+		}
+	}
+
+	if err := c.fileManager.CompleteUpload(ctx, ctx.Param("id"), req.Parts); err != nil {
+		c.handleUploadError(ctx, err, "failed to complete upload")
+		return
+	}
+
+	ctx.Status(http.StatusCreated)
+}
+
+func (c *RestController) DeleteUpload(ctx *gin.Context) {
+	if err := c.fileManager.AbortUpload(ctx, ctx.Param("id")); err != nil {
+		c.handleUploadError(ctx, err, "failed to abort upload")
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+func (c *RestController) handleUploadError(ctx *gin.Context, err error, msg string) {
+	switch {
+	case errors.Is(err, manager.ErrUploadNotFound):
+		ctx.String(http.StatusNotFound, "upload not found")
+	case errors.Is(err, manager.ErrPartNotFound):
+		ctx.String(http.StatusBadRequest, "part not found")
+	case errors.Is(err, manager.ErrInvalidPartNumber):
+		ctx.String(http.StatusBadRequest, "invalid part number")
+	case errors.Is(err, manager.ErrBusy):
+		ctx.String(http.StatusForbidden, "upload is busy")
+	default:
+		c.log.With("err", err).Error(msg)
+		ctx.Status(http.StatusInternalServerError)
+	}
+}
+
+func newUploadedPartResponse(part manager.UploadedPart) UploadedPartResponse {
+	return UploadedPartResponse{
+		Number: part.Number,
+		Size:   part.Size,
+		Hash:   part.Hash,
+	}
+}
@@ -0,0 +1,29 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/blkmlk/file-storage/internal/services/manager"
+)
+
+// parsePrecondition reads the If-Match and If-None-Match headers of a write.
+// Every header may hold a comma-separated list of ETags or "*".
+func parsePrecondition(header http.Header) manager.Precondition {
+	return manager.Precondition{
+		IfMatch:     splitETags(header.Values("If-Match")),
+		IfNoneMatch: splitETags(header.Values("If-None-Match")),
+	}
+}
+
+func splitETags(values []string) []string {
+	var etags []string
+	for _, v := range values {
+		for _, e := range strings.Split(v, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				etags = append(etags, e)
+			}
+		}
+	}
+	return etags
+}
@@ -0,0 +1,22 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePrecondition(t *testing.T) {
+	header := http.Header{}
+	require.Empty(t, parsePrecondition(header).IfMatch)
+	require.Empty(t, parsePrecondition(header).IfNoneMatch)
+
+	header.Add("If-Match", `"abc", W/"def"`)
+	header.Add("If-Match", `"ghi"`)
+	header.Set("If-None-Match", "*")
+
+	p := parsePrecondition(header)
+	require.Equal(t, []string{`"abc"`, `W/"def"`, `"ghi"`}, p.IfMatch)
+	require.Equal(t, []string{"*"}, p.IfNoneMatch)
+}
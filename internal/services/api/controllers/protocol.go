@@ -21,9 +21,29 @@ func NewProtocolController(repo repository2.Repository) *ProtocolController {
 
 func (p *ProtocolController) Register(ctx context.Context, request *protocol.RegisterRequest) (*protocol.RegisterResponse, error) {
 	storage := repository2.NewStorage(request.StorageId, request.Host)
+	storage.Zone = request.Zone
 	if err := p.repo.CreateOrUpdateStorage(ctx, &storage); err != nil {
 		//	log
 		return nil, err
 	}
 	return &protocol.RegisterResponse{}, nil
 }
+
+// Heartbeat keeps the storage alive. A storage which isn't known yet, e.g. after
+// the DB is restored from a backup, is registered again.
+func (p *ProtocolController) Heartbeat(ctx context.Context, request *protocol.HeartbeatRequest) (*protocol.HeartbeatResponse, error) {
+	storage := repository2.NewStorage(request.StorageId, request.Host)
+	storage.Zone = request.Zone
+	if err := p.repo.CreateOrUpdateStorage(ctx, &storage); err != nil {
+		return nil, err
+	}
+
+	// a storage which failed to check its disk reports no capacity
+	if request.TotalBytes > 0 {
+		err := p.repo.UpdateStorageUsage(ctx, request.StorageId, request.TotalBytes, request.UsedBytes, request.FreeBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &protocol.HeartbeatResponse{}, nil
+}
@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errInvalidRange = errors.New("invalid range")
+)
+
+type httpRange struct {
+	start  int64
+	length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+func (r httpRange) mimeHeader(contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {r.contentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+// parseRange parses a Range header as per RFC 7233. Ranges which start
+// beyond the size are skipped, errInvalidRange is returned when nothing is left.
+func parseRange(header string, size int64) ([]httpRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, errInvalidRange
+	}
+
+	var ranges []httpRange
+	noOverlap := false
+	for _, spec := range strings.Split(header[len(prefix):], ",") {
+		spec = textproto.TrimString(spec)
+		if spec == "" {
+			continue
+		}
+
+		startValue, endValue, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, errInvalidRange
+		}
+		startValue, endValue = textproto.TrimString(startValue), textproto.TrimString(endValue)
+
+		var r httpRange
+		if startValue == "" {
+			// a suffix range: the last N bytes
+			if endValue == "" || endValue[0] == '-' {
+				return nil, errInvalidRange
+			}
+			n, err := strconv.ParseInt(endValue, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errInvalidRange
+			}
+			if n > size {
+				n = size
+			}
+			r.start = size - n
+			r.length = n
+		} else {
+			start, err := strconv.ParseInt(startValue, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errInvalidRange
+			}
+			if start >= size {
+				noOverlap = true
+				continue
+			}
+			r.start = start
+
+			if endValue == "" {
+				r.length = size - start
+			} else {
+				end, err := strconv.ParseInt(endValue, 10, 64)
+				if err != nil || start > end {
+					return nil, errInvalidRange
+				}
+				if end >= size {
+					end = size - 1
+				}
+				r.length = end - start + 1
+			}
+		}
+
+		if r.length > 0 {
+			ranges = append(ranges, r)
+		}
+	}
+
+	if noOverlap && len(ranges) == 0 {
+		return nil, errInvalidRange
+	}
+	return ranges, nil
+}
+
+func sumRangesSize(ranges []httpRange) int64 {
+	var size int64
+	for _, r := range ranges {
+		size += r.length
+	}
+	return size
+}
+
+// checkIfRange reports whether the Range header should be applied for the file
+// with the given entity tag last modified at the given time.
+func checkIfRange(request *http.Request, etag string, modifiedAt time.Time) bool {
+	value := request.Header.Get("If-Range")
+	if value == "" {
+		return true
+	}
+
+	// weak entity tags can't be used with ranges
+	if strings.HasPrefix(value, "W/") {
+		return false
+	}
+	if strings.HasPrefix(value, `"`) {
+		return etag != "" && value == etag
+	}
+
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return false
+	}
+	return modifiedAt.Truncate(time.Second).Equal(t)
+}
@@ -0,0 +1,40 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		ranges []httpRange
+		err    bool
+	}{
+		{header: "bytes=0-99", ranges: []httpRange{{start: 0, length: 100}}},
+		{header: "bytes=100-", ranges: []httpRange{{start: 100, length: 900}}},
+		{header: "bytes=-100", ranges: []httpRange{{start: 900, length: 100}}},
+		{header: "bytes=-2000", ranges: []httpRange{{start: 0, length: 1000}}},
+		{header: "bytes=900-1999", ranges: []httpRange{{start: 900, length: 100}}},
+		{header: "bytes=0-0, 10-19", ranges: []httpRange{{start: 0, length: 1}, {start: 10, length: 10}}},
+		{header: "bytes=0-9,2000-", ranges: []httpRange{{start: 0, length: 10}}},
+		{header: "bytes=2000-", err: true},
+		{header: "bytes=20-10", err: true},
+		{header: "bytes=a-b", err: true},
+		{header: "bytes=10", err: true},
+		{header: "items=0-10", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			ranges, err := parseRange(tt.header, 1000)
+			if tt.err {
+				require.ErrorIs(t, err, errInvalidRange)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.ranges, ranges)
+		})
+	}
+}
@@ -3,7 +3,11 @@ package controllers
 import (
 	"errors"
 	"fmt"
+	"io"
+	"mime/multipart"
 	"net/http"
+	"strconv"
+	"time"
 
 	"go.uber.org/zap"
 
@@ -16,6 +20,9 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// HeaderVersionID tells the version of an uploaded or downloaded file.
+const HeaderVersionID = "X-Version-Id"
+
 type RestController struct {
 	repo           repository.Repository
 	log            *zap.SugaredLogger
@@ -27,6 +34,15 @@ type GetUploadLinkResponse struct {
 	UploadLink string `json:"upload_link"`
 }
 
+type FileVersionResponse struct {
+	VersionID    string    `json:"version_id"`
+	Size         int64     `json:"size"`
+	Hash         string    `json:"hash,omitempty"`
+	IsLatest     bool      `json:"is_latest"`
+	DeleteMarker bool      `json:"delete_marker"`
+	LastModified time.Time `json:"last_modified"`
+}
+
 func NewUploadController(
 	repo repository.Repository,
 	log *zap.SugaredLogger,
@@ -60,64 +76,160 @@ func (c *RestController) GetUploadLink(ctx *gin.Context) {
 	})
 }
 
+// PostUploadFile streams the "file" part of a multipart form straight into storages.
+// Its size is taken from the "size" field sent before the file, the Content-Length
+// header of the part or the size query parameter. Without any of them the size
+// is known only when the part ends.
 func (c *RestController) PostUploadFile(ctx *gin.Context) {
-	mf, err := ctx.MultipartForm()
+	mr, err := ctx.Request.MultipartReader()
 	if err != nil {
-		c.log.With("err", err).Error("failed to open multiform")
-		ctx.Status(http.StatusInternalServerError)
+		ctx.String(http.StatusBadRequest, "multipart form is expected")
 		return
 	}
 
-	files, ok := mf.File["file"]
-	if !ok {
-		c.log.With("err", err).Error("no file is provided in request")
-		ctx.Status(http.StatusInternalServerError)
+	size, err := parseSize(ctx.Query("size"))
+	if err != nil {
+		ctx.String(http.StatusBadRequest, "invalid size")
 		return
 	}
 
-	if len(files) != 1 {
-		c.log.With("err", err).Error("provided more than 1 file")
-		ctx.Status(http.StatusInternalServerError)
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				ctx.String(http.StatusBadRequest, "no file is provided in request")
+				return
+			}
+			c.log.With("err", err).Error("failed to read multipart form")
+			ctx.String(http.StatusBadRequest, "invalid multipart form")
+			return
+		}
+
+		switch part.FormName() {
+		case "size":
+			value, err := io.ReadAll(io.LimitReader(part, 20))
+			if err == nil {
+				size, err = parseSize(string(value))
+			}
+			if err != nil {
+				ctx.String(http.StatusBadRequest, "invalid size")
+				return
+			}
+		case "file":
+			if value := part.Header.Get("Content-Length"); value != "" {
+				if size, err = parseSize(value); err != nil {
+					ctx.String(http.StatusBadRequest, "invalid size")
+					return
+				}
+			}
+
+			c.storeFile(ctx, part.FileName(), part.Header.Get("Content-Type"), size, part)
+			return
+		}
+	}
+}
+
+// PutUploadFile streams the raw request body, the name is passed in the query.
+// A chunked body has no Content-Length, so its size is known only when it ends.
+func (c *RestController) PutUploadFile(ctx *gin.Context) {
+	name := ctx.Query("name")
+	if name == "" {
+		ctx.String(http.StatusBadRequest, "name is required")
+		return
+	}
+
+	c.storeFile(ctx, name, ctx.GetHeader("Content-Type"), ctx.Request.ContentLength, ctx.Request.Body)
+}
+
+func (c *RestController) storeFile(ctx *gin.Context, name, contentType string, size int64, reader io.Reader) {
+	if name == "" {
+		ctx.String(http.StatusBadRequest, "file name is required")
 		return
 	}
 
-	file := files[0]
+	var replicas int
+	if value := ctx.Query("replicas"); value != "" {
+		var err error
+		replicas, err = strconv.Atoi(value)
+		if err != nil || replicas < 1 {
+			ctx.String(http.StatusBadRequest, "replicas must be a positive integer")
+			return
+		}
+	}
 
-	id := ctx.Param("id")
+	encoding := repository.FileEncoding(ctx.Query("encoding"))
+	switch encoding {
+	case "", repository.FileEncodingReplication, repository.FileEncodingErasure:
+	default:
+		ctx.String(http.StatusBadRequest, "unknown encoding")
+		return
+	}
 
-	pipe, err := file.Open()
+	checksums, err := parseChecksums(ctx.Request.Header)
 	if err != nil {
-		c.log.With("err", err).Error("failed to open file")
-		ctx.Status(http.StatusInternalServerError)
+		ctx.String(http.StatusBadRequest, "invalid checksum")
 		return
 	}
 
+	// a file which is expected to match an ETag is replaced
+	precondition := parsePrecondition(ctx.Request.Header)
+	overwrite := len(precondition.IfMatch) > 0
+	if value := ctx.Query("overwrite"); value != "" {
+		if overwrite, err = strconv.ParseBool(value); err != nil {
+			ctx.String(http.StatusBadRequest, "overwrite must be a boolean")
+			return
+		}
+	}
+
 	fileInfo := manager.FileInfo{
-		Name:        file.Filename,
-		ContentType: file.Header.Get("Content-Type"),
-		Size:        file.Size,
+		Name:         name,
+		ContentType:  contentType,
+		Size:         size,
+		Replicas:     replicas,
+		Encoding:     encoding,
+		Checksums:    checksums,
+		Overwrite:    overwrite,
+		Precondition: precondition,
 	}
 
-	err = c.fileManager.Store(ctx, id, fileInfo, pipe)
+	err = c.fileManager.Store(ctx, ctx.Param("id"), fileInfo, reader)
 	if err != nil {
 		switch {
 		case errors.Is(err, manager.ErrBusy):
 			ctx.String(http.StatusForbidden, "file is being stored")
 		case errors.Is(err, manager.ErrExists):
 			ctx.String(http.StatusForbidden, "file is stored")
+		case errors.Is(err, manager.ErrSizeMismatch):
+			ctx.String(http.StatusBadRequest, "file size doesn't match")
+		case errors.Is(err, manager.ErrChecksumMismatch):
+			ctx.String(http.StatusBadRequest, "file checksum doesn't match")
+		case errors.Is(err, manager.ErrPreconditionFailed):
+			ctx.String(http.StatusPreconditionFailed, "file doesn't match the precondition")
 		default:
 			c.log.With("err", err).Error("failed to store")
 			ctx.Status(http.StatusInternalServerError)
 		}
 		return
 	}
+
+	// the version of the file is the ID it was uploaded with
+	ctx.Header(HeaderVersionID, ctx.Param("id"))
 	ctx.Status(http.StatusCreated)
 }
 
+// GetDownloadFile serves the current version of the file or the one given by the version parameter.
 func (c *RestController) GetDownloadFile(ctx *gin.Context) {
 	fileName := ctx.Param("name")
 
-	file, err := c.repo.GetFileByName(ctx, fileName)
+	var (
+		file *repository.File
+		err  error
+	)
+	if version := ctx.Query("version"); version != "" {
+		file, err = c.repo.GetFileVersion(ctx, fileName, version)
+	} else {
+		file, err = c.repo.GetFileByName(ctx, fileName)
+	}
 	if err != nil {
 		if errors.Is(err, repository.ErrNotFound) {
 			ctx.String(http.StatusForbidden, "file not found")
@@ -130,9 +242,28 @@ func (c *RestController) GetDownloadFile(ctx *gin.Context) {
 
 	extraHeaders := map[string]string{
 		"Content-Disposition": fmt.Sprintf(`attachment; filename="%s"`, fileName),
+		"Accept-Ranges":       "bytes",
+		"Last-Modified":       file.UpdatedAt.UTC().Format(http.TimeFormat),
+		HeaderVersionID:       file.ID,
+	}
+	setFileHeaders(extraHeaders, file)
+
+	if rangeHeader := ctx.GetHeader("Range"); rangeHeader != "" && checkIfRange(ctx.Request, fileETag(file), file.UpdatedAt) {
+		ranges, err := parseRange(rangeHeader, file.Size)
+		if err != nil {
+			ctx.Header("Content-Range", fmt.Sprintf("bytes */%d", file.Size))
+			ctx.Status(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		// ranges which don't make the response smaller are served as a whole file
+		if len(ranges) > 0 && sumRangesSize(ranges) <= file.Size {
+			c.serveRanges(ctx, file, ranges, extraHeaders)
+			return
+		}
 	}
 
-	reader, err := c.fileManager.Load(ctx, fileName)
+	reader, err := c.fileManager.Load(ctx, fileName, file.ID)
 	if err != nil {
 		if errors.Is(err, manager.ErrNotFound) {
 			ctx.String(http.StatusForbidden, "file not found")
@@ -145,3 +276,125 @@ func (c *RestController) GetDownloadFile(ctx *gin.Context) {
 
 	ctx.DataFromReader(http.StatusOK, file.Size, file.ContentType, reader, extraHeaders)
 }
+
+func (c *RestController) serveRanges(ctx *gin.Context, file *repository.File, ranges []httpRange, extraHeaders map[string]string) {
+	fileName := *file.Name
+
+	if len(ranges) == 1 {
+		r := ranges[0]
+		reader, err := c.fileManager.LoadRange(ctx, fileName, file.ID, r.start, r.length)
+		if err != nil {
+			if errors.Is(err, manager.ErrNotFound) {
+				ctx.String(http.StatusForbidden, "file not found")
+				return
+			}
+			c.log.With("err", err).Error("failed to load file range")
+			ctx.Status(http.StatusInternalServerError)
+			return
+		}
+
+		extraHeaders["Content-Range"] = r.contentRange(file.Size)
+		ctx.DataFromReader(http.StatusPartialContent, r.length, file.ContentType, reader, extraHeaders)
+		return
+	}
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	// the gin context is reused once the handler returns, so the goroutine
+	// which may outlive it uses the request context
+	reqCtx := ctx.Request.Context()
+	body := multipart.NewWriter(pw)
+	go func() {
+		for _, r := range ranges {
+			part, err := body.CreatePart(r.mimeHeader(file.ContentType, file.Size))
+			if err != nil {
+				_ = pw.CloseWithError(err)
+				return
+			}
+
+			reader, err := c.fileManager.LoadRange(reqCtx, fileName, file.ID, r.start, r.length)
+			if err != nil {
+				c.log.With("err", err).Error("failed to load file range")
+				_ = pw.CloseWithError(err)
+				return
+			}
+
+			if _, err = io.Copy(part, reader); err != nil {
+				_ = pw.CloseWithError(err)
+				return
+			}
+		}
+		_ = pw.CloseWithError(body.Close())
+	}()
+
+	contentType := "multipart/byteranges; boundary=" + body.Boundary()
+	ctx.DataFromReader(http.StatusPartialContent, -1, contentType, pr, extraHeaders)
+}
+
+// DeleteFile deletes the file, or hides it behind a delete marker when versioning is on.
+// The version parameter deletes the given version for good.
+func (c *RestController) DeleteFile(ctx *gin.Context) {
+	fileName := ctx.Param("name")
+
+	var err error
+	if version := ctx.Query("version"); version != "" {
+		err = c.fileManager.DeleteVersion(ctx, fileName, version)
+	} else {
+		err = c.fileManager.Delete(ctx, fileName)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, manager.ErrNotFound):
+			ctx.String(http.StatusNotFound, "file not found")
+		case errors.Is(err, manager.ErrBusy):
+			ctx.String(http.StatusForbidden, "file is busy")
+		default:
+			c.log.With("err", err).Error("failed to delete file")
+			ctx.Status(http.StatusInternalServerError)
+		}
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// GetFileVersions lists the versions and delete markers of the file, the newest first.
+func (c *RestController) GetFileVersions(ctx *gin.Context) {
+	files, err := c.repo.FindFileVersions(ctx, ctx.Param("name"))
+	if err != nil {
+		c.log.With("err", err).Error("failed to find file versions")
+		ctx.Status(http.StatusInternalServerError)
+		return
+	}
+	if len(files) == 0 {
+		ctx.String(http.StatusNotFound, "file not found")
+		return
+	}
+
+	resp := make([]FileVersionResponse, 0, len(files))
+	for _, f := range files {
+		resp = append(resp, FileVersionResponse{
+			VersionID:    f.ID,
+			Size:         f.Size,
+			Hash:         f.Hash,
+			IsLatest:     !f.Noncurrent,
+			DeleteMarker: f.DeleteMarker,
+			LastModified: f.UpdatedAt,
+		})
+	}
+
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// parseSize returns manager.UnknownSize for an empty value.
+func parseSize(value string) (int64, error) {
+	if value == "" {
+		return manager.UnknownSize, nil
+	}
+
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size: %s", value)
+	}
+	return size, nil
+}
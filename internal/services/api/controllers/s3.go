@@ -0,0 +1,845 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	"github.com/blkmlk/file-storage/env"
+	"github.com/blkmlk/file-storage/internal/services/manager"
+	"github.com/blkmlk/file-storage/internal/services/repository"
+)
+
+const (
+	s3MaxKeys       = 1000
+	s3ListBatchSize = 1000
+	s3AuthKey       = "s3auth"
+
+	// keys are valid UTF-8, so every key with a given prefix sorts before prefix+maxRune
+	maxRune = "\U0010FFFF"
+)
+
+var bucketNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// S3Controller serves a subset of the S3 API in path style (/bucket/key).
+// Buckets are rows of their own, objects are files named "bucket/key".
+type S3Controller struct {
+	repo        repository.Repository
+	log         *zap.SugaredLogger
+	fileManager manager.Manager
+	verifier    *sigV4Verifier
+	accessKey   string
+	region      string
+}
+
+func NewS3Controller(
+	repo repository.Repository,
+	log *zap.SugaredLogger,
+	fileManager manager.Manager,
+) (*S3Controller, error) {
+	accessKey := env.GetOptional(env.S3AccessKey, "")
+	secretKey := env.GetOptional(env.S3SecretKey, "")
+	region := env.GetOptional(env.S3Region, "us-east-1")
+
+	c := &S3Controller{
+		repo:        repo,
+		log:         log,
+		fileManager: fileManager,
+		accessKey:   accessKey,
+		region:      region,
+	}
+
+	// without credentials every request is denied
+	if accessKey != "" && secretKey != "" {
+		c.verifier = newSigV4Verifier(accessKey, secretKey, region)
+	}
+
+	return c, nil
+}
+
+func (c *S3Controller) Authenticate(ctx *gin.Context) {
+	if c.verifier == nil {
+		c.abortWithError(ctx, http.StatusForbidden, "AccessDenied", "Access Denied")
+		return
+	}
+
+	auth, err := c.verifier.Verify(ctx.Request)
+	if err != nil {
+		switch {
+		case errors.Is(err, errMissingAuth), errors.Is(err, errUnknownAccessKey):
+			c.abortWithError(ctx, http.StatusForbidden, "AccessDenied", "Access Denied")
+		case errors.Is(err, errRequestExpired):
+			c.abortWithError(ctx, http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the current time is too large.")
+		case errors.Is(err, errMalformedAuth):
+			c.abortWithError(ctx, http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed.")
+		case errors.Is(err, errUnsupportedPayload):
+			c.abortWithError(ctx, http.StatusNotImplemented, "NotImplemented", "A header you provided implies functionality that is not implemented.")
+		default:
+			c.abortWithError(ctx, http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.")
+		}
+		return
+	}
+
+	ctx.Set(s3AuthKey, auth)
+	ctx.Next()
+}
+
+func (c *S3Controller) ListBuckets(ctx *gin.Context) {
+	buckets, err := c.repo.FindBuckets(ctx)
+	if err != nil {
+		c.internalError(ctx, err, "failed to find buckets")
+		return
+	}
+
+	resp := ListAllMyBucketsResult{
+		Owner: S3Owner{ID: c.accessKey, DisplayName: c.accessKey},
+	}
+	for _, b := range buckets {
+		resp.Buckets = append(resp.Buckets, S3Bucket{
+			Name:         b.Name,
+			CreationDate: formatS3Time(b.CreatedAt),
+		})
+	}
+
+	c.xml(ctx, http.StatusOK, &resp)
+}
+
+func (c *S3Controller) PutBucket(ctx *gin.Context) {
+	name := ctx.Param("bucket")
+	if !bucketNameRegexp.MatchString(name) {
+		c.writeError(ctx, http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid.")
+		return
+	}
+
+	bucket := repository.NewBucket(name)
+	if err := c.repo.CreateBucket(ctx, &bucket); err != nil {
+		if errors.Is(err, repository.ErrAlreadyExists) {
+			c.writeError(ctx, http.StatusConflict, "BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it.")
+			return
+		}
+		c.internalError(ctx, err, "failed to create bucket")
+		return
+	}
+
+	ctx.Header("Location", "/"+name)
+	ctx.Status(http.StatusOK)
+}
+
+func (c *S3Controller) HeadBucket(ctx *gin.Context) {
+	if _, ok := c.getBucket(ctx); !ok {
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
+
+func (c *S3Controller) DeleteBucket(ctx *gin.Context) {
+	bucket, ok := c.getBucket(ctx)
+	if !ok {
+		return
+	}
+
+	files, err := c.repo.FindFilesByPrefix(ctx, bucket.Name+"/", "", 1)
+	if err != nil {
+		c.internalError(ctx, err, "failed to find objects")
+		return
+	}
+	if len(files) > 0 {
+		c.writeError(ctx, http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty.")
+		return
+	}
+
+	if err = c.repo.DeleteBucket(ctx, bucket.Name); err != nil && !errors.Is(err, repository.ErrNotFound) {
+		c.internalError(ctx, err, "failed to delete bucket")
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+func (c *S3Controller) GetBucket(ctx *gin.Context) {
+	bucket, ok := c.getBucket(ctx)
+	if !ok {
+		return
+	}
+
+	if _, ok = ctx.GetQuery("location"); ok {
+		c.xml(ctx, http.StatusOK, &LocationConstraint{Location: c.region})
+		return
+	}
+
+	c.listObjects(ctx, bucket)
+}
+
+// listObjects implements ListObjectsV2. Keys under a common prefix are skipped
+// at once by moving the cursor past the prefix.
+func (c *S3Controller) listObjects(ctx *gin.Context, bucket *repository.Bucket) {
+	prefix := ctx.Query("prefix")
+	delimiter := ctx.Query("delimiter")
+	encodingType := ctx.Query("encoding-type")
+	if encodingType != "" && encodingType != "url" {
+		c.writeError(ctx, http.StatusBadRequest, "InvalidArgument", "Invalid Encoding Method specified in Request")
+		return
+	}
+
+	maxKeys := s3MaxKeys
+	if value := ctx.Query("max-keys"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			c.writeError(ctx, http.StatusBadRequest, "InvalidArgument", "Provided max-keys not an integer or within integer range")
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	namePrefix := bucket.Name + "/"
+	startAfter := ctx.Query("start-after")
+	cursor := namePrefix + startAfter
+
+	token := ctx.Query("continuation-token")
+	if token != "" {
+		key, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			c.writeError(ctx, http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect")
+			return
+		}
+		cursor = namePrefix + string(key)
+	}
+
+	encode := func(s string) string {
+		if encodingType == "url" {
+			return uriEncode(s, false)
+		}
+		return s
+	}
+
+	resp := ListBucketV2Result{
+		Name:              bucket.Name,
+		Prefix:            encode(prefix),
+		Delimiter:         encode(delimiter),
+		MaxKeys:           maxKeys,
+		EncodingType:      encodingType,
+		ContinuationToken: token,
+		StartAfter:        encode(startAfter),
+	}
+
+	// max-keys=0 returns an empty listing which is never truncated, as S3 does
+	entries := 0
+	for more := maxKeys > 0; more && !resp.IsTruncated; {
+		files, err := c.repo.FindFilesByPrefix(ctx, namePrefix+prefix, cursor, s3ListBatchSize)
+		if err != nil {
+			c.internalError(ctx, err, "failed to find objects")
+			return
+		}
+		more = len(files) == s3ListBatchSize
+
+		for _, f := range files {
+			if entries == maxKeys {
+				resp.IsTruncated = true
+				break
+			}
+			entries++
+
+			key := strings.TrimPrefix(*f.Name, namePrefix)
+			if delimiter != "" {
+				if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+					commonPrefix := key[:len(prefix)+i+len(delimiter)]
+					resp.CommonPrefixes = append(resp.CommonPrefixes, S3CommonPrefix{Prefix: encode(commonPrefix)})
+					cursor = namePrefix + commonPrefix + maxRune
+					more = true
+					break
+				}
+			}
+
+			resp.Contents = append(resp.Contents, S3Object{
+				Key:          encode(key),
+				LastModified: formatS3Time(f.UpdatedAt),
+				ETag:         objectETag(f),
+				Size:         f.Size,
+				StorageClass: "STANDARD",
+			})
+			cursor = *f.Name
+		}
+	}
+
+	resp.KeyCount = entries
+	if resp.IsTruncated {
+		key := strings.TrimPrefix(cursor, namePrefix)
+		resp.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(key))
+	}
+
+	c.xml(ctx, http.StatusOK, &resp)
+}
+
+func (c *S3Controller) PutObject(ctx *gin.Context) {
+	if isBucketPath(ctx) {
+		c.PutBucket(ctx)
+		return
+	}
+
+	bucket, key, ok := c.getObjectKey(ctx)
+	if !ok {
+		return
+	}
+
+	if uploadID := ctx.Query("uploadId"); uploadID != "" {
+		c.uploadPart(ctx, bucket, key, uploadID)
+		return
+	}
+
+	if source := ctx.GetHeader("X-Amz-Copy-Source"); source != "" {
+		c.copyObject(ctx, bucket, key, source)
+		return
+	}
+
+	size, ok := c.contentLength(ctx)
+	if !ok {
+		return
+	}
+
+	checksums, err := parseChecksums(ctx.Request.Header)
+	if err != nil {
+		c.writeError(ctx, http.StatusBadRequest, "InvalidDigest", "The Content-MD5 or checksum value that you specified is not valid.")
+		return
+	}
+
+	file, err := c.storeObject(ctx, manager.FileInfo{
+		Name:        objectName(bucket, key),
+		ContentType: ctx.GetHeader("Content-Type"),
+		Size:        size,
+		Checksums:   checksums,
+	}, c.payload(ctx))
+	if err != nil {
+		c.handleObjectError(ctx, err, "failed to store object")
+		return
+	}
+
+	ctx.Header("ETag", objectETag(file))
+	ctx.Status(http.StatusOK)
+}
+
+func (c *S3Controller) copyObject(ctx *gin.Context, bucket *repository.Bucket, key, source string) {
+	source, err := url.PathUnescape(strings.TrimPrefix(source, "/"))
+	if err != nil {
+		c.writeError(ctx, http.StatusBadRequest, "InvalidArgument", "Copy Source must mention the source bucket and key: sourcebucket/sourcekey")
+		return
+	}
+	source, _, _ = strings.Cut(source, "?")
+
+	srcBucket, srcKey, found := strings.Cut(source, "/")
+	if !found || srcBucket == "" || srcKey == "" {
+		c.writeError(ctx, http.StatusBadRequest, "InvalidArgument", "Copy Source must mention the source bucket and key: sourcebucket/sourcekey")
+		return
+	}
+
+	name := objectName(bucket, key)
+	srcName := srcBucket + "/" + srcKey
+	if srcName == name {
+		c.writeError(ctx, http.StatusBadRequest, "InvalidRequest", "This copy request is illegal because it is trying to copy an object to itself.")
+		return
+	}
+
+	src, err := c.repo.GetFileByName(ctx, srcName)
+	if err != nil {
+		c.handleObjectError(ctx, err, "failed to get source object")
+		return
+	}
+
+	contentType := src.ContentType
+	if ctx.GetHeader("X-Amz-Metadata-Directive") == "REPLACE" {
+		contentType = ctx.GetHeader("Content-Type")
+	}
+
+	reader, err := c.fileManager.Load(ctx, srcName, src.ID)
+	if err != nil {
+		c.handleObjectError(ctx, err, "failed to load source object")
+		return
+	}
+
+	file, err := c.storeObject(ctx, manager.FileInfo{
+		Name:        name,
+		ContentType: contentType,
+		Size:        src.Size,
+	}, reader)
+	if err != nil {
+		c.handleObjectError(ctx, err, "failed to copy object")
+		return
+	}
+
+	c.xml(ctx, http.StatusOK, &CopyObjectResult{
+		LastModified: formatS3Time(file.UpdatedAt),
+		ETag:         objectETag(file),
+	})
+}
+
+// storeObject replaces the object if it exists. Readers see the old object until
+// the new one is stored. The If-Match and If-None-Match headers are checked
+// against the object which is replaced.
+func (c *S3Controller) storeObject(ctx *gin.Context, info manager.FileInfo, reader io.Reader) (*repository.File, error) {
+	info.Overwrite = true
+	info.Precondition = parsePrecondition(ctx.Request.Header)
+
+	id, err := c.fileManager.Prepare(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = c.fileManager.Store(ctx, id, info, reader); err != nil {
+		return nil, err
+	}
+
+	return c.repo.GetFile(ctx, id)
+}
+
+func (c *S3Controller) GetObject(ctx *gin.Context) {
+	if isBucketPath(ctx) {
+		c.GetBucket(ctx)
+		return
+	}
+
+	bucket, key, ok := c.getObjectKey(ctx)
+	if !ok {
+		return
+	}
+
+	if uploadID := ctx.Query("uploadId"); uploadID != "" {
+		c.listParts(ctx, bucket, key, uploadID)
+		return
+	}
+
+	name := objectName(bucket, key)
+	file, err := c.repo.GetFileByName(ctx, name)
+	if err != nil {
+		c.handleObjectError(ctx, err, "failed to get object")
+		return
+	}
+
+	extraHeaders := objectHeaders(file)
+
+	// multiple ranges aren't supported by S3, the whole object is returned instead
+	if rangeHeader := ctx.GetHeader("Range"); rangeHeader != "" {
+		ranges, err := parseRange(rangeHeader, file.Size)
+		if err != nil {
+			ctx.Header("Content-Range", fmt.Sprintf("bytes */%d", file.Size))
+			c.writeError(ctx, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+			return
+		}
+
+		if len(ranges) == 1 {
+			r := ranges[0]
+			reader, err := c.fileManager.LoadRange(ctx, name, file.ID, r.start, r.length)
+			if err != nil {
+				c.handleObjectError(ctx, err, "failed to load object range")
+				return
+			}
+
+			extraHeaders["Content-Range"] = r.contentRange(file.Size)
+			ctx.DataFromReader(http.StatusPartialContent, r.length, file.ContentType, reader, extraHeaders)
+			return
+		}
+	}
+
+	reader, err := c.fileManager.Load(ctx, name, file.ID)
+	if err != nil {
+		c.handleObjectError(ctx, err, "failed to load object")
+		return
+	}
+
+	ctx.DataFromReader(http.StatusOK, file.Size, file.ContentType, reader, extraHeaders)
+}
+
+func (c *S3Controller) HeadObject(ctx *gin.Context) {
+	if isBucketPath(ctx) {
+		c.HeadBucket(ctx)
+		return
+	}
+
+	bucket, key, ok := c.getObjectKey(ctx)
+	if !ok {
+		return
+	}
+
+	file, err := c.repo.GetFileByName(ctx, objectName(bucket, key))
+	if err != nil {
+		c.handleObjectError(ctx, err, "failed to get object")
+		return
+	}
+
+	for k, v := range objectHeaders(file) {
+		ctx.Header(k, v)
+	}
+	ctx.Header("Content-Type", file.ContentType)
+	ctx.Header("Content-Length", strconv.FormatInt(file.Size, 10))
+	ctx.Status(http.StatusOK)
+}
+
+func (c *S3Controller) DeleteObject(ctx *gin.Context) {
+	if isBucketPath(ctx) {
+		c.DeleteBucket(ctx)
+		return
+	}
+
+	bucket, key, ok := c.getObjectKey(ctx)
+	if !ok {
+		return
+	}
+
+	if uploadID := ctx.Query("uploadId"); uploadID != "" {
+		c.abortUpload(ctx, bucket, key, uploadID)
+		return
+	}
+
+	// deleting a missing object succeeds as well
+	err := c.fileManager.Delete(ctx, objectName(bucket, key))
+	if err != nil && !errors.Is(err, manager.ErrNotFound) {
+		c.handleObjectError(ctx, err, "failed to delete object")
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+func (c *S3Controller) PostObject(ctx *gin.Context) {
+	bucket, key, ok := c.getObjectKey(ctx)
+	if !ok {
+		return
+	}
+
+	if _, ok = ctx.GetQuery("uploads"); ok {
+		c.initiateUpload(ctx, bucket, key)
+		return
+	}
+
+	if uploadID := ctx.Query("uploadId"); uploadID != "" {
+		c.completeUpload(ctx, bucket, key, uploadID)
+		return
+	}
+
+	c.writeError(ctx, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.")
+}
+
+func (c *S3Controller) initiateUpload(ctx *gin.Context, bucket *repository.Bucket, key string) {
+	// the object is replaced when the upload is completed
+	info := manager.FileInfo{
+		Name:        objectName(bucket, key),
+		ContentType: ctx.GetHeader("Content-Type"),
+		Overwrite:   true,
+	}
+
+	uploadID, err := c.fileManager.InitiateUpload(ctx, info)
+	if err != nil {
+		c.handleObjectError(ctx, err, "failed to initiate upload")
+		return
+	}
+
+	c.xml(ctx, http.StatusOK, &InitiateMultipartUploadResult{
+		Bucket:   bucket.Name,
+		Key:      key,
+		UploadID: uploadID,
+	})
+}
+
+func (c *S3Controller) uploadPart(ctx *gin.Context, bucket *repository.Bucket, key, uploadID string) {
+	number, err := strconv.Atoi(ctx.Query("partNumber"))
+	if err != nil {
+		c.writeError(ctx, http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000, inclusive")
+		return
+	}
+
+	if !c.checkUpload(ctx, bucket, key, uploadID) {
+		return
+	}
+
+	size, ok := c.contentLength(ctx)
+	if !ok {
+		return
+	}
+	if size == 0 {
+		c.writeError(ctx, http.StatusBadRequest, "EntityTooSmall", "Your proposed upload is smaller than the minimum allowed object size.")
+		return
+	}
+
+	part, err := c.fileManager.UploadPart(ctx, uploadID, number, size, c.payload(ctx))
+	if err != nil {
+		c.handleObjectError(ctx, err, "failed to upload part")
+		return
+	}
+
+	ctx.Header("ETag", partETag(*part))
+	ctx.Status(http.StatusOK)
+}
+
+func (c *S3Controller) listParts(ctx *gin.Context, bucket *repository.Bucket, key, uploadID string) {
+	if !c.checkUpload(ctx, bucket, key, uploadID) {
+		return
+	}
+
+	parts, err := c.fileManager.ListParts(ctx, uploadID)
+	if err != nil {
+		c.handleObjectError(ctx, err, "failed to list parts")
+		return
+	}
+
+	resp := ListPartsResult{
+		Bucket:   bucket.Name,
+		Key:      key,
+		UploadID: uploadID,
+	}
+	for _, p := range parts {
+		resp.Parts = append(resp.Parts, S3Part{
+			PartNumber: p.Number,
+			ETag:       partETag(p),
+			Size:       p.Size,
+		})
+	}
+
+	c.xml(ctx, http.StatusOK, &resp)
+}
+
+func (c *S3Controller) completeUpload(ctx *gin.Context, bucket *repository.Bucket, key, uploadID string) {
+	var req CompleteMultipartUpload
+	if err := xml.NewDecoder(c.payload(ctx)).Decode(&req); err != nil || len(req.Parts) == 0 {
+		c.writeError(ctx, http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema.")
+		return
+	}
+
+	if !sort.SliceIsSorted(req.Parts, func(i, j int) bool {
+		return req.Parts[i].PartNumber < req.Parts[j].PartNumber
+	}) {
+		c.writeError(ctx, http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order.")
+		return
+	}
+
+	if !c.checkUpload(ctx, bucket, key, uploadID) {
+		return
+	}
+
+	parts, err := c.fileManager.ListParts(ctx, uploadID)
+	if err != nil {
+		c.handleObjectError(ctx, err, "failed to list parts")
+		return
+	}
+
+	etags := make(map[int]string, len(parts))
+	for _, p := range parts {
+		etags[p.Number] = partETag(p)
+	}
+
+	numbers := make([]int, 0, len(req.Parts))
+	for _, p := range req.Parts {
+		etag, ok := etags[p.PartNumber]
+		if !ok || strings.Trim(p.ETag, `"`) != strings.Trim(etag, `"`) {
+			c.writeError(ctx, http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found.")
+			return
+		}
+		numbers = append(numbers, p.PartNumber)
+	}
+
+	name := objectName(bucket, key)
+	if err = c.fileManager.CompleteUpload(ctx, uploadID, numbers); err != nil {
+		c.handleObjectError(ctx, err, "failed to complete upload")
+		return
+	}
+
+	file, err := c.repo.GetFileByName(ctx, name)
+	if err != nil {
+		c.handleObjectError(ctx, err, "failed to get object")
+		return
+	}
+
+	c.xml(ctx, http.StatusOK, &CompleteMultipartUploadResult{
+		Location: "/" + bucket.Name + "/" + key,
+		Bucket:   bucket.Name,
+		Key:      key,
+		ETag:     objectETag(file),
+	})
+}
+
+func (c *S3Controller) abortUpload(ctx *gin.Context, bucket *repository.Bucket, key, uploadID string) {
+	if !c.checkUpload(ctx, bucket, key, uploadID) {
+		return
+	}
+
+	if err := c.fileManager.AbortUpload(ctx, uploadID); err != nil {
+		c.handleObjectError(ctx, err, "failed to abort upload")
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+// checkUpload makes sure the upload belongs to the object in the request.
+func (c *S3Controller) checkUpload(ctx *gin.Context, bucket *repository.Bucket, key, uploadID string) bool {
+	file, err := c.repo.GetFile(ctx, uploadID)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		c.internalError(ctx, err, "failed to get upload")
+		return false
+	}
+
+	if err != nil || file.Status != repository.FileStatusUploading || file.Name == nil || *file.Name != objectName(bucket, key) {
+		c.writeError(ctx, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+		return false
+	}
+	return true
+}
+
+func (c *S3Controller) getBucket(ctx *gin.Context) (*repository.Bucket, bool) {
+	bucket, err := c.repo.GetBucket(ctx, ctx.Param("bucket"))
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			c.writeError(ctx, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+			return nil, false
+		}
+		c.internalError(ctx, err, "failed to get bucket")
+		return nil, false
+	}
+	return bucket, true
+}
+
+func (c *S3Controller) getObjectKey(ctx *gin.Context) (*repository.Bucket, string, bool) {
+	bucket, ok := c.getBucket(ctx)
+	if !ok {
+		return nil, "", false
+	}
+
+	key := strings.TrimPrefix(ctx.Param("key"), "/")
+	if key == "" {
+		c.writeError(ctx, http.StatusBadRequest, "InvalidArgument", "The key is empty")
+		return nil, "", false
+	}
+	if len(key) > 1024 {
+		c.writeError(ctx, http.StatusBadRequest, "KeyTooLongError", "Your key is too long")
+		return nil, "", false
+	}
+	return bucket, key, true
+}
+
+// contentLength returns the size of the object. Streaming uploads send the
+// size of the payload without chunk signatures in a header of their own.
+func (c *S3Controller) contentLength(ctx *gin.Context) (int64, bool) {
+	size := ctx.Request.ContentLength
+	if value := ctx.GetHeader("X-Amz-Decoded-Content-Length"); value != "" {
+		var err error
+		if size, err = strconv.ParseInt(value, 10, 64); err != nil {
+			size = -1
+		}
+	}
+
+	if size < 0 {
+		c.writeError(ctx, http.StatusLengthRequired, "MissingContentLength", "You must provide the Content-Length HTTP header.")
+		return 0, false
+	}
+	return size, true
+}
+
+// payload returns the request body checked against its signed hash.
+func (c *S3Controller) payload(ctx *gin.Context) io.Reader {
+	auth := ctx.MustGet(s3AuthKey).(*sigV4Auth)
+	return auth.PayloadReader(ctx.Request.Body)
+}
+
+func (c *S3Controller) handleObjectError(ctx *gin.Context, err error, msg string) {
+	switch {
+	case errors.Is(err, manager.ErrNotFound), errors.Is(err, repository.ErrNotFound):
+		c.writeError(ctx, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+	case errors.Is(err, manager.ErrBusy), errors.Is(err, manager.ErrExists):
+		c.writeError(ctx, http.StatusConflict, "OperationAborted", "A conflicting conditional operation is currently in progress against this resource.")
+	case errors.Is(err, manager.ErrUploadNotFound):
+		c.writeError(ctx, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist.")
+	case errors.Is(err, manager.ErrPartNotFound):
+		c.writeError(ctx, http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found.")
+	case errors.Is(err, manager.ErrInvalidPartNumber):
+		c.writeError(ctx, http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000, inclusive")
+	case errors.Is(err, manager.ErrSizeMismatch):
+		c.writeError(ctx, http.StatusBadRequest, "IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header.")
+	case errors.Is(err, manager.ErrChecksumMismatch):
+		c.writeError(ctx, http.StatusBadRequest, "BadDigest", "The Content-MD5 or checksum value you specified did not match what we received.")
+	case errors.Is(err, manager.ErrPreconditionFailed):
+		c.writeError(ctx, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold")
+	case errors.Is(err, errPayloadMismatch):
+		c.writeError(ctx, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed.")
+	case errors.Is(err, errSignatureMismatch), errors.Is(err, errMalformedAuth):
+		c.writeError(ctx, http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.")
+	default:
+		c.internalError(ctx, err, msg)
+	}
+}
+
+func (c *S3Controller) internalError(ctx *gin.Context, err error, msg string) {
+	c.log.With("err", err).Error(msg)
+	c.writeError(ctx, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.")
+}
+
+func (c *S3Controller) writeError(ctx *gin.Context, status int, code, message string) {
+	c.xml(ctx, status, &S3Error{
+		Code:     code,
+		Message:  message,
+		Resource: ctx.Request.URL.Path,
+	})
+}
+
+func (c *S3Controller) abortWithError(ctx *gin.Context, status int, code, message string) {
+	c.writeError(ctx, status, code, message)
+	ctx.Abort()
+}
+
+func (c *S3Controller) xml(ctx *gin.Context, status int, body any) {
+	data, err := xml.Marshal(body)
+	if err != nil {
+		c.log.With("err", err).Error("failed to marshal xml")
+		ctx.Status(http.StatusInternalServerError)
+		return
+	}
+	ctx.Data(status, "application/xml", append([]byte(xml.Header), data...))
+}
+
+// isBucketPath reports whether the object route got a bucket path with a trailing slash.
+func isBucketPath(ctx *gin.Context) bool {
+	return ctx.Param("key") == "/"
+}
+
+func objectName(bucket *repository.Bucket, key string) string {
+	return bucket.Name + "/" + key
+}
+
+// objectETag is the MD5 of the content as S3 clients expect it. Files stored before
+// MD5s were kept have the content hash, or the file id when it isn't known either.
+func objectETag(file *repository.File) string {
+	if file.MD5 != "" {
+		return strconv.Quote(file.MD5)
+	}
+	if etag := fileETag(file); etag != "" {
+		return etag
+	}
+	return strconv.Quote(file.ID)
+}
+
+// partETag is the MD5 of the part, or its hash for parts uploaded before MD5s were kept.
+func partETag(part manager.UploadedPart) string {
+	if part.MD5 != "" {
+		return strconv.Quote(part.MD5)
+	}
+	return strconv.Quote(part.Hash)
+}
+
+func objectHeaders(file *repository.File) map[string]string {
+	headers := map[string]string{
+		"Last-Modified": file.UpdatedAt.UTC().Format(http.TimeFormat),
+		"Accept-Ranges": "bytes",
+	}
+	setFileHeaders(headers, file)
+	headers["ETag"] = objectETag(file)
+	return headers
+}
@@ -0,0 +1,416 @@
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm      = "AWS4-HMAC-SHA256"
+	sigV4ChunkAlgorithm = "AWS4-HMAC-SHA256-PAYLOAD"
+	sigV4TimeFormat     = "20060102T150405Z"
+	sigV4DateFormat     = "20060102"
+	sigV4Service        = "s3"
+	sigV4Terminator     = "aws4_request"
+	sigV4MaxSkew        = time.Minute * 15
+	// sigV4MaxChunkSize bounds the declared size of an aws-chunked chunk, which is
+	// read before its signature is checked. S3 clients send chunks of 64KiB to 16MiB.
+	sigV4MaxChunkSize = 16 << 20
+
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	streamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	emptySHA256      = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+var (
+	errMissingAuth        = errors.New("missing authentication")
+	errMalformedAuth      = errors.New("malformed authorization")
+	errUnknownAccessKey   = errors.New("unknown access key")
+	errSignatureMismatch  = errors.New("signature does not match")
+	errRequestExpired     = errors.New("request expired")
+	errPayloadMismatch    = errors.New("payload hash does not match")
+	errUnsupportedPayload = errors.New("unsupported payload")
+)
+
+// sigV4Verifier checks AWS Signature Version 4 of S3 requests
+// signed either in the Authorization header or in the query.
+type sigV4Verifier struct {
+	accessKey string
+	secretKey string
+	region    string
+	now       func() time.Time
+}
+
+// sigV4Auth is a verified request signature. It's needed to check the signed payload.
+type sigV4Auth struct {
+	payloadHash string
+	date        time.Time
+	scope       string
+	signingKey  []byte
+	signature   string
+}
+
+func newSigV4Verifier(accessKey, secretKey, region string) *sigV4Verifier {
+	return &sigV4Verifier{
+		accessKey: accessKey,
+		secretKey: secretKey,
+		region:    region,
+		now:       time.Now,
+	}
+}
+
+func (v *sigV4Verifier) Verify(r *http.Request) (*sigV4Auth, error) {
+	if r.URL.Query().Get("X-Amz-Algorithm") != "" {
+		return v.verifyQuery(r)
+	}
+	if r.Header.Get("Authorization") != "" {
+		return v.verifyHeader(r)
+	}
+	return nil, errMissingAuth
+}
+
+func (v *sigV4Verifier) verifyHeader(r *http.Request) (*sigV4Auth, error) {
+	value := r.Header.Get("Authorization")
+	if !strings.HasPrefix(value, sigV4Algorithm+" ") {
+		return nil, errMalformedAuth
+	}
+
+	fields := make(map[string]string)
+	for _, f := range strings.Split(strings.TrimPrefix(value, sigV4Algorithm+" "), ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(f), "=")
+		if !ok {
+			return nil, errMalformedAuth
+		}
+		fields[k] = v
+	}
+
+	credential, signedHeaders, signature := fields["Credential"], fields["SignedHeaders"], fields["Signature"]
+	if credential == "" || signedHeaders == "" || signature == "" {
+		return nil, errMalformedAuth
+	}
+
+	date, err := time.Parse(sigV4TimeFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, errMalformedAuth
+	}
+
+	now := v.now()
+	if date.Before(now.Add(-sigV4MaxSkew)) || date.After(now.Add(sigV4MaxSkew)) {
+		return nil, errRequestExpired
+	}
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		return nil, errMalformedAuth
+	}
+	// the bodies with trailing checksums and the ECDSA signed ones aren't decoded
+	if strings.HasPrefix(payloadHash, "STREAMING-") && payloadHash != streamingPayload {
+		return nil, errUnsupportedPayload
+	}
+
+	return v.verify(r, date, credential, strings.Split(signedHeaders, ";"), signature, payloadHash, r.URL.Query())
+}
+
+func (v *sigV4Verifier) verifyQuery(r *http.Request) (*sigV4Auth, error) {
+	query := r.URL.Query()
+	if query.Get("X-Amz-Algorithm") != sigV4Algorithm {
+		return nil, errMalformedAuth
+	}
+
+	date, err := time.Parse(sigV4TimeFormat, query.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, errMalformedAuth
+	}
+
+	expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || expires < 0 {
+		return nil, errMalformedAuth
+	}
+
+	now := v.now()
+	if date.After(now.Add(sigV4MaxSkew)) || now.After(date.Add(time.Duration(expires)*time.Second)) {
+		return nil, errRequestExpired
+	}
+
+	signature := query.Get("X-Amz-Signature")
+	query.Del("X-Amz-Signature")
+
+	return v.verify(r, date, query.Get("X-Amz-Credential"), strings.Split(query.Get("X-Amz-SignedHeaders"), ";"),
+		signature, unsignedPayload, query)
+}
+
+func (v *sigV4Verifier) verify(
+	r *http.Request,
+	date time.Time,
+	credential string,
+	signedHeaders []string,
+	signature string,
+	payloadHash string,
+	query url.Values,
+) (*sigV4Auth, error) {
+	// AKID/20130524/us-east-1/s3/aws4_request
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[3] != sigV4Service || parts[4] != sigV4Terminator {
+		return nil, errMalformedAuth
+	}
+	if parts[0] != v.accessKey {
+		return nil, errUnknownAccessKey
+	}
+	if parts[1] != date.Format(sigV4DateFormat) || parts[2] != v.region {
+		return nil, errMalformedAuth
+	}
+
+	// the host must be signed, otherwise the request can be replayed to another endpoint
+	hostSigned := false
+	for _, h := range signedHeaders {
+		hostSigned = hostSigned || h == "host"
+	}
+	if !hostSigned {
+		return nil, errMalformedAuth
+	}
+
+	scope := strings.Join(parts[1:], "/")
+	canonicalRequest := buildCanonicalRequest(r, query, signedHeaders, payloadHash)
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		date.Format(sigV4TimeFormat),
+		scope,
+		hashHex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := v.signingKey(parts[1])
+	expected := hex.EncodeToString(hmacSHA256(signingKey, []byte(stringToSign)))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, errSignatureMismatch
+	}
+
+	return &sigV4Auth{
+		payloadHash: payloadHash,
+		date:        date,
+		scope:       scope,
+		signingKey:  signingKey,
+		signature:   signature,
+	}, nil
+}
+
+func (v *sigV4Verifier) signingKey(date string) []byte {
+	key := hmacSHA256([]byte("AWS4"+v.secretKey), []byte(date))
+	key = hmacSHA256(key, []byte(v.region))
+	key = hmacSHA256(key, []byte(sigV4Service))
+	return hmacSHA256(key, []byte(sigV4Terminator))
+}
+
+func buildCanonicalRequest(r *http.Request, query url.Values, signedHeaders []string, payloadHash string) string {
+	var b strings.Builder
+
+	b.WriteString(r.Method)
+	b.WriteByte('\n')
+	b.WriteString(uriEncode(r.URL.Path, false))
+	b.WriteByte('\n')
+
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var params []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, uriEncode(k, true)+"="+uriEncode(value, true))
+		}
+	}
+	b.WriteString(strings.Join(params, "&"))
+	b.WriteByte('\n')
+
+	for _, h := range signedHeaders {
+		b.WriteString(h)
+		b.WriteByte(':')
+		b.WriteString(canonicalHeaderValue(r, h))
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+
+	b.WriteString(strings.Join(signedHeaders, ";"))
+	b.WriteByte('\n')
+	b.WriteString(payloadHash)
+
+	return b.String()
+}
+
+func canonicalHeaderValue(r *http.Request, name string) string {
+	switch name {
+	case "host":
+		return r.Host
+	case "content-length":
+		return strconv.FormatInt(r.ContentLength, 10)
+	}
+
+	var values []string
+	for _, value := range r.Header.Values(name) {
+		values = append(values, strings.Join(strings.Fields(value), " "))
+	}
+	return strings.Join(values, ",")
+}
+
+// uriEncode encodes every byte except the unreserved characters as per RFC 3986.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			_, _ = fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func hashHex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// PayloadReader returns the reader of the request body which fails
+// when the body doesn't match the signed payload.
+func (a *sigV4Auth) PayloadReader(body io.Reader) io.Reader {
+	switch a.payloadHash {
+	case unsignedPayload:
+		return body
+	case streamingPayload:
+		return newChunkedReader(body, a)
+	default:
+		return &hashingReader{reader: body, hash: sha256.New(), expected: a.payloadHash}
+	}
+}
+
+type hashingReader struct {
+	reader   io.Reader
+	hash     hash.Hash
+	expected string
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.reader.Read(p)
+	h.hash.Write(p[:n])
+	if errors.Is(err, io.EOF) && hex.EncodeToString(h.hash.Sum(nil)) != h.expected {
+		return n, errPayloadMismatch
+	}
+	return n, err
+}
+
+// chunkedReader decodes the aws-chunked content encoding and checks the signature of every chunk:
+//
+//	hex-size;chunk-signature=signature\r\n
+//	data\r\n
+type chunkedReader struct {
+	reader    *bufio.Reader
+	auth      *sigV4Auth
+	prevSig   string
+	chunk     []byte
+	remaining []byte
+	done      bool
+}
+
+func newChunkedReader(body io.Reader, auth *sigV4Auth) *chunkedReader {
+	return &chunkedReader{
+		reader:  bufio.NewReader(body),
+		auth:    auth,
+		prevSig: auth.signature,
+	}
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for len(c.remaining) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, c.remaining)
+	c.remaining = c.remaining[n:]
+	return n, nil
+}
+
+func (c *chunkedReader) readChunk() error {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	header := strings.TrimSuffix(line, "\r\n")
+	sizeValue, ext, ok := strings.Cut(header, ";")
+	if !ok || !strings.HasPrefix(ext, "chunk-signature=") {
+		return errMalformedAuth
+	}
+
+	size, err := strconv.ParseInt(sizeValue, 16, 64)
+	if err != nil || size < 0 || size > sigV4MaxChunkSize {
+		return errMalformedAuth
+	}
+
+	if int64(cap(c.chunk)) < size {
+		c.chunk = make([]byte, size)
+	}
+	c.chunk = c.chunk[:size]
+	if _, err = io.ReadFull(c.reader, c.chunk); err != nil {
+		return err
+	}
+
+	crlf := make([]byte, 2)
+	if _, err = io.ReadFull(c.reader, crlf); err != nil || !bytes.Equal(crlf, []byte("\r\n")) {
+		return errMalformedAuth
+	}
+
+	stringToSign := strings.Join([]string{
+		sigV4ChunkAlgorithm,
+		c.auth.date.Format(sigV4TimeFormat),
+		c.auth.scope,
+		c.prevSig,
+		emptySHA256,
+		hashHex(c.chunk),
+	}, "\n")
+
+	signature := strings.TrimPrefix(ext, "chunk-signature=")
+	expected := hex.EncodeToString(hmacSHA256(c.auth.signingKey, []byte(stringToSign)))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errSignatureMismatch
+	}
+
+	c.prevSig = signature
+	c.remaining = c.chunk
+	c.done = size == 0
+	return nil
+}
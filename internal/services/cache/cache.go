@@ -1,12 +1,107 @@
 package cache
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultLockTTL    = time.Minute * 10
+	LockRetryInterval = time.Millisecond * 100
+)
 
 var (
-	ErrExists = errors.New("key exists")
+	ErrExists  = errors.New("key exists")
+	ErrNotHeld = errors.New("key isn't held")
 )
 
+// Lock is a lease of a key. It's held by its owner until it's unlocked or expires.
+type Lock struct {
+	Key        string
+	Owner      string
+	AcquiredAt time.Time
+	ExpiresAt  time.Time
+}
+
+// Cache locks keys with leases which expire after the TTL unless they're renewed.
+// Every acquisition returns its own token, so requests of the same process can't
+// renew or unlock the keys taken by each other.
 type Cache interface {
-	Lock(keys []string) error
-	Unlock(keys []string)
+	// Lock takes all the keys or none of them. It fails with ErrExists when any key is held.
+	Lock(keys []string) (string, error)
+	// LockContext waits until all the keys are free and takes them.
+	LockContext(ctx context.Context, keys []string) (string, error)
+	// Renew extends the leases of the keys taken with the token. It fails with
+	// ErrNotHeld when any key isn't held with the token anymore.
+	Renew(token string, keys []string) error
+	// Unlock releases the keys which are still held with the token.
+	Unlock(token string, keys []string)
+	// Locks returns the locks held now by all owners.
+	Locks(ctx context.Context) ([]Lock, error)
+	TTL() time.Duration
+}
+
+// Hold renews the leases of the keys locked with the token until the returned function
+// is called, which unlocks them. The returned context is cancelled once a lease is lost.
+func Hold(ctx context.Context, log *zap.SugaredLogger, c Cache, token string, keys []string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(c.TTL() / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if err := c.Renew(token, keys); err != nil {
+				log.With("err", err).Errorf("failed to renew locks of %v", keys)
+				if errors.Is(err, ErrNotHeld) {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	return ctx, func() {
+		close(done)
+		cancel()
+		c.Unlock(token, keys)
+	}
+}
+
+func lockContext(ctx context.Context, lock func([]string) (string, error), keys []string) (string, error) {
+	for {
+		token, err := lock(keys)
+		if !errors.Is(err, ErrExists) {
+			return token, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(LockRetryInterval):
+		}
+	}
+}
+
+// newOwner returns an ID which tells the process holding locks.
+func newOwner() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return uuid.NewString()
+	}
+	return hostname + "-" + uuid.NewString()
 }
@@ -1,28 +1,136 @@
 package cache
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 )
 
 func TestMapCache(t *testing.T) {
 	mc := NewMapCache()
 
 	keys := []string{"key1", "key2"}
-	err := mc.Lock(keys)
+	token, err := mc.Lock(keys)
 	require.NoError(t, err)
 
-	err = mc.Lock([]string{"key1"})
+	_, err = mc.Lock([]string{"key1"})
 	require.Error(t, err)
 
-	err = mc.Lock([]string{"key2"})
+	_, err = mc.Lock([]string{"key2"})
 	require.Error(t, err)
 
-	err = mc.Lock(keys)
+	_, err = mc.Lock(keys)
 	require.Error(t, err)
 
-	mc.Unlock(keys)
-	err = mc.Lock(keys)
+	mc.Unlock(token, keys)
+	_, err = mc.Lock(keys)
 	require.NoError(t, err)
 }
+
+func TestMapCache_Leases(t *testing.T) {
+	mc := newMapCache(time.Millisecond * 100)
+
+	keys := []string{"key1", "key2"}
+	token, err := mc.Lock(keys)
+	require.NoError(t, err)
+
+	locks, err := mc.Locks(context.Background())
+	require.NoError(t, err)
+	require.Len(t, locks, 2)
+	require.Equal(t, mc.owner, locks[0].Owner)
+
+	time.Sleep(time.Millisecond * 60)
+	require.NoError(t, mc.Renew(token, keys))
+	time.Sleep(time.Millisecond * 60)
+	_, err = mc.Lock(keys[:1])
+	require.ErrorIs(t, err, ErrExists)
+
+	// an expired lock is free
+	time.Sleep(time.Millisecond * 60)
+	locks, err = mc.Locks(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, locks)
+	token, err = mc.Lock(keys)
+	require.NoError(t, err)
+
+	mc.Unlock(token, keys)
+	require.ErrorIs(t, mc.Renew(token, keys), ErrNotHeld)
+}
+
+func TestMapCache_Tokens(t *testing.T) {
+	mc := newMapCache(time.Millisecond * 50)
+
+	keys := []string{"key1"}
+	expired, err := mc.Lock(keys)
+	require.NoError(t, err)
+
+	// the same process takes the expired key over with another acquisition
+	time.Sleep(time.Millisecond * 60)
+	token, err := mc.Lock(keys)
+	require.NoError(t, err)
+	require.NotEqual(t, expired, token)
+
+	// the stale acquisition neither renews nor releases the new one
+	require.ErrorIs(t, mc.Renew(expired, keys), ErrNotHeld)
+	mc.Unlock(expired, keys)
+	require.NoError(t, mc.Renew(token, keys))
+	_, err = mc.Lock(keys)
+	require.ErrorIs(t, err, ErrExists)
+
+	mc.Unlock(token, keys)
+	_, err = mc.Lock(keys)
+	require.NoError(t, err)
+}
+
+func TestMapCache_LockContext(t *testing.T) {
+	mc := newMapCache(time.Minute)
+
+	keys := []string{"key1"}
+	token, err := mc.Lock(keys)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), LockRetryInterval*2)
+	defer cancel()
+	_, err = mc.LockContext(ctx, keys)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	go func() {
+		time.Sleep(LockRetryInterval)
+		mc.Unlock(token, keys)
+	}()
+	_, err = mc.LockContext(context.Background(), keys)
+	require.NoError(t, err)
+}
+
+func TestHold(t *testing.T) {
+	mc := newMapCache(time.Millisecond * 60)
+
+	keys := []string{"key1"}
+	token, err := mc.Lock(keys)
+	require.NoError(t, err)
+
+	ctx, release := Hold(context.Background(), zap.NewNop().Sugar(), mc, token, keys)
+	time.Sleep(time.Millisecond * 150)
+	require.NoError(t, ctx.Err())
+	_, err = mc.Lock(keys)
+	require.ErrorIs(t, err, ErrExists)
+
+	release()
+	require.Error(t, ctx.Err())
+	token, err = mc.Lock(keys)
+	require.NoError(t, err)
+
+	// the context is cancelled once the lease is lost
+	ctx, release = Hold(context.Background(), zap.NewNop().Sugar(), mc, token, keys)
+	defer release()
+	mc.Unlock(token, keys)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context isn't cancelled")
+	}
+}
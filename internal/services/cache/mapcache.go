@@ -1,41 +1,124 @@
 package cache
 
-import "sync"
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// lease is a lock with the token of the acquisition which took it.
+type lease struct {
+	Lock
+	token string
+}
 
 type mapCache struct {
 	locker sync.Mutex
-	keys   map[string]struct{}
+	owner  string
+	ttl    time.Duration
+	locks  map[string]lease
 }
 
 func NewMapCache() Cache {
+	return newMapCache(DefaultLockTTL)
+}
+
+func newMapCache(ttl time.Duration) *mapCache {
 	return &mapCache{
-		keys: make(map[string]struct{}),
+		owner: newOwner(),
+		ttl:   ttl,
+		locks: make(map[string]lease),
 	}
 }
 
-func (m *mapCache) Lock(keys []string) error {
+func (m *mapCache) Lock(keys []string) (string, error) {
 	m.locker.Lock()
 	defer m.locker.Unlock()
 
+	now := time.Now()
 	for _, k := range keys {
-		_, ok := m.keys[k]
-		if ok {
-			return ErrExists
+		if m.held(k, now) {
+			return "", ErrExists
 		}
 	}
 
+	token := uuid.NewString()
 	for _, k := range keys {
-		m.keys[k] = struct{}{}
+		m.locks[k] = lease{
+			Lock: Lock{
+				Key:        k,
+				Owner:      m.owner,
+				AcquiredAt: now,
+				ExpiresAt:  now.Add(m.ttl),
+			},
+			token: token,
+		}
+	}
+
+	return token, nil
+}
+
+func (m *mapCache) LockContext(ctx context.Context, keys []string) (string, error) {
+	return lockContext(ctx, m.Lock, keys)
+}
+
+func (m *mapCache) Renew(token string, keys []string) error {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	for _, k := range keys {
+		if l, ok := m.locks[k]; !ok || l.token != token {
+			return ErrNotHeld
+		}
+	}
+
+	expiresAt := time.Now().Add(m.ttl)
+	for _, k := range keys {
+		l := m.locks[k]
+		l.ExpiresAt = expiresAt
+		m.locks[k] = l
 	}
 
 	return nil
 }
 
-func (m *mapCache) Unlock(keys []string) {
+func (m *mapCache) Unlock(token string, keys []string) {
 	m.locker.Lock()
 	defer m.locker.Unlock()
 
 	for _, k := range keys {
-		delete(m.keys, k)
+		if l, ok := m.locks[k]; ok && l.token == token {
+			delete(m.locks, k)
+		}
+	}
+}
+
+func (m *mapCache) Locks(_ context.Context) ([]Lock, error) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	now := time.Now()
+	result := make([]Lock, 0, len(m.locks))
+	for k, l := range m.locks {
+		if m.held(k, now) {
+			result = append(result, l.Lock)
+		}
 	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].AcquiredAt.Before(result[j].AcquiredAt)
+	})
+	return result, nil
+}
+
+func (m *mapCache) TTL() time.Duration {
+	return m.ttl
+}
+
+func (m *mapCache) held(key string, now time.Time) bool {
+	l, ok := m.locks[key]
+	return ok && now.Before(l.ExpiresAt)
 }
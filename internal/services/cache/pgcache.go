@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+
+	"github.com/blkmlk/file-storage/env"
+)
+
+// pgCache keeps locks in the locks table, so they're shared by all uploaders using
+// the database. Every lock is a lease which expires after the TTL, so locks of a crashed
+// uploader are taken over by others eventually. The owner tells the uploader holding
+// a lock, the token tells the acquisition.
+type pgCache struct {
+	log   *zap.SugaredLogger
+	db    *gorm.DB
+	owner string
+	ttl   time.Duration
+}
+
+func NewPostgresCache(log *zap.SugaredLogger, db *gorm.DB) (Cache, error) {
+	ttl, err := time.ParseDuration(env.GetOptional(env.LockTTL, DefaultLockTTL.String()))
+	if err != nil || ttl <= 0 {
+		return nil, fmt.Errorf("%s is not a positive duration", env.LockTTL)
+	}
+
+	return newPostgresCache(log, db, newOwner(), ttl), nil
+}
+
+func newPostgresCache(log *zap.SugaredLogger, db *gorm.DB, owner string, ttl time.Duration) *pgCache {
+	return &pgCache{
+		log:   log,
+		db:    db,
+		owner: owner,
+		ttl:   ttl,
+	}
+}
+
+func (c *pgCache) Lock(keys []string) (string, error) {
+	keys = uniqueKeys(keys)
+	token := uuid.NewString()
+	if len(keys) == 0 {
+		return token, nil
+	}
+
+	// a key which is held fails the transaction, so none of the keys is taken
+	err := c.db.Transaction(func(tx *gorm.DB) error {
+		for _, key := range keys {
+			// expired locks are taken over, the database clock is used by all owners
+			res := tx.Exec(`
+				INSERT INTO locks (name, owner, token, acquired_at, expires_at)
+				VALUES (?, ?, ?, NOW(), NOW() + ? * INTERVAL '1 millisecond')
+				ON CONFLICT (name) DO UPDATE
+					SET owner = EXCLUDED.owner, token = EXCLUDED.token,
+						acquired_at = EXCLUDED.acquired_at, expires_at = EXCLUDED.expires_at
+				WHERE locks.expires_at < NOW()`,
+				key, c.owner, token, c.ttl.Milliseconds())
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected == 0 {
+				return ErrExists
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (c *pgCache) LockContext(ctx context.Context, keys []string) (string, error) {
+	return lockContext(ctx, c.Lock, keys)
+}
+
+// Renew extends the leases of the keys unless they have been taken over.
+func (c *pgCache) Renew(token string, keys []string) error {
+	keys = uniqueKeys(keys)
+	if len(keys) == 0 {
+		return nil
+	}
+
+	return c.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Exec(`
+			UPDATE locks SET expires_at = NOW() + ? * INTERVAL '1 millisecond'
+			WHERE name IN ? AND token = ?`,
+			c.ttl.Milliseconds(), keys, token)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected < int64(len(keys)) {
+			return ErrNotHeld
+		}
+		return nil
+	})
+}
+
+func (c *pgCache) Unlock(token string, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	err := c.db.Exec(`DELETE FROM locks WHERE name IN ? AND token = ?`, keys, token).Error
+	if err != nil {
+		c.log.With("err", err).Errorf("failed to unlock %v", keys)
+	}
+}
+
+func (c *pgCache) Locks(ctx context.Context) ([]Lock, error) {
+	var locks []Lock
+	err := c.db.WithContext(ctx).Raw(`
+		SELECT name AS key, owner, acquired_at, expires_at FROM locks
+		WHERE expires_at >= NOW() ORDER BY acquired_at`).
+		Scan(&locks).Error
+	if err != nil {
+		return nil, err
+	}
+	return locks, nil
+}
+
+func (c *pgCache) TTL() time.Duration {
+	return c.ttl
+}
+
+func uniqueKeys(keys []string) []string {
+	seen := make(map[string]struct{}, len(keys))
+	result := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		result = append(result, k)
+	}
+	return result
+}
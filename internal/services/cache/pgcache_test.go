@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/blkmlk/file-storage/deps"
+	"github.com/blkmlk/file-storage/migrations"
+)
+
+func TestPostgresCache(t *testing.T) {
+	db, err := deps.NewLocalDB()
+	require.NoError(t, err)
+
+	m, err := migrations.NewLocal()
+	require.NoError(t, err)
+	if err = m.Up(); err != nil {
+		require.ErrorIs(t, err, migrate.ErrNoChange)
+	}
+
+	first := newPostgresCache(zap.NewNop().Sugar(), db, uuid.NewString(), time.Minute)
+	second := newPostgresCache(zap.NewNop().Sugar(), db, uuid.NewString(), time.Minute)
+
+	keys := []string{uuid.NewString(), uuid.NewString()}
+	firstToken, err := first.Lock(keys)
+	require.NoError(t, err)
+	_, err = second.Lock(keys[:1])
+	require.ErrorIs(t, err, ErrExists)
+	_, err = first.Lock(keys[1:])
+	require.ErrorIs(t, err, ErrExists)
+
+	// the failed lock takes none of the keys
+	other := uuid.NewString()
+	_, err = second.Lock([]string{other, keys[1]})
+	require.ErrorIs(t, err, ErrExists)
+	otherToken, err := first.Lock([]string{other})
+	require.NoError(t, err)
+	first.Unlock(otherToken, []string{other})
+
+	// only the acquisition which took the keys unlocks them, even in the same process
+	second.Unlock(otherToken, keys)
+	first.Unlock(otherToken, keys)
+	_, err = second.Lock(keys)
+	require.ErrorIs(t, err, ErrExists)
+
+	first.Unlock(firstToken, keys)
+	secondToken, err := second.Lock(append(keys, keys[0]))
+	require.NoError(t, err)
+	require.ErrorIs(t, first.Renew(firstToken, keys), ErrNotHeld)
+	require.NoError(t, second.Renew(secondToken, keys))
+
+	locks, err := first.Locks(context.Background())
+	require.NoError(t, err)
+	var held []string
+	for _, l := range locks {
+		if l.Owner == second.owner {
+			held = append(held, l.Key)
+		}
+	}
+	require.ElementsMatch(t, keys, held)
+	second.Unlock(secondToken, keys)
+}
+
+func TestPostgresCache_Expiry(t *testing.T) {
+	db, err := deps.NewLocalDB()
+	require.NoError(t, err)
+
+	crashed := newPostgresCache(zap.NewNop().Sugar(), db, uuid.NewString(), time.Millisecond*100)
+	alive := newPostgresCache(zap.NewNop().Sugar(), db, uuid.NewString(), time.Minute)
+
+	keys := []string{uuid.NewString()}
+	crashedToken, err := crashed.Lock(keys)
+	require.NoError(t, err)
+	_, err = alive.Lock(keys)
+	require.ErrorIs(t, err, ErrExists)
+
+	time.Sleep(time.Millisecond * 200)
+	aliveToken, err := alive.Lock(keys)
+	require.NoError(t, err)
+
+	// the expired acquisition can't release the lock taken over
+	require.ErrorIs(t, crashed.Renew(crashedToken, keys), ErrNotHeld)
+	crashed.Unlock(crashedToken, keys)
+	_, err = crashed.Lock(keys)
+	require.ErrorIs(t, err, ErrExists)
+	alive.Unlock(aliveToken, keys)
+}
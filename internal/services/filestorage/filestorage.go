@@ -3,10 +3,27 @@ package filestorage
 import (
 	"context"
 	"io"
+	"time"
 )
 
 type FileStorage interface {
 	Create(ctx context.Context, name string) (io.WriteCloser, error)
 	Get(ctx context.Context, name string) (io.ReadCloser, error)
 	Exists(ctx context.Context, name string) (bool, error)
+	Delete(ctx context.Context, name string) error
+	Usage(ctx context.Context) (Usage, error)
+	List(ctx context.Context, startAfter string, limit int) ([]FileInfo, error)
+}
+
+type FileInfo struct {
+	Name       string
+	Size       int64
+	ModifiedAt time.Time
+}
+
+// Usage is the capacity of the disk the files are kept on, in bytes.
+type Usage struct {
+	Total int64
+	Used  int64
+	Free  int64
 }
@@ -51,4 +51,30 @@ func TestFSStorage(t *testing.T) {
 	fileBytes, err := io.ReadAll(reader)
 	require.NoError(t, err)
 	require.Equal(t, buff, fileBytes)
+	require.NoError(t, reader.Close())
+
+	files, err := fs.List(ctx, "", 10)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.Equal(t, "test", files[0].Name)
+	require.EqualValues(t, len(buff), files[0].Size)
+
+	files, err = fs.List(ctx, "test", 10)
+	require.NoError(t, err)
+	require.Empty(t, files)
+
+	err = fs.Delete(ctx, "test")
+	require.NoError(t, err)
+
+	exists, err = fs.Exists(ctx, "test")
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	err = fs.Delete(ctx, "test")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	usage, err := fs.Usage(ctx)
+	require.NoError(t, err)
+	require.Positive(t, usage.Total)
+	require.LessOrEqual(t, usage.Used+usage.Free, usage.Total)
 }
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"syscall"
 
 	"github.com/blkmlk/file-storage/env"
 )
@@ -69,6 +70,68 @@ func (f *fsFileStorage) Exists(ctx context.Context, name string) (bool, error) {
 	return !info.IsDir(), nil
 }
 
+func (f *fsFileStorage) Delete(ctx context.Context, name string) error {
+	filePath := f.getFilePath(name)
+
+	if err := os.Remove(filePath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+// List returns the files with names after startAfter ordered by their names.
+func (f *fsFileStorage) List(ctx context.Context, startAfter string, limit int) ([]FileInfo, error) {
+	entries, err := os.ReadDir(f.rootPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []FileInfo
+	for _, entry := range entries {
+		if len(result) == limit {
+			break
+		}
+		if entry.IsDir() || entry.Name() <= startAfter {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			// the file is deleted while it's listed
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		result = append(result, FileInfo{
+			Name:       entry.Name(),
+			Size:       info.Size(),
+			ModifiedAt: info.ModTime(),
+		})
+	}
+	return result, nil
+}
+
+// Usage reports the space available to unprivileged users as free,
+// the blocks reserved for root count as neither used nor free.
+func (f *fsFileStorage) Usage(ctx context.Context) (Usage, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(f.rootPath, &stat); err != nil {
+		return Usage{}, err
+	}
+
+	blockSize := int64(stat.Bsize)
+	total := int64(stat.Blocks) * blockSize
+	return Usage{
+		Total: total,
+		Used:  total - int64(stat.Bfree)*blockSize,
+		Free:  int64(stat.Bavail) * blockSize,
+	}, nil
+}
+
 func (f *fsFileStorage) getFilePath(name string) string {
 	return fmt.Sprintf("%s/%s", f.rootPath, name)
 }
@@ -0,0 +1,101 @@
+package manager
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"strconv"
+)
+
+var ErrChecksumMismatch = errors.New("checksum doesn't match")
+
+// Checksums are the digests a client expects the content to have.
+// Empty ones aren't checked.
+type Checksums struct {
+	MD5    []byte
+	SHA256 []byte
+}
+
+// checksumReader computes the digest of the file while it's read. It fails instead
+// of returning EOF when the content doesn't match the expected checksums, so the
+// upload is discarded before the file is saved.
+type checksumReader struct {
+	reader   io.Reader
+	sha256   hash.Hash
+	md5      hash.Hash
+	expected Checksums
+}
+
+func newChecksumReader(reader io.Reader, expected Checksums) *checksumReader {
+	r := &checksumReader{
+		reader:   reader,
+		sha256:   sha256.New(),
+		expected: expected,
+	}
+	r.md5 = md5.New()
+	return r
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.sha256.Write(p[:n])
+	r.md5.Write(p[:n])
+	if errors.Is(err, io.EOF) {
+		if err := r.verify(); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+func (r *checksumReader) verify() error {
+	if len(r.expected.SHA256) > 0 && !bytes.Equal(r.sha256.Sum(nil), r.expected.SHA256) {
+		return ErrChecksumMismatch
+	}
+	if len(r.expected.MD5) > 0 && !bytes.Equal(r.md5.Sum(nil), r.expected.MD5) {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// Hash returns the hex-encoded SHA-256 of the content read so far.
+func (r *checksumReader) Hash() string {
+	return hex.EncodeToString(r.sha256.Sum(nil))
+}
+
+// MD5 returns the hex-encoded MD5 of the content read so far.
+func (r *checksumReader) MD5() string {
+	return hex.EncodeToString(r.md5.Sum(nil))
+}
+
+// multipartHash is the hash of a file assembled from parts: the SHA-256 of
+// their digests followed by the number of parts, as S3 does with MD5.
+func multipartHash(parts []UploadedPart) string {
+	h := sha256.New()
+	for _, p := range parts {
+		digest, err := hex.DecodeString(p.Hash)
+		if err != nil {
+			return ""
+		}
+		h.Write(digest)
+	}
+	return hex.EncodeToString(h.Sum(nil)) + "-" + strconv.Itoa(len(parts))
+}
+
+// multipartMD5 is the MD5 of the part MD5s followed by the number of parts, which S3
+// clients expect as the ETag of a multipart upload. It's empty when a part MD5 isn't known.
+func multipartMD5(parts []UploadedPart) string {
+	h := md5.New()
+	for _, p := range parts {
+		digest, err := hex.DecodeString(p.MD5)
+		if err != nil || len(digest) != md5.Size {
+			return ""
+		}
+		h.Write(digest)
+	}
+	return hex.EncodeToString(h.Sum(nil)) + "-" + strconv.Itoa(len(parts))
+}
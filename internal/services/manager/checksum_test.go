@@ -0,0 +1,118 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/blkmlk/file-storage/internal/mocks"
+	"github.com/blkmlk/file-storage/protocol"
+)
+
+func TestChecksumReader(t *testing.T) {
+	data := make([]byte, 3*ChunkSize+100)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	md5Sum := md5.Sum(data)
+	sha256Sum := sha256.Sum256(data)
+	wrong := sha256.Sum256(data[1:])
+
+	tests := []struct {
+		name     string
+		expected Checksums
+		err      error
+	}{
+		{name: "not expected"},
+		{name: "matching", expected: Checksums{MD5: md5Sum[:], SHA256: sha256Sum[:]}},
+		{name: "wrong md5", expected: Checksums{MD5: wrong[:md5.Size]}, err: ErrChecksumMismatch},
+		{name: "wrong sha256", expected: Checksums{SHA256: wrong[:]}, err: ErrChecksumMismatch},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := newChecksumReader(bytes.NewReader(data), tt.expected)
+
+			read, err := io.ReadAll(reader)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, data, read)
+			require.Equal(t, hex.EncodeToString(sha256Sum[:]), reader.Hash())
+			require.Equal(t, hex.EncodeToString(md5Sum[:]), reader.MD5())
+		})
+	}
+}
+
+func TestLoader_UploadChecksumMismatch(t *testing.T) {
+	ctx := context.Background()
+
+	fullSize := int64(2*ChunkSize + 10)
+	data := make([]byte, fullSize)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	wrong := sha256.Sum256(data[1:])
+
+	ldr := NewLoader(zap.NewNop().Sugar(), fullSize)
+	for seq := 0; seq < 2; seq++ {
+		client := mocks.NewStorage(ctx)
+		resp, err := client.CheckReadiness(ctx, &protocol.CheckReadinessRequest{})
+		require.NoError(t, err)
+
+		ldr.AddFilePart(&FilePart{
+			Seq:       seq,
+			RemoteID:  resp.Id,
+			StorageID: uuid.NewString(),
+			Client:    client,
+		})
+	}
+
+	// the mismatch is found only when the whole file is read
+	err = ldr.Upload(ctx, newChecksumReader(bytes.NewReader(data), Checksums{SHA256: wrong[:]}))
+	require.ErrorIs(t, err, ErrChecksumMismatch)
+}
+
+func TestMultipartHash(t *testing.T) {
+	first := sha256.Sum256([]byte("first"))
+	second := sha256.Sum256([]byte("second"))
+
+	parts := []UploadedPart{
+		{Number: 1, Hash: hex.EncodeToString(first[:])},
+		{Number: 2, Hash: hex.EncodeToString(second[:])},
+	}
+
+	expected := sha256.Sum256(append(first[:], second[:]...))
+	require.Equal(t, hex.EncodeToString(expected[:])+"-2", multipartHash(parts))
+
+	parts[1].Hash = "unknown"
+	require.Empty(t, multipartHash(parts))
+}
+
+func TestMultipartMD5(t *testing.T) {
+	first := md5.Sum([]byte("first"))
+	second := md5.Sum([]byte("second"))
+
+	parts := []UploadedPart{
+		{Number: 1, MD5: hex.EncodeToString(first[:])},
+		{Number: 2, MD5: hex.EncodeToString(second[:])},
+	}
+
+	expected := md5.Sum(append(first[:], second[:]...))
+	require.Equal(t, hex.EncodeToString(expected[:])+"-2", multipartMD5(parts))
+
+	// parts uploaded before MD5s were kept
+	parts[1].MD5 = ""
+	require.Empty(t, multipartMD5(parts))
+}
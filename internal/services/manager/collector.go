@@ -0,0 +1,282 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/blkmlk/file-storage/env"
+	"github.com/blkmlk/file-storage/internal/services/cache"
+	"github.com/blkmlk/file-storage/internal/services/repository"
+	"github.com/blkmlk/file-storage/protocol"
+)
+
+const (
+	DefaultGCInterval  = time.Hour
+	DefaultGCUploadTTL = time.Hour * 24
+	DefaultGCOrphanAge = time.Hour
+	GCBatchSize        = 100
+	GCListLimit        = 1000
+)
+
+// gcMetrics counts expired uploads and orphaned parts, the ones found in dry-run
+// mode are counted separately.
+var gcMetrics = expvar.NewMap("gc")
+
+// GarbageCollector removes what failed or abandoned uploads leave behind: files which
+// were prepared but never uploaded and parts on storages which no file refers to.
+type GarbageCollector interface {
+	Run(ctx context.Context) error
+}
+
+func NewGarbageCollector(
+	log *zap.SugaredLogger,
+	repo repository.Repository,
+	cache cache.Cache,
+	clientFactory ClientFactory,
+) (GarbageCollector, error) {
+	interval, err := time.ParseDuration(env.GetOptional(env.GCInterval, DefaultGCInterval.String()))
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("%s is not a positive duration", env.GCInterval)
+	}
+
+	uploadTTL, err := time.ParseDuration(env.GetOptional(env.GCUploadTTL, DefaultGCUploadTTL.String()))
+	if err != nil || uploadTTL <= 0 {
+		return nil, fmt.Errorf("%s is not a positive duration", env.GCUploadTTL)
+	}
+
+	orphanAge, err := time.ParseDuration(env.GetOptional(env.GCOrphanAge, DefaultGCOrphanAge.String()))
+	if err != nil || orphanAge <= 0 {
+		return nil, fmt.Errorf("%s is not a positive duration", env.GCOrphanAge)
+	}
+
+	dryRun, err := strconv.ParseBool(env.GetOptional(env.GCDryRun, "false"))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a boolean", env.GCDryRun)
+	}
+
+	return &collector{
+		log:           log,
+		repo:          repo,
+		cache:         cache,
+		clientFactory: clientFactory,
+		interval:      interval,
+		uploadTTL:     uploadTTL,
+		orphanAge:     orphanAge,
+		dryRun:        dryRun,
+	}, nil
+}
+
+type collector struct {
+	log           *zap.SugaredLogger
+	repo          repository.Repository
+	cache         cache.Cache
+	clientFactory ClientFactory
+	interval      time.Duration
+	// uploadTTL is how long a prepared or initiated upload may stay unchanged
+	uploadTTL time.Duration
+	// orphanAge is how old a part must be to be deleted when nothing refers to it,
+	// so the parts which are being written aren't deleted. The parts of a file which
+	// are written already while the rest of it is sent are reserved for the file.
+	orphanAge time.Duration
+	// dryRun makes the collector only log what it would delete
+	dryRun bool
+}
+
+func (c *collector) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		runLeased(ctx, c.log, c.cache, "gc", func(ctx context.Context) {
+			if err := c.collectUploads(ctx); err != nil {
+				c.log.With("err", err).Error("failed to collect expired uploads")
+			}
+
+			if err := c.collectOrphans(ctx); err != nil {
+				c.log.With("err", err).Error("failed to collect orphaned parts")
+			}
+		})
+	}
+}
+
+// collectUploads deletes the files which stayed prepared or partially uploaded for
+// longer than the TTL together with their parts.
+func (c *collector) collectUploads(ctx context.Context) error {
+	for {
+		files, err := c.repo.FindExpiredUploads(ctx, time.Now().Add(-c.uploadTTL), GCBatchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			if c.dryRun {
+				gcMetrics.Add("expired_uploads_found", 1)
+				c.log.Infof("dry run: upload %s in status %s would expire", file.ID, file.Status)
+				continue
+			}
+
+			if err = c.expireUpload(ctx, file); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				c.log.With("err", err).Warnf("failed to expire upload %s", file.ID)
+			}
+		}
+
+		// nothing is deleted in dry-run mode, so the same uploads would be found again
+		if c.dryRun || len(files) < GCBatchSize {
+			return nil
+		}
+	}
+}
+
+func (c *collector) expireUpload(ctx context.Context, file *repository.File) error {
+	keys := []string{file.ID}
+	if file.Name != nil {
+		keys = append(keys, *file.Name)
+	}
+	ctx, unlock, err := lockKeys(ctx, c.log, c.cache, 0, keys)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// the upload may be completed while it isn't locked
+	current, err := c.repo.GetFile(ctx, file.ID)
+	if err != nil {
+		return err
+	}
+	if current.Status == repository.FileStatusUploaded || current.UpdatedAt.After(file.UpdatedAt) {
+		return nil
+	}
+
+	deletions, err := c.repo.DeleteFile(ctx, file.ID)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	deleteParts(ctx, c.log, c.repo, c.clientFactory, deletions)
+
+	gcMetrics.Add("expired_uploads", 1)
+	c.log.Infof("upload %s in status %s expired with %d parts", file.ID, file.Status, len(deletions))
+
+	return nil
+}
+
+// collectOrphans compares the parts every storage keeps with the parts in the DB and
+// deletes the ones nothing refers to.
+func (c *collector) collectOrphans(ctx context.Context) error {
+	storages, err := c.repo.FindStorages(ctx)
+	if err != nil {
+		return err
+	}
+
+	olderThan := time.Now().Add(-c.orphanAge)
+	for _, s := range storages {
+		client, err := c.clientFactory.NewStorageClient(ctx, s.Host)
+		if err != nil {
+			c.log.With("err", err).Warnf("failed to connect to storage %s", s.ID)
+			continue
+		}
+
+		orphans, err := findOrphans(ctx, client, olderThan, func(remoteIDs []string) ([]string, error) {
+			return c.repo.FindKnownRemoteIDs(ctx, s.ID, remoteIDs)
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			c.log.With("err", err).Warnf("failed to list parts of storage %s", s.ID)
+			continue
+		}
+
+		if c.dryRun {
+			for _, remoteID := range orphans {
+				c.log.Infof("dry run: part %s on storage %s would be deleted", remoteID, s.ID)
+			}
+			gcMetrics.Add("orphans_found", int64(len(orphans)))
+			continue
+		}
+
+		fileParts := make([]FilePart, 0, len(orphans))
+		for _, remoteID := range orphans {
+			fileParts = append(fileParts, FilePart{
+				RemoteID:  remoteID,
+				StorageID: s.ID,
+			})
+		}
+		discardFileParts(c.log, c.repo, c.clientFactory, fileParts)
+
+		if len(orphans) > 0 {
+			gcMetrics.Add("orphans", int64(len(orphans)))
+			c.log.Infof("%d orphaned parts are deleted from storage %s", len(orphans), s.ID)
+		}
+	}
+
+	return nil
+}
+
+// findOrphans lists the parts on the storage page by page and returns the ones older
+// than the given time which aren't known.
+func findOrphans(
+	ctx context.Context,
+	client protocol.StorageClient,
+	olderThan time.Time,
+	known func(remoteIDs []string) ([]string, error),
+) ([]string, error) {
+	var (
+		orphans    []string
+		startAfter string
+	)
+	for {
+		reqCtx, cancel := context.WithTimeout(ctx, MaxResponseTime)
+		resp, err := client.ListFileParts(reqCtx, &protocol.ListFilePartsRequest{
+			StartAfter: startAfter,
+			Limit:      GCListLimit,
+		})
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Parts) == 0 {
+			return orphans, nil
+		}
+		startAfter = resp.Parts[len(resp.Parts)-1].Id
+
+		var candidates []string
+		for _, p := range resp.Parts {
+			if time.Unix(p.ModifiedAt, 0).Before(olderThan) {
+				candidates = append(candidates, p.Id)
+			}
+		}
+
+		knownIDs, err := known(candidates)
+		if err != nil {
+			return nil, err
+		}
+		isKnown := make(map[string]bool, len(knownIDs))
+		for _, id := range knownIDs {
+			isKnown[id] = true
+		}
+
+		for _, id := range candidates {
+			if !isKnown[id] {
+				orphans = append(orphans, id)
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/blkmlk/file-storage/internal/mocks"
+	"github.com/blkmlk/file-storage/internal/services/repository"
+	"github.com/blkmlk/file-storage/protocol"
+)
+
+func TestCollector_FindOrphans(t *testing.T) {
+	ctx := context.Background()
+
+	client := mocks.NewStorage(ctx)
+	storageID := uuid.NewString()
+
+	fullSize := int64(3 * ChunkSize)
+	ldr := NewLoader(zap.NewNop().Sugar(), fullSize)
+	for seq := 0; seq < 3; seq++ {
+		resp, err := client.CheckReadiness(ctx, &protocol.CheckReadinessRequest{})
+		require.NoError(t, err)
+
+		ldr.AddFilePart(&FilePart{
+			Seq:       seq,
+			RemoteID:  resp.Id,
+			StorageID: storageID,
+			Client:    client,
+		})
+	}
+
+	buff := make([]byte, fullSize)
+	_, err := rand.Read(buff)
+	require.NoError(t, err)
+	require.NoError(t, ldr.Upload(ctx, bytes.NewReader(buff)))
+
+	// a reserved part has nothing on disk yet
+	_, err = client.CheckReadiness(ctx, &protocol.CheckReadinessRequest{})
+	require.NoError(t, err)
+
+	fileParts := ldr.GetFileParts()
+	known := func(remoteIDs []string) ([]string, error) {
+		require.Len(t, remoteIDs, 3)
+		return []string{fileParts[0].RemoteID, fileParts[2].RemoteID}, nil
+	}
+
+	orphans, err := findOrphans(ctx, client, time.Now().Add(time.Minute), known)
+	require.NoError(t, err)
+	require.Equal(t, []string{fileParts[1].RemoteID}, orphans)
+
+	// parts which may still be uploaded aren't orphans
+	orphans, err = findOrphans(ctx, client, time.Now().Add(-time.Minute), func(remoteIDs []string) ([]string, error) {
+		require.Empty(t, remoteIDs)
+		return nil, nil
+	})
+	require.NoError(t, err)
+	require.Empty(t, orphans)
+}
+
+// reservingRepo keeps the storages and the part reservations, the parts
+// which are reserved are the only known ones.
+type reservingRepo struct {
+	repository.Repository
+	locker   sync.Mutex
+	storages []*repository.Storage
+	reserved map[string]bool
+}
+
+func (r *reservingRepo) FindStorages(ctx context.Context) ([]*repository.Storage, error) {
+	return r.storages, nil
+}
+
+func (r *reservingRepo) CreatePartReservations(ctx context.Context, reservations []repository.PartReservation) error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	for _, pr := range reservations {
+		r.reserved[pr.StorageID+"/"+pr.RemoteID] = true
+	}
+	return nil
+}
+
+func (r *reservingRepo) FindKnownRemoteIDs(ctx context.Context, storageID string, remoteIDs []string) ([]string, error) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	var known []string
+	for _, id := range remoteIDs {
+		if r.reserved[storageID+"/"+id] {
+			known = append(known, id)
+		}
+	}
+	return known, nil
+}
+
+type storageFactory map[string]*mocks.Storage
+
+func (f storageFactory) NewStorageClient(ctx context.Context, host string) (protocol.StorageClient, error) {
+	return f[host], nil
+}
+
+func TestCollector_SlowUpload(t *testing.T) {
+	ctx := context.Background()
+
+	storage := repository.NewStorage(uuid.NewString(), "storage")
+	client := mocks.NewStorage(ctx)
+	repo := &reservingRepo{storages: []*repository.Storage{&storage}, reserved: make(map[string]bool)}
+	factory := storageFactory{storage.Host: client}
+
+	m := &manager{log: zap.NewNop().Sugar(), repo: repo, clientFactory: factory}
+
+	partSize := int64(2 * ChunkSize)
+	ldr := NewLoader(zap.NewNop().Sugar(), 2*partSize)
+	ldr.SetParallelism(1)
+	for seq := 0; seq < 2; seq++ {
+		resp, err := client.CheckReadiness(ctx, &protocol.CheckReadinessRequest{Size: partSize})
+		require.NoError(t, err)
+
+		ldr.AddFilePart(&FilePart{
+			Seq:       seq,
+			RemoteID:  resp.Id,
+			StorageID: storage.ID,
+			Client:    client,
+		})
+	}
+	ldr.SortFileParts()
+	require.NoError(t, m.holdFileParts(ctx, uuid.NewString(), ldr))
+
+	buff := make([]byte, 2*partSize)
+	_, err := rand.Read(buff)
+	require.NoError(t, err)
+
+	first := ldr.GetFileParts()[0].RemoteID
+
+	// the second part waits until the first one is older than the orphan age
+	reader, writer := io.Pipe()
+	uploaded := make(chan error, 1)
+	go func() {
+		uploaded <- ldr.Upload(ctx, reader)
+	}()
+	_, err = writer.Write(buff[:partSize])
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		for _, fp := range client.GetFileParts() {
+			if fp.ID == first {
+				return int64(fp.Data.Len()) == partSize
+			}
+		}
+		return false
+	}, time.Second, time.Millisecond)
+
+	c := &collector{
+		log:           zap.NewNop().Sugar(),
+		repo:          repo,
+		clientFactory: factory,
+		orphanAge:     time.Nanosecond,
+	}
+	require.NoError(t, c.collectOrphans(ctx))
+
+	_, err = writer.Write(buff[partSize:])
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	require.NoError(t, <-uploaded)
+
+	for _, fp := range client.GetFileParts() {
+		require.Equal(t, partSize, int64(fp.Data.Len()))
+	}
+}
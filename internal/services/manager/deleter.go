@@ -0,0 +1,112 @@
+package manager
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/blkmlk/file-storage/internal/services/repository"
+	"github.com/blkmlk/file-storage/protocol"
+)
+
+const (
+	DeletionRetryInterval = time.Second * 30
+	DeletionBatchSize     = 100
+)
+
+// Deleter retries deletions of file parts which storages failed to delete in time.
+type Deleter interface {
+	Run(ctx context.Context) error
+}
+
+func NewDeleter(
+	log *zap.SugaredLogger,
+	repo repository.Repository,
+	clientFactory ClientFactory,
+) Deleter {
+	return &deleter{
+		log:           log,
+		repo:          repo,
+		clientFactory: clientFactory,
+	}
+}
+
+type deleter struct {
+	log           *zap.SugaredLogger
+	repo          repository.Repository
+	clientFactory ClientFactory
+}
+
+func (d *deleter) Run(ctx context.Context) error {
+	ticker := time.NewTicker(DeletionRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		deletions, err := d.repo.FindPartDeletions(ctx, time.Now().Add(-DeletionRetryInterval), DeletionBatchSize)
+		if err != nil {
+			d.log.With("err", err).Error("failed to find part deletions")
+			continue
+		}
+
+		deleteParts(ctx, d.log, d.repo, d.clientFactory, deletions)
+	}
+}
+
+// deleteParts removes the parts from their storages. Deletions which succeeded are
+// forgotten, the failed ones are kept for the next attempt.
+func deleteParts(
+	ctx context.Context,
+	log *zap.SugaredLogger,
+	repo repository.Repository,
+	clientFactory ClientFactory,
+	deletions []*repository.PartDeletion,
+) {
+	var wg sync.WaitGroup
+	for _, d := range deletions {
+		wg.Add(1)
+		go func(d repository.PartDeletion) {
+			defer wg.Done()
+
+			if err := deletePart(ctx, repo, clientFactory, d); err != nil {
+				log.With("err", err).Warnf("failed to delete part %s from storage %s", d.RemoteID, d.StorageID)
+				if err = repo.UpdatePartDeletionAttempt(ctx, d.ID, err.Error()); err != nil {
+					log.With("err", err).Error("failed to update part deletion")
+				}
+				return
+			}
+
+			if err := repo.RemovePartDeletion(ctx, d.ID); err != nil {
+				log.With("err", err).Error("failed to remove part deletion")
+			}
+		}(*d)
+	}
+	wg.Wait()
+}
+
+func deletePart(ctx context.Context, repo repository.Repository, clientFactory ClientFactory, d repository.PartDeletion) error {
+	storage, err := repo.GetStorage(ctx, d.StorageID)
+	if err != nil {
+		return err
+	}
+
+	client, err := clientFactory.NewStorageClient(ctx, storage.Host)
+	if err != nil {
+		return err
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, MaxResponseTime)
+	defer cancel()
+
+	_, err = client.DeleteFilePart(reqCtx, &protocol.DeleteFilePartRequest{
+		Id: d.RemoteID,
+	})
+	return err
+}
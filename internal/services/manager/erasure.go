@@ -0,0 +1,303 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// Erasure-coded files are written in stripes. Every stripe takes ChunkSize bytes
+// of every data shard and produces ChunkSize bytes of every parity shard, so all
+// the shards of a file have the same size.
+
+func stripeCount(size int64, dataShards int) int64 {
+	stripeSize := int64(dataShards) * ChunkSize
+	count := (size + stripeSize - 1) / stripeSize
+	if count == 0 {
+		count = 1
+	}
+	return count
+}
+
+func shardSize(size int64, dataShards int) int64 {
+	return stripeCount(size, dataShards) * ChunkSize
+}
+
+func (l *loader) uploadShards(ctx context.Context, reader io.Reader) error {
+	totalShards := l.dataShards + l.parityShards
+	if len(l.fileParts) != totalShards {
+		return fmt.Errorf("expected %d shards, got %d", totalShards, len(l.fileParts))
+	}
+
+	enc, err := reedsolomon.New(l.dataShards, l.parityShards)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	failure := &uploadError{cancel: cancel}
+
+	if l.failover != nil {
+		for _, fp := range l.fileParts {
+			l.failover.use(fp.StorageID)
+		}
+	}
+
+	// every shard has a sender of its own, so all the shards are sent at the same time
+	senders := make([]*partSender, 0, totalShards)
+	for i := range l.fileParts {
+		size := shardSize(l.size, l.dataShards)
+		sender, err := newPartSender(ctx, l.log, []*FilePart{&l.fileParts[i]}, size, l.failover, failure.set)
+		if err != nil {
+			failure.set(err)
+			break
+		}
+		senders = append(senders, sender)
+	}
+
+	if failure.get() == nil {
+		if err = l.sendStripes(ctx, enc, reader, senders); err != nil {
+			failure.set(err)
+		}
+	}
+
+	for _, sender := range senders {
+		if err = sender.Close(); err != nil {
+			failure.set(err)
+		}
+	}
+
+	return failure.get()
+}
+
+func (l *loader) sendStripes(ctx context.Context, enc reedsolomon.Encoder, reader io.Reader, senders []*partSender) error {
+	totalShards := len(senders)
+	buff := make([]byte, totalShards*ChunkSize)
+	shards := make([][]byte, totalShards)
+	for i := range shards {
+		shards[i] = buff[i*ChunkSize : (i+1)*ChunkSize]
+	}
+
+	dataSize := int64(l.dataShards) * ChunkSize
+	remainingSize := l.size
+	stripes := stripeCount(l.size, l.dataShards)
+	for stripe := int64(0); stripe < stripes; stripe++ {
+		size := dataSize
+		if remainingSize < size {
+			size = remainingSize
+		}
+
+		if err := readFull(reader, buff[:size]); err != nil {
+			return err
+		}
+
+		// the last stripe is padded with zeros
+		for i := size; i < dataSize; i++ {
+			buff[i] = 0
+		}
+
+		if err := enc.Encode(shards); err != nil {
+			return err
+		}
+
+		for i, sender := range senders {
+			data := chunkPool.Get().([]byte)
+			copy(data, shards[i])
+			if err := sender.Send(ctx, data); err != nil {
+				return err
+			}
+		}
+
+		remainingSize -= size
+	}
+
+	return nil
+}
+
+// downloadShards reads length bytes starting from offset. Only the stripes which
+// overlap the range are requested from storages.
+func (l *loader) downloadShards(ctx context.Context, offset, length int64) (io.Reader, error) {
+	if length == 0 {
+		return io.MultiReader(), nil
+	}
+
+	enc, err := reedsolomon.New(l.dataShards, l.parityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	stripeSize := int64(l.dataShards) * ChunkSize
+	firstStripe := offset / stripeSize
+	endStripe := (offset + length + stripeSize - 1) / stripeSize
+
+	files, err := l.fetchShards(ctx, firstStripe*ChunkSize, endStripe*ChunkSize)
+	if err != nil {
+		return nil, err
+	}
+
+	r, w := io.Pipe()
+	stop := closeOnDone(ctx, r)
+	go func() {
+		defer stop()
+		defer removeShards(files)
+		_ = w.CloseWithError(l.decodeShards(enc, files, w, offset, length))
+	}()
+
+	return r, nil
+}
+
+// fetchShards fetches the range [from, to) of intact shards until there are enough
+// of them to rebuild the range. Shards which aren't fetched are nil.
+func (l *loader) fetchShards(ctx context.Context, from, to int64) ([]*os.File, error) {
+	totalShards := l.dataShards + l.parityShards
+	files := make([]*os.File, totalShards)
+
+	// data shards go first, so parity is fetched only when some of them are lost
+	var valid int
+	var corrupted error
+	for _, fp := range l.fileParts {
+		if valid == l.dataShards {
+			break
+		}
+		if fp.Seq < 0 || fp.Seq >= totalShards {
+			continue
+		}
+
+		f, err := l.fetchPart(ctx, fp, from, to)
+		if errors.Is(err, ErrCorrupted) {
+			corrupted = err
+			l.log.With("err", err).Errorf("shard %d on storage %s is corrupted", fp.Seq, fp.StorageID)
+			continue
+		}
+		if err != nil {
+			l.log.With("err", err).Warnf("failed to fetch shard %d from storage %s", fp.Seq, fp.StorageID)
+			continue
+		}
+		files[fp.Seq] = f
+		valid++
+	}
+
+	if valid < l.dataShards {
+		removeShards(files)
+		if corrupted != nil {
+			return nil, fmt.Errorf("not enough shards: %d of %d: %w", valid, l.dataShards, corrupted)
+		}
+		return nil, fmt.Errorf("not enough shards: %d of %d", valid, l.dataShards)
+	}
+
+	return files, nil
+}
+
+func removeShards(files []*os.File) {
+	for _, f := range files {
+		if f != nil {
+			removeTemp(f)
+		}
+	}
+}
+
+// decodeShards writes length bytes of the file starting from offset.
+// The shards begin with the stripe which holds the offset.
+func (l *loader) decodeShards(enc reedsolomon.Encoder, files []*os.File, writer io.Writer, offset, length int64) error {
+	buff := make([]byte, len(files)*ChunkSize)
+	shards := make([][]byte, len(files))
+
+	stripeSize := int64(l.dataShards) * ChunkSize
+	firstStripe := offset / stripeSize
+
+	end := offset + length
+	pos := firstStripe * stripeSize
+	for pos < end {
+		for i, f := range files {
+			shard := buff[i*ChunkSize : (i+1)*ChunkSize]
+			if f == nil {
+				// an empty shard is rebuilt in place
+				shards[i] = shard[:0]
+				continue
+			}
+			if _, err := io.ReadFull(f, shard); err != nil {
+				return err
+			}
+			shards[i] = shard
+		}
+
+		if err := enc.ReconstructData(shards); err != nil {
+			return err
+		}
+
+		for i := 0; i < l.dataShards && pos < end; i++ {
+			from, to := int64(0), int64(ChunkSize)
+			if pos < offset {
+				from = offset - pos
+			}
+			if pos+to > end {
+				to = end - pos
+			}
+			if from < to {
+				if _, err := writer.Write(shards[i][from:to]); err != nil {
+					return err
+				}
+			}
+			pos += ChunkSize
+		}
+	}
+
+	return nil
+}
+
+// rebuildShard restores the shard with the given seq from the other shards
+// into a temporary file.
+func (l *loader) rebuildShard(ctx context.Context, seq int, size int64) (*os.File, error) {
+	enc, err := reedsolomon.New(l.dataShards, l.parityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := l.fetchShards(ctx, 0, size)
+	if err != nil {
+		return nil, err
+	}
+	defer removeShards(files)
+
+	out, err := os.CreateTemp("", "shard-")
+	if err != nil {
+		return nil, err
+	}
+
+	buff := make([]byte, len(files)*ChunkSize)
+	shards := make([][]byte, len(files))
+	for pos := int64(0); pos < size && err == nil; pos += ChunkSize {
+		for i, f := range files {
+			shard := buff[i*ChunkSize : (i+1)*ChunkSize]
+			if f == nil {
+				shards[i] = shard[:0]
+				continue
+			}
+			if _, err = io.ReadFull(f, shard); err != nil {
+				break
+			}
+			shards[i] = shard
+		}
+
+		if err == nil {
+			err = enc.Reconstruct(shards)
+		}
+		if err == nil {
+			_, err = out.Write(shards[seq])
+		}
+	}
+	if err == nil {
+		_, err = out.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		removeTemp(out)
+		return nil, err
+	}
+
+	return out, nil
+}
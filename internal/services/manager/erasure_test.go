@@ -0,0 +1,178 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/blkmlk/file-storage/internal/mocks"
+	"github.com/blkmlk/file-storage/protocol"
+)
+
+func TestLoader_UploadShards(t *testing.T) {
+	ctx := context.Background()
+
+	dataShards, parityShards := 3, 2
+	fullSize := int64(3*ChunkSize*4 + 1000)
+	ldr := NewErasureLoader(zap.NewNop().Sugar(), fullSize, dataShards, parityShards)
+
+	for seq := 0; seq < dataShards+parityShards; seq++ {
+		client := mocks.NewStorage(ctx)
+		resp, err := client.CheckReadiness(ctx, &protocol.CheckReadinessRequest{
+			Size: shardSize(fullSize, dataShards),
+		})
+		require.NoError(t, err)
+
+		ldr.AddFilePart(&FilePart{
+			Seq:       seq,
+			RemoteID:  resp.Id,
+			StorageID: uuid.NewString(),
+			Client:    client,
+		})
+	}
+	ldr.SortFileParts()
+
+	buff := make([]byte, fullSize)
+	_, err := rand.Read(buff)
+	require.NoError(t, err)
+
+	err = ldr.Upload(ctx, bytes.NewReader(buff))
+	require.NoError(t, err)
+
+	fileParts := ldr.GetFileParts()
+	for _, fp := range fileParts {
+		require.Equal(t, shardSize(fullSize, dataShards), fp.Size)
+		require.NotEmpty(t, fp.Hash)
+	}
+
+	tests := []struct {
+		name    string
+		lost    []int
+		corrupt []int
+		err     error
+	}{
+		{name: "all shards"},
+		{name: "lost parity", lost: []int{3, 4}},
+		{name: "lost and corrupted data", lost: []int{0}, corrupt: []int{2}},
+		{name: "too many lost", lost: []int{0, 1}, corrupt: []int{4}, err: ErrCorrupted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			downloader := NewErasureLoader(zap.NewNop().Sugar(), fullSize, dataShards, parityShards)
+			for _, fp := range fileParts {
+				if contains(tt.lost, fp.Seq) {
+					continue
+				}
+				if contains(tt.corrupt, fp.Seq) {
+					fp.Hash = "corrupted"
+				}
+				downloader.AddFilePart(&fp)
+			}
+			downloader.SortFileParts()
+
+			reader, err := downloader.Download(ctx)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+
+			recovered, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			require.Equal(t, buff, recovered)
+
+			offset := int64(3*ChunkSize + 100)
+			reader, err = downloader.DownloadRange(ctx, offset, 2*ChunkSize)
+			require.NoError(t, err)
+
+			recovered, err = io.ReadAll(reader)
+			require.NoError(t, err)
+			require.Equal(t, buff[offset:offset+2*ChunkSize], recovered)
+		})
+	}
+}
+
+func contains(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLoader_RebuildShard(t *testing.T) {
+	ctx := context.Background()
+
+	dataShards, parityShards := 3, 2
+	fullSize := int64(3*ChunkSize*4 + 1000)
+	ldr := NewErasureLoader(zap.NewNop().Sugar(), fullSize, dataShards, parityShards)
+
+	for seq := 0; seq < dataShards+parityShards; seq++ {
+		client := mocks.NewStorage(ctx)
+		resp, err := client.CheckReadiness(ctx, &protocol.CheckReadinessRequest{})
+		require.NoError(t, err)
+
+		ldr.AddFilePart(&FilePart{
+			Seq:       seq,
+			RemoteID:  resp.Id,
+			StorageID: uuid.NewString(),
+			Client:    client,
+		})
+	}
+	ldr.SortFileParts()
+
+	buff := make([]byte, fullSize)
+	_, err := rand.Read(buff)
+	require.NoError(t, err)
+	require.NoError(t, ldr.Upload(ctx, bytes.NewReader(buff)))
+
+	fileParts := ldr.GetFileParts()
+	for _, lost := range []int{1, 4} {
+		t.Run(fmt.Sprintf("shard %d", lost), func(t *testing.T) {
+			repairer := NewErasureLoader(zap.NewNop().Sugar(), fullSize, dataShards, parityShards)
+			for _, fp := range fileParts {
+				if fp.Seq != lost {
+					repairer.AddFilePart(&fp)
+				}
+			}
+			repairer.SortFileParts()
+
+			client := mocks.NewStorage(ctx)
+			resp, err := client.CheckReadiness(ctx, &protocol.CheckReadinessRequest{})
+			require.NoError(t, err)
+
+			target := &FilePart{Seq: lost, RemoteID: resp.Id, StorageID: uuid.NewString(), Client: client}
+			require.NoError(t, repairer.RebuildPart(ctx, fileParts[lost], target))
+			require.Equal(t, fileParts[lost].Hash, target.Hash)
+			require.Equal(t, fileParts[lost].Size, target.Size)
+
+			// the file is read with the rebuilt shard in place of the lost one
+			downloader := NewErasureLoader(zap.NewNop().Sugar(), fullSize, dataShards, parityShards)
+			for _, fp := range fileParts {
+				if fp.Seq == lost {
+					fp = *target
+				}
+				if fp.Seq != (lost+1)%(dataShards+parityShards) {
+					downloader.AddFilePart(&fp)
+				}
+			}
+			downloader.SortFileParts()
+
+			reader, err := downloader.Download(ctx)
+			require.NoError(t, err)
+
+			recovered, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			require.Equal(t, buff, recovered)
+		})
+	}
+}
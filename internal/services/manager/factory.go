@@ -2,6 +2,7 @@ package manager
 
 import (
 	"context"
+	"sync"
 
 	"github.com/blkmlk/file-storage/internal/mocks"
 
@@ -15,20 +16,35 @@ type ClientFactory interface {
 }
 
 func NewGRPCClientFactory() ClientFactory {
-	return grpcClientFactory{}
+	return &grpcClientFactory{
+		conns: make(map[string]*grpc.ClientConn),
+	}
 }
 
 func NewMockedClientFactory() ClientFactory {
 	return mockedClientFactory{}
 }
 
+// grpcClientFactory keeps a connection per host, so background jobs
+// which talk to storages all the time don't open new ones.
 type grpcClientFactory struct {
+	locker sync.Mutex
+	conns  map[string]*grpc.ClientConn
 }
 
-func (g grpcClientFactory) NewStorageClient(ctx context.Context, host string) (protocol.StorageClient, error) {
-	conn, err := grpc.DialContext(ctx, host, grpc.WithInsecure())
-	if err != nil {
-		return nil, err
+func (g *grpcClientFactory) NewStorageClient(ctx context.Context, host string) (protocol.StorageClient, error) {
+	g.locker.Lock()
+	defer g.locker.Unlock()
+
+	conn, ok := g.conns[host]
+	if !ok {
+		var err error
+		// the connection outlives the request, so it isn't bound to its context
+		conn, err = grpc.DialContext(context.Background(), host, grpc.WithInsecure())
+		if err != nil {
+			return nil, err
+		}
+		g.conns[host] = conn
 	}
 
 	return protocol.NewStorageClient(conn), nil
@@ -0,0 +1,334 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/blkmlk/file-storage/internal/services/repository"
+	"github.com/blkmlk/file-storage/protocol"
+)
+
+const (
+	DefaultUploadRetries      = 3
+	DefaultUploadRetryBackoff = time.Millisecond * 200
+)
+
+var ErrNoStorages = errors.New("no storages left")
+
+// ReplaceFunc reserves a part of the given size on a ready storage which isn't
+// among the excluded ones. The size is negative when it isn't known yet.
+type ReplaceFunc func(ctx context.Context, seq int, size int64, exclude []string) (*FilePart, error)
+
+// failover moves replicas from failed storages to other ones. The retry budget
+// is shared by all the parts of an upload.
+type failover struct {
+	replace  ReplaceFunc
+	backoff  time.Duration
+	distinct bool
+
+	locker    sync.Mutex
+	retries   int
+	failed    map[string]bool
+	used      map[string]bool
+	abandoned []FilePart
+}
+
+func newFailover(replace ReplaceFunc, retries int, backoff time.Duration) *failover {
+	return &failover{
+		replace: replace,
+		retries: retries,
+		backoff: backoff,
+		failed:  make(map[string]bool),
+		used:    make(map[string]bool),
+	}
+}
+
+// abandon remembers the replica, so it's deleted, and its storage, so it's not used again.
+func (f *failover) abandon(fp FilePart) {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	f.failed[fp.StorageID] = true
+	f.abandoned = append(f.abandoned, fp)
+}
+
+func (f *failover) take() bool {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	if f.retries <= 0 {
+		return false
+	}
+	f.retries--
+	return true
+}
+
+// exclude returns the storages which must not get a replacement. Shards of an
+// erasure-coded file are kept on distinct storages, so all the used ones are excluded.
+func (f *failover) exclude(own []string) []string {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	result := append([]string(nil), own...)
+	for id := range f.failed {
+		result = append(result, id)
+	}
+	if f.distinct {
+		for id := range f.used {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+func (f *failover) use(storageID string) {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	f.used[storageID] = true
+}
+
+func (f *failover) getAbandoned() []FilePart {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+	return append([]FilePart(nil), f.abandoned...)
+}
+
+// spool keeps the data sent to a part, so it can be sent again to a replacement.
+type spool struct {
+	file *os.File
+	size int64
+}
+
+func newSpool() (*spool, error) {
+	file, err := os.CreateTemp("", "part")
+	if err != nil {
+		return nil, err
+	}
+	return &spool{file: file}, nil
+}
+
+func (s *spool) Write(data []byte) error {
+	n, err := s.file.Write(data)
+	s.size += int64(n)
+	return err
+}
+
+// Reader reads the data written so far.
+func (s *spool) Reader() io.Reader {
+	return io.NewSectionReader(s.file, 0, s.size)
+}
+
+func (s *spool) Replay(stream protocol.Storage_UploadFileClient, remoteID string) error {
+	buff := make([]byte, ChunkSize)
+	reader := s.Reader()
+	for {
+		n, err := io.ReadFull(reader, buff)
+		if n > 0 {
+			if err := stream.Send(&protocol.UploadFileRequest{Id: remoteID, Data: buff[:n]}); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *spool) Close() {
+	_ = s.file.Close()
+	_ = os.Remove(s.file.Name())
+}
+
+// recover replaces the i-th replica after a failure and sends it everything sent
+// to the failed one. It gives up when the retry budget or storages run out.
+func (s *partSender) recover(i int, cause error) error {
+	// a cancelled upload isn't a failure of the storage, and neither is a request
+	// it rejected, another storage would reject it the same way
+	if s.failover == nil || s.ctx.Err() != nil || rejected(cause) {
+		return cause
+	}
+
+	for attempt := 0; ; attempt++ {
+		failed := *s.replicas[i]
+		s.failover.abandon(failed)
+
+		if !s.failover.take() {
+			return fmt.Errorf("retries are exhausted: %w", cause)
+		}
+
+		select {
+		case <-time.After(s.failover.backoff << attempt):
+		case <-s.ctx.Done():
+			return cause
+		}
+
+		own := make([]string, 0, len(s.replicas))
+		for _, r := range s.replicas {
+			own = append(own, r.StorageID)
+		}
+
+		part, err := s.failover.replace(s.ctx, failed.Seq, s.size, s.failover.exclude(own))
+		if err != nil {
+			return fmt.Errorf("%v: %w", cause, err)
+		}
+		s.failover.use(part.StorageID)
+
+		s.log.With("err", cause).Warnf("part %d is moved from storage %s to %s", failed.Seq, failed.StorageID, part.StorageID)
+
+		s.replicas[i].RemoteID = part.RemoteID
+		s.replicas[i].StorageID = part.StorageID
+		s.replicas[i].Client = part.Client
+
+		stream, err := part.Client.UploadFile(s.ctx)
+		if err == nil {
+			err = s.spool.Replay(stream, part.RemoteID)
+		}
+		if err == nil {
+			s.streams[i] = stream
+			return nil
+		}
+		cause = err
+	}
+}
+
+// rejected tells whether the storage refused the request itself rather than failed to serve it.
+func rejected(err error) bool {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.NotFound, codes.AlreadyExists, codes.FailedPrecondition,
+		codes.OutOfRange, codes.PermissionDenied, codes.Unauthenticated:
+		return true
+	default:
+		return false
+	}
+}
+
+// replaceFilePart reserves a part on a ready storage which isn't excluded.
+func (m *manager) replaceFilePart(ctx context.Context, seq int, size int64, exclude []string) (*FilePart, error) {
+	if size < 0 {
+		size = m.streamPartSize
+	}
+	return reservePart(ctx, m.repo, m.clientFactory, m.placement, seq, size, exclude)
+}
+
+// reservePart reserves a part on the first ready storage in the order of the placement
+// policy. The excluded storages keep other copies of the part, so the policy may keep
+// the new one away from them.
+func reservePart(
+	ctx context.Context,
+	repo repository.Repository,
+	clientFactory ClientFactory,
+	placement PlacementPolicy,
+	seq int,
+	size int64,
+	exclude []string,
+) (*FilePart, error) {
+	storages, err := repo.FindStorages(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	excluded := make(map[string]bool, len(exclude))
+	for _, id := range exclude {
+		excluded[id] = true
+	}
+
+	var candidates, avoid []*repository.Storage
+	for _, s := range storages {
+		if excluded[s.ID] {
+			avoid = append(avoid, s)
+		} else {
+			candidates = append(candidates, s)
+		}
+	}
+
+	for _, s := range placement.Order(candidates, avoid) {
+
+		client, err := clientFactory.NewStorageClient(ctx, s.Host)
+		if err != nil {
+			continue
+		}
+
+		reqCtx, cancel := context.WithTimeout(ctx, MaxResponseTime)
+		resp, err := client.CheckReadiness(reqCtx, &protocol.CheckReadinessRequest{
+			Size: size,
+		})
+		cancel()
+		if err != nil || !resp.Ready {
+			continue
+		}
+
+		return &FilePart{
+			Seq:       seq,
+			RemoteID:  resp.Id,
+			StorageID: s.ID,
+			Client:    client,
+		}, nil
+	}
+
+	return nil, ErrNoStorages
+}
+
+// cleanupUpload deletes the replicas left on failed storages and,
+// when the upload failed, all the replicas written so far.
+func (m *manager) cleanupUpload(ldr *loader, err error) {
+	discarded := ldr.AbandonedFileParts()
+	if err != nil {
+		// a replica which failed without a replacement is abandoned already
+		abandoned := make(map[string]bool, len(discarded))
+		for _, fp := range discarded {
+			abandoned[fp.RemoteID] = true
+		}
+		for _, fp := range ldr.GetFileParts() {
+			if !abandoned[fp.RemoteID] {
+				discarded = append(discarded, fp)
+			}
+		}
+	}
+	m.discardFileParts(discarded)
+}
+
+func (m *manager) discardFileParts(fileParts []FilePart) {
+	discardFileParts(m.log, m.repo, m.clientFactory, fileParts)
+}
+
+// discardFileParts deletes replicas which aren't saved as file parts. Deletions are
+// recorded first, so the deleter retries them when a storage is unavailable.
+func discardFileParts(
+	log *zap.SugaredLogger,
+	repo repository.Repository,
+	clientFactory ClientFactory,
+	fileParts []FilePart,
+) {
+	if len(fileParts) == 0 {
+		return
+	}
+
+	// the request may be cancelled already
+	ctx := context.Background()
+
+	deletions := make([]repository.PartDeletion, 0, len(fileParts))
+	for _, fp := range fileParts {
+		deletions = append(deletions, repository.NewPartDeletion(fp.StorageID, fp.RemoteID))
+	}
+
+	if err := repo.CreatePartDeletions(ctx, deletions); err != nil {
+		log.With("err", err).Error("failed to create part deletions")
+		return
+	}
+
+	pending := make([]*repository.PartDeletion, 0, len(deletions))
+	for i := range deletions {
+		pending = append(pending, &deletions[i])
+	}
+	deleteParts(ctx, log, repo, clientFactory, pending)
+}
@@ -0,0 +1,156 @@
+package manager
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+)
+
+var ErrCorrupted = errors.New("file part is corrupted")
+
+// CorruptedPartError is returned when a replica doesn't match the size or hash
+// saved at upload. It matches ErrCorrupted.
+type CorruptedPartError struct {
+	Seq          int
+	StorageID    string
+	RemoteID     string
+	ExpectedSize int64
+	ActualSize   int64
+	ExpectedHash string
+	ActualHash   string
+}
+
+func (e *CorruptedPartError) Error() string {
+	if e.ExpectedSize != e.ActualSize {
+		return fmt.Sprintf("part %d on storage %s is corrupted: size %d != %d", e.Seq, e.StorageID, e.ActualSize, e.ExpectedSize)
+	}
+	return fmt.Sprintf("part %d on storage %s is corrupted: hash %s != %s", e.Seq, e.StorageID, e.ActualHash, e.ExpectedHash)
+}
+
+func (e *CorruptedPartError) Is(target error) bool {
+	return target == ErrCorrupted
+}
+
+// fetchReplica fetches the range [from, to) of a part from any replica which is
+// available and intact, beginning with a random one to spread reads across storages.
+// When all of them fail, a corruption is reported in preference to other errors.
+func (l *loader) fetchReplica(ctx context.Context, replicas []*FilePart, from, to int64) (*os.File, error) {
+	var err, corrupted error
+	start := rand.Intn(len(replicas))
+	for i := 0; i < len(replicas) && ctx.Err() == nil; i++ {
+		fp := replicas[(start+i)%len(replicas)]
+
+		var f *os.File
+		f, err = l.fetchPart(ctx, *fp, from, to)
+		if err == nil {
+			return f, nil
+		}
+
+		if errors.Is(err, ErrCorrupted) {
+			corrupted = err
+			l.log.With("err", err).Errorf("file part %d on storage %s is corrupted", fp.Seq, fp.StorageID)
+			continue
+		}
+		l.log.With("err", err).Warnf("failed to get file part %d from storage %s", fp.Seq, fp.StorageID)
+	}
+
+	if corrupted != nil {
+		return nil, corrupted
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return nil, err
+}
+
+// fetchPart copies the range [from, to) of the part into a temporary file. Only the
+// range is requested from the storage, so the stored hash is checked when the whole
+// part is read and a range is checked against the part size only.
+func (l *loader) fetchPart(ctx context.Context, part FilePart, from, to int64) (*os.File, error) {
+	whole := from == 0 && to == part.Size
+
+	// the whole part is read to its end, so a part longer than saved is noticed too
+	length := to - from
+	if whole {
+		length = 0
+	}
+
+	reader, err := l.getByChunks(ctx, part, from, length, ChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	f, err := os.CreateTemp("", "part-")
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	var writer io.Writer = f
+	if whole {
+		writer = io.MultiWriter(f, h)
+	}
+
+	n, err := io.Copy(writer, reader)
+	switch {
+	case err != nil:
+	case whole:
+		err = checkPart(part, n, hex.EncodeToString(h.Sum(nil)))
+	case n != length:
+		// the part ends before the range does
+		err = checkPart(part, from+n, part.Hash)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		removeTemp(f)
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// checkPart compares the received part with the one saved at upload.
+// Parts saved without a hash are checked by size only.
+func checkPart(part FilePart, size int64, hash string) error {
+	if size == part.Size && (part.Hash == "" || hash == part.Hash) {
+		return nil
+	}
+	return &CorruptedPartError{
+		Seq:          part.Seq,
+		StorageID:    part.StorageID,
+		RemoteID:     part.RemoteID,
+		ExpectedSize: part.Size,
+		ActualSize:   size,
+		ExpectedHash: part.Hash,
+		ActualHash:   hash,
+	}
+}
+
+// closeOnDone closes the reader when the context is done, so the writer isn't blocked
+// by a reader which is gone. The returned function stops watching.
+func closeOnDone(ctx context.Context, r *io.PipeReader) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = r.CloseWithError(ctx.Err())
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+func removeTemp(f *os.File) {
+	_ = f.Close()
+	_ = os.Remove(f.Name())
+}
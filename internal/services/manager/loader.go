@@ -5,8 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"sort"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 
@@ -27,62 +29,313 @@ type FilePart struct {
 }
 
 type loader struct {
-	log       *zap.SugaredLogger
-	size      int64
-	locker    sync.Mutex
-	fileParts []FilePart
+	log          *zap.SugaredLogger
+	size         int64
+	dataShards   int
+	parityShards int
+	parallelism  int
+	failover     *failover
+	locker       sync.Mutex
+	fileParts    []FilePart
 }
 
 func NewLoader(log *zap.SugaredLogger, size int64) *loader {
-	return &loader{log: log, size: size}
+	return &loader{log: log, size: size, parallelism: DefaultUploadParallelism}
+}
+
+// NewErasureLoader creates a loader which stores every file part as a Reed-Solomon shard.
+// Parts with seq below dataShards hold data, the rest hold parity.
+func NewErasureLoader(log *zap.SugaredLogger, size int64, dataShards, parityShards int) *loader {
+	return &loader{
+		log:          log,
+		size:         size,
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		parallelism:  DefaultUploadParallelism,
+	}
+}
+
+// SetFailover makes the loader move a replica which fails during upload to another
+// storage given by replace. At most retries replicas of the file are moved.
+func (l *loader) SetFailover(replace ReplaceFunc, retries int, backoff time.Duration) {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+	l.failover = newFailover(replace, retries, backoff)
+	l.failover.distinct = l.isErasure()
+}
+
+// AbandonedFileParts returns the replicas left on failed storages during upload.
+func (l *loader) AbandonedFileParts() []FilePart {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+	if l.failover == nil {
+		return nil
+	}
+	return l.failover.getAbandoned()
+}
+
+// SetParallelism sets how many parts are sent at the same time.
+// Shards of an erasure-coded file are always sent together.
+func (l *loader) SetParallelism(parallelism int) {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+	if parallelism > 0 {
+		l.parallelism = parallelism
+	}
 }
 
 func (l *loader) Upload(ctx context.Context, reader io.Reader) error {
 	l.locker.Lock()
 	defer l.locker.Unlock()
 
-	fileParts := l.fileParts
+	if l.isErasure() {
+		if err := l.uploadShards(ctx, reader); err != nil {
+			return err
+		}
+		return ensureEOF(reader)
+	}
+
+	if err := l.uploadParts(ctx, reader); err != nil {
+		return err
+	}
+	return ensureEOF(reader)
+}
+
+// uploadParts reads the input once and sends up to parallelism parts at the same time.
+// With parallelism above one every part but the last is read ahead into a temporary
+// file and sent from it in background, so the input goes on to the next part at once.
+// The temporary files take at most parallelism parts of disk space.
+func (l *loader) uploadParts(ctx context.Context, reader io.Reader) error {
+	groups := l.groupBySeq()
+	if len(groups) > 1 && l.size < int64(len(groups)) {
+		return fmt.Errorf("%d bytes can't be split into %d parts", l.size, len(groups))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	failure := &uploadError{cancel: cancel}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, l.parallelism)
 
 	remainingSize := l.size
-	partSize := l.size / int64(len(fileParts))
+	partSize := l.size / int64(len(groups))
 
-	for i := 0; i < len(fileParts); i++ {
-		last := i == len(fileParts)-1
+	for i := 0; i < len(groups) && failure.get() == nil; i++ {
+		last := i == len(groups)-1
 
 		size := partSize
 		if last {
 			size = remainingSize
 		}
 
-		err := l.sendByChunks(ctx, &fileParts[i], reader, size, ChunkSize)
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			failure.set(ctx.Err())
+			continue
+		}
+
+		// a slot may be freed by the part which failed
+		if err := ctx.Err(); err != nil {
+			<-slots
+			failure.set(err)
+			continue
+		}
+
+		var ahead *spool
+		if l.parallelism > 1 && !last {
+			var err error
+			if ahead, err = readAhead(reader, size); err != nil {
+				<-slots
+				failure.set(err)
+				continue
+			}
+		}
+
+		sender, err := newPartSender(ctx, l.log, groups[i], size, l.failover, failure.set)
 		if err != nil {
-			return err
+			if ahead != nil {
+				ahead.Close()
+			}
+			<-slots
+			failure.set(err)
+			continue
+		}
+
+		if ahead == nil {
+			if err = sender.Pump(ctx, reader, size); err != nil {
+				failure.set(err)
+			}
 		}
 
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ahead != nil {
+				if err := sender.Pump(ctx, ahead.Reader(), size); err != nil {
+					failure.set(err)
+				}
+				ahead.Close()
+			}
+			if err := sender.Close(); err != nil {
+				failure.set(err)
+			}
+			<-slots
+		}()
+
 		remainingSize -= size
 	}
+	wg.Wait()
 
-	return nil
+	return failure.get()
+}
+
+// UploadStream sends the reader until EOF to the replicas of a single part
+// and returns the number of bytes sent.
+func (l *loader) UploadStream(ctx context.Context, reader io.Reader) (int64, error) {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+
+	groups := l.groupBySeq()
+	if len(groups) != 1 {
+		return 0, fmt.Errorf("stream must be uploaded as a single part")
+	}
+
+	if err := l.sendPart(ctx, groups[0], reader, UnknownSize); err != nil {
+		return 0, err
+	}
+
+	l.size = groups[0][0].Size
+	return l.size, nil
 }
 
 func (l *loader) Download(ctx context.Context) (io.Reader, error) {
+	return l.DownloadRange(ctx, 0, l.size)
+}
+
+// DownloadRange reads length bytes starting from offset. Only the parts which
+// overlap the range are requested from storages, and only their bytes in the range.
+// A part read whole is checked against its hash, a corrupted replica is replaced
+// with another one.
+// The first part is fetched before returning, so a file which can't be read
+// fails early.
+func (l *loader) DownloadRange(ctx context.Context, offset, length int64) (io.Reader, error) {
 	l.locker.Lock()
 	defer l.locker.Unlock()
 
-	fileParts := l.fileParts
+	if offset < 0 || length < 0 || offset+length > l.size {
+		return nil, fmt.Errorf("range %d-%d is out of file size %d", offset, offset+length, l.size)
+	}
+
+	if l.isErasure() {
+		return l.downloadShards(ctx, offset, length)
+	}
+
+	groups := l.groupBySeq()
+
+	end := offset + length
+	windows := make([]partWindow, 0, len(groups))
+	var partStart int64
+	for _, replicas := range groups {
+		partEnd := partStart + replicas[0].Size
+		if partEnd > offset && partStart < end {
+			from, to := int64(0), replicas[0].Size
+			if offset > partStart {
+				from = offset - partStart
+			}
+			if end < partEnd {
+				to = end - partStart
+			}
+
+			windows = append(windows, partWindow{replicas: replicas, from: from, to: to})
+		}
+		partStart = partEnd
+	}
+
+	if len(windows) == 0 {
+		return io.MultiReader(), nil
+	}
+
+	first, err := l.fetchReplica(ctx, windows[0].replicas, windows[0].from, windows[0].to)
+	if err != nil {
+		return nil, err
+	}
+
+	r, w := io.Pipe()
+	stop := closeOnDone(ctx, r)
+	go func() {
+		defer stop()
+		_ = w.CloseWithError(l.copyWindows(ctx, first, windows, w))
+	}()
+
+	return r, nil
+}
+
+// partWindow is the range [from, to) of a part which is read.
+type partWindow struct {
+	replicas []*FilePart
+	from, to int64
+}
+
+// copyWindows writes the windows of the parts, the first one is fetched already.
+func (l *loader) copyWindows(ctx context.Context, first *os.File, windows []partWindow, writer io.Writer) error {
+	f := first
+	for i, win := range windows {
+		if i > 0 {
+			var err error
+			if f, err = l.fetchReplica(ctx, win.replicas, win.from, win.to); err != nil {
+				return err
+			}
+		}
 
-	readers := make([]io.Reader, 0, len(fileParts))
-	for _, fp := range fileParts {
-		r, err := l.getByChunks(ctx, fp, ChunkSize)
+		_, err := io.Copy(writer, f)
+		removeTemp(f)
 		if err != nil {
-			return nil, err
+			return err
+		}
+	}
+	return nil
+}
+
+// RebuildPart restores the lost part from the parts held by the loader and writes it
+// to the target. A replica is copied from another one, a shard is rebuilt from the
+// other shards. The target gets the hash of the part it received.
+func (l *loader) RebuildPart(ctx context.Context, lost FilePart, target *FilePart) error {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+
+	var (
+		f   *os.File
+		err error
+	)
+	if l.isErasure() {
+		f, err = l.rebuildShard(ctx, lost.Seq, lost.Size)
+	} else {
+		var replicas []*FilePart
+		for _, group := range l.groupBySeq() {
+			if group[0].Seq == lost.Seq {
+				replicas = group
+			}
 		}
+		if len(replicas) == 0 {
+			return fmt.Errorf("no replicas of part %d are left", lost.Seq)
+		}
+		f, err = l.fetchReplica(ctx, replicas, 0, replicas[0].Size)
+	}
+	if err != nil {
+		return err
+	}
+	defer removeTemp(f)
 
-		readers = append(readers, r)
+	if err = l.sendPart(ctx, []*FilePart{target}, f, lost.Size); err != nil {
+		return err
 	}
-	reader := io.MultiReader(readers...)
 
-	return reader, nil
+	if lost.Hash != "" && target.Hash != lost.Hash {
+		return fmt.Errorf("rebuilt part %d doesn't match its hash", lost.Seq)
+	}
+	return nil
 }
 
 func (l *loader) AddFilePart(fp *FilePart) {
@@ -103,7 +356,7 @@ func (l *loader) GetFileParts() []FilePart {
 func (l *loader) SortFileParts() {
 	l.locker.Lock()
 	defer l.locker.Unlock()
-	sort.Slice(l.fileParts, func(i, j int) bool {
+	sort.SliceStable(l.fileParts, func(i, j int) bool {
 		return l.fileParts[i].Seq < l.fileParts[j].Seq
 	})
 }
@@ -114,61 +367,79 @@ func (l *loader) LenFileParts() int {
 	return len(l.fileParts)
 }
 
-func (l *loader) sendByChunks(ctx context.Context, part *FilePart, reader io.Reader, fullSize, chunkSize int64) error {
-	inCtx, cancel := context.WithCancel(ctx)
+func (l *loader) isErasure() bool {
+	return l.dataShards > 0
+}
+
+// groupBySeq returns the replicas of every part ordered by seq.
+// The caller must hold the locker and the parts must be sorted.
+func (l *loader) groupBySeq() [][]*FilePart {
+	var groups [][]*FilePart
+	for i := range l.fileParts {
+		fp := &l.fileParts[i]
+		if len(groups) == 0 || groups[len(groups)-1][0].Seq != fp.Seq {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], fp)
+	}
+	return groups
+}
+
+// sendPart sends size bytes of the reader to the replicas of a part,
+// a negative size means the part ends with the reader.
+func (l *loader) sendPart(ctx context.Context, replicas []*FilePart, reader io.Reader, size int64) error {
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	failure := &uploadError{cancel: cancel}
 
-	stream, err := part.Client.UploadFile(inCtx)
+	sender, err := newPartSender(ctx, l.log, replicas, size, l.failover, failure.set)
 	if err != nil {
 		return err
 	}
 
-	remainingSize := fullSize
-	buff := make([]byte, chunkSize)
-	for remainingSize > 0 {
-		chunk := chunkSize
-		if remainingSize < chunk {
-			chunk = remainingSize
-		}
-
-		data := buff[:chunk]
-		n, err := reader.Read(data)
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				break
-			}
-			return err
-		}
+	if err = sender.Pump(ctx, reader, size); err != nil {
+		failure.set(err)
+	}
+	if err = sender.Close(); err != nil {
+		failure.set(err)
+	}
 
-		if int64(n) < chunk {
-			return fmt.Errorf("read less than expected")
-		}
+	return failure.get()
+}
 
-		err = stream.Send(&protocol.UploadFileRequest{
-			Id:   part.RemoteID,
-			Data: data,
-		})
-		if err != nil {
-			return err
+// readFull fills the buffer, a stream which ends earlier is shorter than its declared size.
+func readFull(reader io.Reader, buff []byte) error {
+	if _, err := io.ReadFull(reader, buff); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrSizeMismatch
 		}
-
-		remainingSize -= chunk
+		return err
 	}
+	return nil
+}
 
-	resp, err := stream.CloseAndRecv()
-	if err != nil {
+// ensureEOF checks that the stream has no data beyond its declared size.
+func ensureEOF(reader io.Reader) error {
+	var buff [1]byte
+	_, err := io.ReadFull(reader, buff[:])
+	if err == nil {
+		return ErrSizeMismatch
+	}
+	if !errors.Is(err, io.EOF) {
 		return err
 	}
-	part.Hash = resp.Hash
-	part.Size = fullSize
-
 	return nil
 }
 
-func (l *loader) getByChunks(ctx context.Context, part FilePart, chunkSize int64) (io.Reader, error) {
+func (l *loader) getByChunks(ctx context.Context, part FilePart, offset, length, chunkSize int64) (io.ReadCloser, error) {
 	r, w := io.Pipe()
 
-	resp, err := part.Client.GetFile(ctx, &protocol.GetFileRequest{Id: part.RemoteID, ChunkSize: chunkSize})
+	resp, err := part.Client.GetFile(ctx, &protocol.GetFileRequest{
+		Id:        part.RemoteID,
+		ChunkSize: chunkSize,
+		Offset:    offset,
+		Length:    length,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -177,19 +448,19 @@ func (l *loader) getByChunks(ctx context.Context, part FilePart, chunkSize int64
 	}()
 
 	go func() {
-		defer w.Close()
 		for {
 			partData, err := resp.Recv()
 			if err != nil {
 				if errors.Is(err, io.EOF) {
-					break
+					err = nil
 				}
-				l.log.Errorf("failed to receive msg from storage: %v", err)
-				break
+				// a broken stream must not look like a short part
+				_ = w.CloseWithError(err)
+				return
 			}
 
-			if _, err = w.Write(partData.Data); err != nil && !errors.Is(err, io.EOF) {
-				l.log.Errorf("failed to write data to pipe: %v", err)
+			if _, err = w.Write(partData.Data); err != nil {
+				return
 			}
 		}
 	}()
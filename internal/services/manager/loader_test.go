@@ -4,10 +4,19 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"errors"
 	"io"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/blkmlk/file-storage/protocol"
+	"go.uber.org/zap"
 
 	"github.com/stretchr/testify/require"
 
@@ -20,7 +29,7 @@ func TestLoader_Upload(t *testing.T) {
 	ctx := context.Background()
 
 	fullSize := int64(1792)
-	ldr := NewLoader(fullSize)
+	ldr := NewLoader(zap.NewNop().Sugar(), fullSize)
 
 	fileParts := []*FilePart{
 		{
@@ -83,4 +92,663 @@ func TestLoader_Upload(t *testing.T) {
 	recovered, err := io.ReadAll(reader)
 	require.NoError(t, err)
 	require.Equal(t, buff, recovered)
+
+	ranges := [][2]int64{{0, 1}, {100, 400}, {590, 20}, {1000, 792}, {0, fullSize}, {1791, 1}}
+	for _, r := range ranges {
+		reader, err = ldr.DownloadRange(ctx, r[0], r[1])
+		require.NoError(t, err)
+
+		recovered, err = io.ReadAll(reader)
+		require.NoError(t, err)
+		require.Equal(t, buff[r[0]:r[0]+r[1]], recovered)
+	}
+
+	_, err = ldr.DownloadRange(ctx, 1000, fullSize)
+	require.Error(t, err)
+}
+
+func TestLoader_UploadReplicas(t *testing.T) {
+	ctx := context.Background()
+
+	fullSize := int64(1792)
+	ldr := NewLoader(zap.NewNop().Sugar(), fullSize)
+
+	storages := []*mocks.Storage{
+		mocks.NewStorage(ctx),
+		mocks.NewStorage(ctx),
+		mocks.NewStorage(ctx),
+	}
+	replicas := 2
+	for i, s := range storages {
+		for r := 0; r < replicas; r++ {
+			resp, err := s.CheckReadiness(ctx, &protocol.CheckReadinessRequest{})
+			require.NoError(t, err)
+
+			ldr.AddFilePart(&FilePart{
+				Seq:       (i + r) % len(storages),
+				RemoteID:  resp.Id,
+				StorageID: uuid.NewString(),
+				Client:    s,
+			})
+		}
+	}
+	ldr.SortFileParts()
+
+	buff := make([]byte, fullSize)
+	_, err := rand.Read(buff)
+	require.NoError(t, err)
+
+	err = ldr.Upload(ctx, bytes.NewReader(buff))
+	require.NoError(t, err)
+
+	fileParts := ldr.GetFileParts()
+	require.Len(t, fileParts, len(storages)*replicas)
+
+	hashes := make(map[int]string)
+	for _, fp := range fileParts {
+		require.NotEmpty(t, fp.Hash)
+		if hash, ok := hashes[fp.Seq]; ok {
+			require.Equal(t, hash, fp.Hash)
+		}
+		hashes[fp.Seq] = fp.Hash
+	}
+	require.Len(t, hashes, len(storages))
+
+	// only one healthy replica is left for every part
+	downloader := NewLoader(zap.NewNop().Sugar(), fullSize)
+	for _, fp := range fileParts {
+		if fp.Seq%2 == 0 && fp.Client == storages[fp.Seq] {
+			fp.RemoteID = uuid.NewString()
+		}
+		downloader.AddFilePart(&fp)
+	}
+	downloader.SortFileParts()
+
+	reader, err := downloader.Download(ctx)
+	require.NoError(t, err)
+
+	recovered, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, buff, recovered)
+}
+
+func TestLoader_DownloadCorrupted(t *testing.T) {
+	ctx := context.Background()
+
+	fullSize := int64(3 * ChunkSize)
+	ldr := NewLoader(zap.NewNop().Sugar(), fullSize)
+
+	storages := []*mocks.Storage{mocks.NewStorage(ctx), mocks.NewStorage(ctx)}
+	for seq := 0; seq < 3; seq++ {
+		for _, s := range storages {
+			resp, err := s.CheckReadiness(ctx, &protocol.CheckReadinessRequest{})
+			require.NoError(t, err)
+
+			ldr.AddFilePart(&FilePart{
+				Seq:       seq,
+				RemoteID:  resp.Id,
+				StorageID: uuid.NewString(),
+				Client:    s,
+			})
+		}
+	}
+	ldr.SortFileParts()
+
+	buff := make([]byte, fullSize)
+	_, err := rand.Read(buff)
+	require.NoError(t, err)
+	require.NoError(t, ldr.Upload(ctx, bytes.NewReader(buff)))
+
+	download := func(offset, length int64) ([]byte, error) {
+		downloader := NewLoader(zap.NewNop().Sugar(), fullSize)
+		for _, fp := range ldr.GetFileParts() {
+			downloader.AddFilePart(&fp)
+		}
+		downloader.SortFileParts()
+
+		reader, err := downloader.DownloadRange(ctx, offset, length)
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(reader)
+	}
+
+	// every part has a corrupted replica
+	for _, fp := range ldr.GetFileParts() {
+		if fp.Client == storages[fp.Seq%2] {
+			storages[fp.Seq%2].Corrupt(fp.RemoteID)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		data, err := download(0, fullSize)
+		require.NoError(t, err)
+		require.Equal(t, buff, data)
+	}
+
+	// a part read whole is checked, a range is fetched as is
+	data, err := download(ChunkSize, ChunkSize)
+	require.NoError(t, err)
+	require.Equal(t, buff[ChunkSize:2*ChunkSize], data)
+
+	data, err = download(ChunkSize+10, ChunkSize-10)
+	require.NoError(t, err)
+	require.Equal(t, buff[ChunkSize+10:2*ChunkSize], data)
+
+	// the last part has no intact replica
+	for _, fp := range ldr.GetFileParts() {
+		if fp.Seq == 2 && fp.Client != storages[0] {
+			storages[1].Corrupt(fp.RemoteID)
+		}
+	}
+
+	_, err = download(2*ChunkSize, ChunkSize)
+	require.ErrorIs(t, err, ErrCorrupted)
+
+	var corrupted *CorruptedPartError
+	require.ErrorAs(t, err, &corrupted)
+	require.Equal(t, 2, corrupted.Seq)
+
+	// a part which isn't the first one fails the reader
+	_, err = download(0, fullSize)
+	require.ErrorIs(t, err, ErrCorrupted)
+}
+
+// windowStorage records the ranges requested from the storage.
+type windowStorage struct {
+	*mocks.Storage
+	locker   sync.Mutex
+	requests []*protocol.GetFileRequest
+}
+
+func (s *windowStorage) GetFile(ctx context.Context, in *protocol.GetFileRequest, opts ...grpc.CallOption) (protocol.Storage_GetFileClient, error) {
+	s.locker.Lock()
+	s.requests = append(s.requests, in)
+	s.locker.Unlock()
+	return s.Storage.GetFile(ctx, in, opts...)
+}
+
+func TestLoader_DownloadRangeWindow(t *testing.T) {
+	ctx := context.Background()
+
+	fullSize := int64(4 * ChunkSize)
+	ldr := NewLoader(zap.NewNop().Sugar(), fullSize)
+
+	storages := make([]*windowStorage, 2)
+	for seq := range storages {
+		storages[seq] = &windowStorage{Storage: mocks.NewStorage(ctx)}
+		resp, err := storages[seq].CheckReadiness(ctx, &protocol.CheckReadinessRequest{})
+		require.NoError(t, err)
+
+		ldr.AddFilePart(&FilePart{
+			Seq:       seq,
+			RemoteID:  resp.Id,
+			StorageID: uuid.NewString(),
+			Client:    storages[seq],
+		})
+	}
+	ldr.SortFileParts()
+
+	buff := make([]byte, fullSize)
+	_, err := rand.Read(buff)
+	require.NoError(t, err)
+	require.NoError(t, ldr.Upload(ctx, bytes.NewReader(buff)))
+
+	offset, length := int64(ChunkSize+10), int64(2*ChunkSize)
+	reader, err := ldr.DownloadRange(ctx, offset, length)
+	require.NoError(t, err)
+
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, buff[offset:offset+length], data)
+
+	// only the bytes of the range are requested from every part
+	require.Len(t, storages[0].requests, 1)
+	require.Equal(t, int64(ChunkSize+10), storages[0].requests[0].Offset)
+	require.Equal(t, int64(ChunkSize-10), storages[0].requests[0].Length)
+
+	require.Len(t, storages[1].requests, 1)
+	require.Equal(t, int64(0), storages[1].requests[0].Offset)
+	require.Equal(t, int64(ChunkSize+10), storages[1].requests[0].Length)
+}
+
+func TestLoader_RebuildPart(t *testing.T) {
+	ctx := context.Background()
+
+	fullSize := int64(2*ChunkSize + 10)
+	ldr := NewLoader(zap.NewNop().Sugar(), fullSize)
+
+	storages := []*mocks.Storage{mocks.NewStorage(ctx), mocks.NewStorage(ctx)}
+	for seq := 0; seq < 2; seq++ {
+		for _, s := range storages {
+			resp, err := s.CheckReadiness(ctx, &protocol.CheckReadinessRequest{})
+			require.NoError(t, err)
+
+			ldr.AddFilePart(&FilePart{
+				Seq:       seq,
+				RemoteID:  resp.Id,
+				StorageID: uuid.NewString(),
+				Client:    s,
+			})
+		}
+	}
+	ldr.SortFileParts()
+
+	buff := make([]byte, fullSize)
+	_, err := rand.Read(buff)
+	require.NoError(t, err)
+	require.NoError(t, ldr.Upload(ctx, bytes.NewReader(buff)))
+
+	fileParts := ldr.GetFileParts()
+	lost := fileParts[2]
+
+	newTarget := func() *FilePart {
+		client := mocks.NewStorage(ctx)
+		resp, err := client.CheckReadiness(ctx, &protocol.CheckReadinessRequest{})
+		require.NoError(t, err)
+		return &FilePart{Seq: lost.Seq, RemoteID: resp.Id, StorageID: uuid.NewString(), Client: client}
+	}
+
+	repairer := NewLoader(zap.NewNop().Sugar(), fullSize)
+	repairer.AddFilePart(&fileParts[3])
+
+	target := newTarget()
+	require.NoError(t, repairer.RebuildPart(ctx, lost, target))
+	require.Equal(t, lost.Hash, target.Hash)
+	require.Equal(t, lost.Size, target.Size)
+
+	parts := target.Client.(*mocks.Storage).GetFileParts()
+	require.Len(t, parts, 1)
+	require.Equal(t, buff[fileParts[0].Size:], parts[0].Data.Bytes())
+
+	// a corrupted replica isn't copied
+	fileParts[3].Client.(*mocks.Storage).Corrupt(fileParts[3].RemoteID)
+	require.ErrorIs(t, repairer.RebuildPart(ctx, lost, newTarget()), ErrCorrupted)
+
+	// no replicas are left
+	require.Error(t, NewLoader(zap.NewNop().Sugar(), fullSize).RebuildPart(ctx, lost, newTarget()))
+}
+
+func TestLoader_UploadStream(t *testing.T) {
+	ctx := context.Background()
+
+	fullSize := int64(3*ChunkSize + 100)
+	buff := make([]byte, fullSize+1)
+	_, err := rand.Read(buff)
+	require.NoError(t, err)
+
+	newLoader := func() *loader {
+		ldr := NewLoader(zap.NewNop().Sugar(), fullSize)
+		for seq := 0; seq < 2; seq++ {
+			client := mocks.NewStorage(ctx)
+			resp, err := client.CheckReadiness(ctx, &protocol.CheckReadinessRequest{Size: fullSize / 2})
+			require.NoError(t, err)
+
+			ldr.AddFilePart(&FilePart{
+				Seq:       seq,
+				RemoteID:  resp.Id,
+				StorageID: uuid.NewString(),
+				Client:    client,
+			})
+		}
+		ldr.SortFileParts()
+		return ldr
+	}
+
+	// a network stream returns less than asked
+	err = newLoader().Upload(ctx, iotest.HalfReader(bytes.NewReader(buff[:fullSize])))
+	require.NoError(t, err)
+
+	err = newLoader().Upload(ctx, bytes.NewReader(buff[:fullSize-1]))
+	require.ErrorIs(t, err, ErrSizeMismatch)
+
+	err = newLoader().Upload(ctx, bytes.NewReader(buff))
+	require.ErrorIs(t, err, ErrSizeMismatch)
+}
+
+func TestLoader_UploadStreamOfUnknownSize(t *testing.T) {
+	ctx := context.Background()
+
+	buff := make([]byte, 2*ChunkSize+10)
+	_, err := rand.Read(buff)
+	require.NoError(t, err)
+
+	ldr := NewLoader(zap.NewNop().Sugar(), UnknownSize)
+	for i := 0; i < 2; i++ {
+		client := mocks.NewStorage(ctx)
+		resp, err := client.CheckReadiness(ctx, &protocol.CheckReadinessRequest{Size: ChunkSize * 4})
+		require.NoError(t, err)
+
+		ldr.AddFilePart(&FilePart{
+			Seq:       0,
+			RemoteID:  resp.Id,
+			StorageID: uuid.NewString(),
+			Client:    client,
+		})
+	}
+
+	size, err := ldr.UploadStream(ctx, iotest.HalfReader(bytes.NewReader(buff)))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(buff)), size)
+
+	for _, fp := range ldr.GetFileParts() {
+		require.Equal(t, size, fp.Size)
+
+		parts := fp.Client.(*mocks.Storage).GetFileParts()
+		require.Len(t, parts, 1)
+		require.Equal(t, buff, parts[0].Data.Bytes())
+	}
+
+	reader, err := ldr.Download(ctx)
+	require.NoError(t, err)
+
+	downloaded, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, buff, downloaded)
+}
+
+func TestLoader_UploadTooManyParts(t *testing.T) {
+	ctx := context.Background()
+
+	ldr := NewLoader(zap.NewNop().Sugar(), 2)
+	for seq := 0; seq < 3; seq++ {
+		client := mocks.NewStorage(ctx)
+
+		resp, err := client.CheckReadiness(ctx, &protocol.CheckReadinessRequest{Size: 1})
+		require.NoError(t, err)
+
+		ldr.AddFilePart(&FilePart{
+			Seq:       seq,
+			RemoteID:  resp.Id,
+			StorageID: uuid.NewString(),
+			Client:    client,
+		})
+	}
+	ldr.SortFileParts()
+
+	// a part would be empty
+	err := ldr.Upload(ctx, bytes.NewReader([]byte{1, 2}))
+	require.Error(t, err)
+
+	for _, fp := range ldr.GetFileParts() {
+		require.Empty(t, fp.Client.(*mocks.Storage).GetFileParts()[0].Data.Bytes())
+	}
+}
+
+func TestLoader_UploadParallelFailure(t *testing.T) {
+	ctx := context.Background()
+
+	fullSize := int64(8 * ChunkSize * UploadBufferChunks)
+	buff := make([]byte, fullSize)
+	_, err := rand.Read(buff)
+	require.NoError(t, err)
+
+	errFailed := errors.New("storage failed")
+
+	ldr := NewLoader(zap.NewNop().Sugar(), fullSize)
+	ldr.SetParallelism(2)
+	for seq := 0; seq < 4; seq++ {
+		storage := mocks.NewStorage(ctx)
+		var client protocol.StorageClient = &stallingStorage{Storage: storage}
+		if seq == 1 {
+			storage.UploadErr = errFailed
+			client = storage
+		}
+
+		resp, err := client.CheckReadiness(ctx, &protocol.CheckReadinessRequest{Size: fullSize / 4})
+		require.NoError(t, err)
+
+		ldr.AddFilePart(&FilePart{
+			Seq:       seq,
+			RemoteID:  resp.Id,
+			StorageID: uuid.NewString(),
+			Client:    client,
+		})
+	}
+	ldr.SortFileParts()
+
+	err = ldr.Upload(ctx, bytes.NewReader(buff))
+	require.ErrorIs(t, err, errFailed)
+
+	// the last part waits for the slot of the failed one, so it's never started
+	require.Empty(t, ldr.GetFileParts()[3].Hash)
+}
+
+// stallingStorage holds every upload until the upload is cancelled, so its parts
+// never free a slot before the failed part does.
+type stallingStorage struct {
+	*mocks.Storage
+}
+
+func (s *stallingStorage) UploadFile(ctx context.Context, opts ...grpc.CallOption) (protocol.Storage_UploadFileClient, error) {
+	stream, err := s.Storage.UploadFile(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &stallingStream{Storage_UploadFileClient: stream, ctx: ctx}, nil
+}
+
+type stallingStream struct {
+	protocol.Storage_UploadFileClient
+	ctx context.Context
+}
+
+func (s *stallingStream) Send(request *protocol.UploadFileRequest) error {
+	<-s.ctx.Done()
+	return s.ctx.Err()
+}
+
+// streamCounter counts the upload streams open at the same time. A stream waits
+// for the others before its first chunk, so parts sent one by one never overlap.
+type streamCounter struct {
+	locker sync.Mutex
+	want   int
+	active int
+	max    int
+	all    chan struct{}
+}
+
+func (c *streamCounter) open() {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	c.active++
+	if c.active > c.max {
+		c.max = c.active
+	}
+	if c.active == c.want {
+		select {
+		case <-c.all:
+		default:
+			close(c.all)
+		}
+	}
+}
+
+func (c *streamCounter) close() {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	c.active--
+}
+
+type countingStorage struct {
+	*mocks.Storage
+	counter *streamCounter
+}
+
+func (s *countingStorage) UploadFile(ctx context.Context, opts ...grpc.CallOption) (protocol.Storage_UploadFileClient, error) {
+	stream, err := s.Storage.UploadFile(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	s.counter.open()
+	return &countingStream{Storage_UploadFileClient: stream, counter: s.counter}, nil
+}
+
+type countingStream struct {
+	protocol.Storage_UploadFileClient
+	counter *streamCounter
+	started bool
+}
+
+func (s *countingStream) Send(request *protocol.UploadFileRequest) error {
+	if !s.started {
+		s.started = true
+		select {
+		case <-s.counter.all:
+		case <-time.After(time.Second):
+		}
+	}
+	return s.Storage_UploadFileClient.Send(request)
+}
+
+func (s *countingStream) CloseAndRecv() (*protocol.UploadFileResponse, error) {
+	defer s.counter.close()
+	return s.Storage_UploadFileClient.CloseAndRecv()
+}
+
+func TestLoader_UploadParallelism(t *testing.T) {
+	ctx := context.Background()
+
+	const parallelism = 4
+	const parts = 6
+
+	// every part is larger than the chunks a sender queues
+	partSize := int64(2 * ChunkSize * UploadBufferChunks)
+	fullSize := partSize * parts
+	buff := make([]byte, fullSize)
+	_, err := rand.Read(buff)
+	require.NoError(t, err)
+
+	counter := &streamCounter{want: parallelism, all: make(chan struct{})}
+
+	ldr := NewLoader(zap.NewNop().Sugar(), fullSize)
+	ldr.SetParallelism(parallelism)
+	for seq := 0; seq < parts; seq++ {
+		client := &countingStorage{Storage: mocks.NewStorage(ctx), counter: counter}
+
+		resp, err := client.CheckReadiness(ctx, &protocol.CheckReadinessRequest{Size: partSize})
+		require.NoError(t, err)
+
+		ldr.AddFilePart(&FilePart{
+			Seq:       seq,
+			RemoteID:  resp.Id,
+			StorageID: uuid.NewString(),
+			Client:    client,
+		})
+	}
+	ldr.SortFileParts()
+
+	require.NoError(t, ldr.Upload(ctx, bytes.NewReader(buff)))
+	require.Equal(t, parallelism, counter.max)
+
+	var data []byte
+	for _, fp := range ldr.GetFileParts() {
+		require.Equal(t, partSize, fp.Size)
+		stored := fp.Client.(*countingStorage).GetFileParts()
+		require.Len(t, stored, 1)
+		data = append(data, stored[0].Data.Bytes()...)
+	}
+	require.Equal(t, buff, data)
+}
+
+func TestLoader_UploadFailover(t *testing.T) {
+	ctx := context.Background()
+
+	fullSize := int64(4*ChunkSize*UploadBufferChunks + 100)
+	buff := make([]byte, fullSize)
+	_, err := rand.Read(buff)
+	require.NoError(t, err)
+
+	errFailed := errors.New("storage failed")
+
+	newLoader := func(retries int, spare int) (*loader, map[string]*mocks.Storage) {
+		storages := make(map[string]*mocks.Storage)
+
+		ldr := NewLoader(zap.NewNop().Sugar(), fullSize)
+		for seq := 0; seq < 2; seq++ {
+			client := mocks.NewStorage(ctx)
+			if seq == 1 {
+				client.UploadErr = errFailed
+			}
+
+			resp, err := client.CheckReadiness(ctx, &protocol.CheckReadinessRequest{Size: fullSize / 2})
+			require.NoError(t, err)
+
+			storageID := uuid.NewString()
+			storages[storageID] = client
+			ldr.AddFilePart(&FilePart{
+				Seq:       seq,
+				RemoteID:  resp.Id,
+				StorageID: storageID,
+				Client:    client,
+			})
+		}
+		ldr.SortFileParts()
+
+		ldr.SetFailover(func(ctx context.Context, seq int, size int64, exclude []string) (*FilePart, error) {
+			if spare == 0 {
+				return nil, ErrNoStorages
+			}
+			spare--
+
+			client := mocks.NewStorage(ctx)
+			resp, err := client.CheckReadiness(ctx, &protocol.CheckReadinessRequest{Size: size})
+			if err != nil {
+				return nil, err
+			}
+
+			storageID := uuid.NewString()
+			storages[storageID] = client
+			return &FilePart{Seq: seq, RemoteID: resp.Id, StorageID: storageID, Client: client}, nil
+		}, retries, time.Millisecond)
+
+		return ldr, storages
+	}
+
+	t.Run("moved to another storage", func(t *testing.T) {
+		ldr, storages := newLoader(1, 1)
+
+		err := ldr.Upload(ctx, bytes.NewReader(buff))
+		require.NoError(t, err)
+
+		abandoned := ldr.AbandonedFileParts()
+		require.Len(t, abandoned, 1)
+		require.Equal(t, 1, abandoned[0].Seq)
+
+		offset := int64(0)
+		for _, fp := range ldr.GetFileParts() {
+			require.NotEqual(t, abandoned[0].StorageID, fp.StorageID)
+
+			parts := storages[fp.StorageID].GetFileParts()
+			require.Len(t, parts, 1)
+			require.Equal(t, buff[offset:offset+fp.Size], parts[0].Data.Bytes())
+			offset += fp.Size
+		}
+		require.Equal(t, fullSize, offset)
+	})
+
+	t.Run("rejected by storage", func(t *testing.T) {
+		ldr, storages := newLoader(1, 1)
+
+		errRejected := status.Error(codes.AlreadyExists, "already exists")
+		storages[ldr.GetFileParts()[1].StorageID].UploadErr = errRejected
+
+		err := ldr.Upload(ctx, bytes.NewReader(buff))
+		require.ErrorIs(t, err, errRejected)
+		require.Empty(t, ldr.AbandonedFileParts())
+	})
+
+	t.Run("no retries left", func(t *testing.T) {
+		ldr, _ := newLoader(0, 1)
+
+		err := ldr.Upload(ctx, bytes.NewReader(buff))
+		require.ErrorIs(t, err, errFailed)
+	})
+
+	t.Run("no storages left", func(t *testing.T) {
+		ldr, _ := newLoader(1, 0)
+
+		err := ldr.Upload(ctx, bytes.NewReader(buff))
+		require.ErrorIs(t, err, ErrNoStorages)
+	})
 }
@@ -1,10 +1,12 @@
 package manager
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"strconv"
 	"sync"
 	"time"
@@ -23,30 +25,61 @@ import (
 
 const (
 	MaxResponseTime = time.Millisecond * 200
+	// UnknownSize is the size of a file which is known only when its stream ends.
+	UnknownSize = -1
 )
 
 var (
 	ErrBusy     = errors.New("file is busy")
 	ErrExists   = errors.New("file exists")
 	ErrNotFound = errors.New("not found")
+
+	ErrUnknownEncoding = errors.New("unknown encoding")
+	ErrInvalidRange    = errors.New("invalid range")
+	ErrSizeMismatch    = errors.New("content size doesn't match")
 )
 
 type FileInfo struct {
 	Name        string
 	ContentType string
-	Size        int64
+	// Size is UnknownSize for streams of unknown length, they're always replicated.
+	Size int64
+	// Replicas overrides the cluster-wide replication factor when it's positive.
+	Replicas int
+	// Encoding overrides the cluster-wide durability mode when it's set.
+	Encoding repository.FileEncoding
+	// Checksums reject the upload when the content doesn't match them.
+	Checksums Checksums
+	// Overwrite replaces the current file of the name instead of failing with ErrExists.
+	// The parts of the replaced file are deleted once the new one takes the name.
+	Overwrite bool
+	// Precondition is checked against the current file of the name.
+	Precondition Precondition
 }
 
 type Manager interface {
 	Prepare(ctx context.Context) (string, error)
 	Store(ctx context.Context, id string, info FileInfo, reader io.Reader) error
-	Load(ctx context.Context, name string) (io.Reader, error)
+	// Load reads the version of the file, the current one when the version is empty.
+	Load(ctx context.Context, name, version string) (io.Reader, error)
+	LoadRange(ctx context.Context, name, version string, offset, length int64) (io.Reader, error)
+	// Delete hides the file behind a delete marker when versioning is on, otherwise it deletes the file.
+	Delete(ctx context.Context, name string) error
+	DeleteVersion(ctx context.Context, name, version string) error
+
+	InitiateUpload(ctx context.Context, info FileInfo) (string, error)
+	UploadPart(ctx context.Context, uploadID string, number int, size int64, reader io.Reader) (*UploadedPart, error)
+	ListParts(ctx context.Context, uploadID string) ([]UploadedPart, error)
+	CompleteUpload(ctx context.Context, uploadID string, numbers []int) error
+	AbortUpload(ctx context.Context, uploadID string) error
 }
 
 func New(
+	log *zap.SugaredLogger,
 	repo repository.Repository,
 	cache cache.Cache,
 	clientFactory ClientFactory,
+	placement PlacementPolicy,
 ) (Manager, error) {
 	value, err := env.Get(env.MinStorages)
 	if err != nil {
@@ -58,11 +91,91 @@ func New(
 		return nil, fmt.Errorf("%s is not integer", env.MinStorages)
 	}
 
+	replicas, err := strconv.Atoi(env.GetOptional(env.ReplicationFactor, "1"))
+	if err != nil || replicas < 1 {
+		return nil, fmt.Errorf("%s is not positive integer", env.ReplicationFactor)
+	}
+
+	encoding := repository.FileEncoding(env.GetOptional(env.FileEncoding, string(repository.FileEncodingReplication)))
+	if encoding != repository.FileEncodingReplication && encoding != repository.FileEncodingErasure {
+		return nil, fmt.Errorf("%s is unknown: %s", env.FileEncoding, encoding)
+	}
+
+	dataShards, err := strconv.Atoi(env.GetOptional(env.ErasureDataShards, "4"))
+	if err != nil || dataShards < 1 {
+		return nil, fmt.Errorf("%s is not positive integer", env.ErasureDataShards)
+	}
+
+	parityShards, err := strconv.Atoi(env.GetOptional(env.ErasureParityShards, "2"))
+	if err != nil || parityShards < 1 {
+		return nil, fmt.Errorf("%s is not positive integer", env.ErasureParityShards)
+	}
+
+	streamPartSize, err := strconv.ParseInt(env.GetOptional(env.StreamPartSize, "67108864"), 10, 64)
+	if err != nil || streamPartSize < ChunkSize {
+		return nil, fmt.Errorf("%s must be at least %d", env.StreamPartSize, ChunkSize)
+	}
+
+	uploadParallelism, err := strconv.Atoi(env.GetOptional(env.UploadParallelism, strconv.Itoa(DefaultUploadParallelism)))
+	if err != nil || uploadParallelism < 1 {
+		return nil, fmt.Errorf("%s is not positive integer", env.UploadParallelism)
+	}
+
+	uploadRetries, err := strconv.Atoi(env.GetOptional(env.UploadRetries, strconv.Itoa(DefaultUploadRetries)))
+	if err != nil || uploadRetries < 0 {
+		return nil, fmt.Errorf("%s is not non-negative integer", env.UploadRetries)
+	}
+
+	uploadRetryBackoff, err := time.ParseDuration(env.GetOptional(env.UploadRetryBackoff, DefaultUploadRetryBackoff.String()))
+	if err != nil || uploadRetryBackoff < 0 {
+		return nil, fmt.Errorf("%s is not a duration", env.UploadRetryBackoff)
+	}
+
+	// a replicated file spans all the ready storages unless the span is set
+	span, err := strconv.Atoi(env.GetOptional(env.PlacementSpan, "0"))
+	if err != nil || span < 0 || (span > 0 && (span < minStorages || span < replicas)) {
+		return nil, fmt.Errorf("%s is not 0 or an integer not less than %s and %s", env.PlacementSpan, env.MinStorages, env.ReplicationFactor)
+	}
+
+	lockWait, err := time.ParseDuration(env.GetOptional(env.LockWait, "0s"))
+	if err != nil || lockWait < 0 {
+		return nil, fmt.Errorf("%s is not a duration", env.LockWait)
+	}
+
+	readCacheSize, err := strconv.ParseInt(env.GetOptional(env.ReadCacheSize, "0"), 10, 64)
+	if err != nil || readCacheSize < 0 {
+		return nil, fmt.Errorf("%s is not non-negative integer", env.ReadCacheSize)
+	}
+
+	readCacheMaxObject, err := strconv.ParseInt(env.GetOptional(env.ReadCacheMaxObject, strconv.Itoa(DefaultReadCacheMaxObject)), 10, 64)
+	if err != nil || readCacheMaxObject < 1 {
+		return nil, fmt.Errorf("%s is not positive integer", env.ReadCacheMaxObject)
+	}
+
+	versioning, err := strconv.ParseBool(env.GetOptional(env.Versioning, "false"))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a boolean", env.Versioning)
+	}
+
 	return &manager{
-		cache:         cache,
-		repo:          repo,
-		clientFactory: clientFactory,
-		minStorages:   minStorages,
+		log:                log,
+		cache:              cache,
+		repo:               repo,
+		clientFactory:      clientFactory,
+		placement:          placement,
+		minStorages:        minStorages,
+		span:               span,
+		replicas:           replicas,
+		encoding:           encoding,
+		dataShards:         dataShards,
+		parityShards:       parityShards,
+		streamPartSize:     streamPartSize,
+		uploadParallelism:  uploadParallelism,
+		uploadRetries:      uploadRetries,
+		uploadRetryBackoff: uploadRetryBackoff,
+		lockWait:           lockWait,
+		reads:              newReadCache(readCacheSize, readCacheMaxObject),
+		versioning:         versioning,
 	}, nil
 }
 
@@ -71,7 +184,24 @@ type manager struct {
 	repo          repository.Repository
 	cache         cache.Cache
 	clientFactory ClientFactory
+	placement     PlacementPolicy
 	minStorages   int
+	// span is the number of storages a replicated file is placed on, zero means all
+	span               int
+	replicas           int
+	encoding           repository.FileEncoding
+	dataShards         int
+	parityShards       int
+	streamPartSize     int64
+	uploadParallelism  int
+	uploadRetries      int
+	uploadRetryBackoff time.Duration
+	// lockWait is how long a request waits for a busy file, zero means it fails at once
+	lockWait time.Duration
+	// reads keeps small files which are read often, it's nil when disabled
+	reads *readCache
+	// versioning keeps older versions of a name when it's uploaded again or deleted
+	versioning bool
 }
 
 func (m *manager) Prepare(ctx context.Context) (string, error) {
@@ -86,18 +216,12 @@ func (m *manager) Prepare(ctx context.Context) (string, error) {
 }
 
 func (m *manager) Store(ctx context.Context, fileID string, info FileInfo, reader io.Reader) error {
-	keys := []string{fileID, info.Name}
-	if err := m.cache.Lock(keys); err != nil {
-		return ErrBusy
-	}
-	defer m.cache.Unlock(keys)
-
-	if _, err := m.repo.GetFileByName(ctx, info.Name); err != nil && !errors.Is(err, repository.ErrNotFound) {
-		if errors.Is(err, repository.ErrAlreadyExists) {
-			return ErrExists
-		}
+	// the name isn't locked, writers of the name are ordered when the file takes it
+	ctx, unlock, err := lockKeys(ctx, m.log, m.cache, m.lockWait, []string{fileID})
+	if err != nil {
 		return err
 	}
+	defer unlock()
 
 	file, err := m.repo.GetFile(ctx, fileID)
 	if err != nil {
@@ -108,114 +232,512 @@ func (m *manager) Store(ctx context.Context, fileID string, info FileInfo, reade
 		return ErrExists
 	}
 
-	ldr, err := m.prepareLoaderForUpload(ctx, info)
+	// the file is checked again when it takes the name, this check saves the upload
+	// when it's going to fail anyway
+	current, err := m.repo.GetFileByName(ctx, info.Name)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		return err
+	}
+	// a failed precondition is reported even when the file can't be replaced anyway
+	err = info.Precondition.check(current)
+	if err == nil && current != nil && !m.versioning && !info.Overwrite {
+		err = ErrExists
+	}
 	if err != nil {
+		// the prepared file won't be stored, so it doesn't wait for the garbage collector
+		m.dropFile(ctx, file.ID)
 		return err
 	}
 
-	if err = ldr.Upload(ctx, reader); err != nil {
-		return err
+	encoding := m.encoding
+	if info.Encoding != "" {
+		encoding = info.Encoding
+	}
+
+	replicas := m.replicas
+	if info.Replicas > 0 {
+		replicas = info.Replicas
 	}
 
-	var dbFileParts = make([]repository.FilePart, 0, ldr.LenFileParts())
-	for seq, fp := range ldr.GetFileParts() {
-		part := repository.NewFilePart(file.ID, fp.RemoteID, seq, fp.Size, fp.StorageID, fp.Hash)
-		dbFileParts = append(dbFileParts, part)
+	// an empty file has no parts at all and a stream is split into parts as it arrives
+	if info.Size <= 0 {
+		encoding = repository.FileEncodingReplication
 	}
 
-	if err = m.repo.CreateFileParts(ctx, dbFileParts); err != nil {
+	var (
+		ldr                      *loader
+		dataShards, parityShards int
+	)
+	switch {
+	case info.Size <= 0:
+	case encoding == repository.FileEncodingReplication:
+		ldr, err = m.prepareLoaderForUpload(ctx, info, replicas)
+	case encoding == repository.FileEncodingErasure:
+		replicas = 1
+		dataShards, parityShards = m.dataShards, m.parityShards
+		ldr, err = m.prepareErasureLoaderForUpload(ctx, info, dataShards, parityShards)
+	default:
+		return ErrUnknownEncoding
+	}
+	if err != nil {
 		return err
 	}
+	if ldr != nil {
+		if err = m.holdFileParts(ctx, file.ID, ldr); err != nil {
+			m.discardFileParts(ldr.GetFileParts())
+			return err
+		}
+	}
 
-	if err = m.repo.UpdateFileInfo(ctx, file.ID, repository.UpdateFileInfoInput{
-		Name:        info.Name,
-		ContentType: info.ContentType,
-		Size:        info.Size,
-		Status:      repository.FileStatusUploaded,
-	}); err != nil {
+	sums := newChecksumReader(reader, info.Checksums)
+	reader = sums
+
+	size := info.Size
+	switch {
+	case ldr != nil:
+		err = ldr.Upload(ctx, reader)
+		m.cleanupUpload(ldr, err)
+		if err != nil {
+			return err
+		}
+
+		var dbFileParts = make([]repository.FilePart, 0, ldr.LenFileParts())
+		for _, fp := range ldr.GetFileParts() {
+			part := repository.NewFilePart(file.ID, fp.RemoteID, fp.Seq, fp.Size, fp.StorageID, fp.Hash)
+			dbFileParts = append(dbFileParts, part)
+		}
+
+		if err = m.repo.CreateFileParts(ctx, dbFileParts); err != nil {
+			m.discardFileParts(ldr.GetFileParts())
+			return err
+		}
+	case info.Size < 0:
+		if size, err = m.storeStream(ctx, file.ID, replicas, reader); err != nil {
+			return err
+		}
+	default:
+		if err = ensureEOF(reader); err != nil {
+			return err
+		}
+	}
+
+	mode := repository.ReplaceNone
+	switch {
+	case m.versioning:
+		mode = repository.ReplaceSupersede
+	case info.Overwrite:
+		mode = repository.ReplaceDelete
+	}
+
+	replaced, deletions, err := m.repo.ReplaceFile(ctx, file.ID, repository.UpdateFileInfoInput{
+		Name:         info.Name,
+		ContentType:  info.ContentType,
+		Size:         size,
+		Hash:         sums.Hash(),
+		MD5:          sums.MD5(),
+		Replicas:     replicas,
+		Encoding:     encoding,
+		DataShards:   dataShards,
+		ParityShards: parityShards,
+		Status:       repository.FileStatusUploaded,
+	}, mode, info.Precondition.check)
+	if err != nil {
+		if errors.Is(err, repository.ErrAlreadyExists) {
+			err = ErrExists
+		}
+		if errors.Is(err, ErrExists) || errors.Is(err, ErrPreconditionFailed) {
+			m.dropFile(ctx, file.ID)
+		}
 		return err
 	}
 
+	m.reads.remove(replaced)
+
+	// the replaced file is gone, parts which fail to be deleted now are retried by the deleter
+	deleteParts(ctx, m.log, m.repo, m.clientFactory, deletions)
+
 	return nil
 }
 
-func (m *manager) Load(ctx context.Context, name string) (io.Reader, error) {
-	file, err := m.repo.GetFileByName(ctx, name)
+// dropFile deletes the uploaded file which can't take its name.
+func (m *manager) dropFile(ctx context.Context, fileID string) {
+	deletions, err := m.repo.DeleteFile(ctx, fileID)
 	if err != nil {
-		if errors.Is(err, repository.ErrNotFound) {
-			return nil, ErrNotFound
+		m.log.With("err", err).Errorf("failed to delete file %s", fileID)
+		return
+	}
+	deleteParts(ctx, m.log, m.repo, m.clientFactory, deletions)
+}
+
+func (m *manager) Load(ctx context.Context, name, version string) (io.Reader, error) {
+	file, err := m.getFile(ctx, name, version)
+	if err != nil {
+		return nil, err
+	}
+
+	cached := m.reads.fits(file.Size, file.Hash)
+	if cached {
+		if data, ok := m.reads.get(file.ID, file.Hash); ok {
+			return bytes.NewReader(data), nil
 		}
+	}
+
+	ldr, err := m.prepareLoaderForDownload(ctx, file)
+	if err != nil {
 		return nil, err
 	}
 
+	reader, err := ldr.Download(ctx)
+	if err != nil || !cached {
+		return reader, err
+	}
+
+	// small files are read whole, so they can be kept by the read cache
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	m.reads.add(file.ID, file.Hash, data)
+
+	return bytes.NewReader(data), nil
+}
+
+func (m *manager) LoadRange(ctx context.Context, name, version string, offset, length int64) (io.Reader, error) {
+	file, err := m.getFile(ctx, name, version)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset < 0 || length < 0 || offset+length > file.Size {
+		return nil, ErrInvalidRange
+	}
+
+	if m.reads.fits(file.Size, file.Hash) {
+		if data, ok := m.reads.get(file.ID, file.Hash); ok {
+			return bytes.NewReader(data[offset : offset+length]), nil
+		}
+	}
+
 	ldr, err := m.prepareLoaderForDownload(ctx, file)
 	if err != nil {
 		return nil, err
 	}
 
-	return ldr.Download(ctx)
+	return ldr.DownloadRange(ctx, offset, length)
 }
 
-func (m *manager) prepareLoaderForUpload(ctx context.Context, info FileInfo) (*loader, error) {
-	storages, err := m.repo.FindStorages(ctx)
+func (m *manager) Delete(ctx context.Context, name string) error {
+	ctx, unlock, err := lockKeys(ctx, m.log, m.cache, m.lockWait, []string{name})
 	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if m.versioning {
+		marker := repository.NewFile()
+		marker.Name = &name
+		hidden, err := m.repo.CreateDeleteMarker(ctx, &marker)
+		if err != nil {
+			switch {
+			case errors.Is(err, repository.ErrNotFound):
+				return ErrNotFound
+			case errors.Is(err, repository.ErrAlreadyExists):
+				// another version of the name became current at the same time
+				return ErrBusy
+			}
+			return err
+		}
+		m.reads.remove(hidden)
+		return nil
+	}
+
+	file, err := m.repo.GetFileByName(ctx, name)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return ErrNotFound
+		}
+		return err
+	}
+
+	deletions, err := m.repo.DeleteFile(ctx, file.ID)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return ErrNotFound
+		}
+		return err
+	}
+
+	m.reads.remove(file.ID)
+
+	// parts which fail to be deleted now are retried by the deleter
+	deleteParts(ctx, m.log, m.repo, m.clientFactory, deletions)
+
+	return nil
+}
+
+// DeleteVersion deletes the version of the file or the delete marker for good.
+// The newest of the remaining versions becomes current.
+func (m *manager) DeleteVersion(ctx context.Context, name, version string) error {
+	ctx, unlock, err := lockKeys(ctx, m.log, m.cache, m.lockWait, []string{name})
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	deletions, err := m.repo.DeleteFileVersion(ctx, name, version)
+	if err != nil {
+		switch {
+		case errors.Is(err, repository.ErrNotFound):
+			return ErrNotFound
+		case errors.Is(err, repository.ErrAlreadyExists):
+			// another version of the name became current at the same time
+			return ErrBusy
+		}
+		return err
+	}
+
+	m.reads.remove(version)
+
+	// parts which fail to be deleted now are retried by the deleter
+	deleteParts(ctx, m.log, m.repo, m.clientFactory, deletions)
+
+	return nil
+}
+
+// getFile returns the version of the file, the current one when the version is empty.
+func (m *manager) getFile(ctx context.Context, name, version string) (*repository.File, error) {
+	var (
+		file *repository.File
+		err  error
+	)
+	if version == "" {
+		file, err = m.repo.GetFileByName(ctx, name)
+	} else {
+		file, err = m.repo.GetFileVersion(ctx, name, version)
+	}
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, ErrNotFound
+		}
 		return nil, err
 	}
+	return file, nil
+}
+
+type readyStorage struct {
+	storage   repository.Storage
+	client    protocol.StorageClient
+	remoteIDs []string
+}
 
-	if len(storages) < m.minStorages {
-		return nil, fmt.Errorf("not enough storages")
+// reserveStorages asks up to n storages, in the order of the placement policy, to reserve
+// the given number of file parts. Storages which aren't ready are replaced by the next
+// ones. It returns the storages which are ready to take all the parts in that order.
+// All the storages are asked when n isn't positive.
+func (m *manager) reserveStorages(ctx context.Context, partSize int64, parts int, n int) ([]readyStorage, error) {
+	storages, err := m.repo.FindStorages(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	ldr := NewLoader(m.log, info.Size)
+	ordered := m.placement.Order(storages, nil)
+	if n <= 0 || n > len(ordered) {
+		n = len(ordered)
+	}
 
-	var wg sync.WaitGroup
-	maxPartSize := info.Size / int64(m.minStorages)
-	errs := make(chan error, len(storages))
-	for _, s := range storages {
-		wg.Add(1)
-		go func(ctx context.Context, s repository.Storage, size int64) {
-			defer wg.Done()
+	var ready []readyStorage
+	for len(ready) < n && len(ordered) > 0 {
+		batch := ordered
+		if len(batch) > n-len(ready) {
+			batch = batch[:n-len(ready)]
+		}
+		ordered = ordered[len(batch):]
+
+		results := make([]*readyStorage, len(batch))
+		var wg sync.WaitGroup
+		for i, s := range batch {
+			wg.Add(1)
+			go func(i int, s repository.Storage) {
+				defer wg.Done()
+
+				rs, err := m.reserveStorage(ctx, s, partSize, parts)
+				if err != nil {
+					m.log.With("err", err).Warnf("failed to reserve parts on storage %s", s.ID)
+					return
+				}
+				results[i] = rs
+			}(i, *s)
+		}
+		wg.Wait()
 
-			client, err := m.clientFactory.NewStorageClient(ctx, s.Host)
-			if err != nil {
-				errs <- fmt.Errorf("failed to connect to storage (%s): %v", s.ID, err)
-				return
+		for _, rs := range results {
+			if rs != nil {
+				ready = append(ready, *rs)
 			}
-			reqCtx, cancel := context.WithTimeout(ctx, MaxResponseTime)
-			defer cancel()
+		}
+	}
 
-			resp, err := client.CheckReadiness(reqCtx, &protocol.CheckReadinessRequest{
-				Size: size,
+	return ready, nil
+}
+
+// reserveStorage reserves the given number of file parts on the storage. It returns nil
+// when the storage isn't ready to take all of them.
+func (m *manager) reserveStorage(ctx context.Context, s repository.Storage, size int64, parts int) (*readyStorage, error) {
+	client, err := m.clientFactory.NewStorageClient(ctx, s.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to storage (%s): %v", s.ID, err)
+	}
+	reqCtx, cancel := context.WithTimeout(ctx, MaxResponseTime)
+	defer cancel()
+
+	rs := &readyStorage{
+		storage:   s,
+		client:    client,
+		remoteIDs: make([]string, 0, parts),
+	}
+	for i := 0; i < parts; i++ {
+		resp, err := client.CheckReadiness(reqCtx, &protocol.CheckReadinessRequest{
+			Size: size,
+		})
+		if err != nil || !resp.Ready {
+			m.releaseStorages([]readyStorage{*rs})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to check storage rediness (%s): %v", s.ID, err)
+		}
+		if !resp.Ready {
+			return nil, nil
+		}
+		rs.remoteIDs = append(rs.remoteIDs, resp.Id)
+	}
+
+	return rs, nil
+}
+
+// releaseStorages frees the space reserved on storages which aren't used.
+func (m *manager) releaseStorages(unused []readyStorage) {
+	var fileParts []FilePart
+	for _, rs := range unused {
+		for _, remoteID := range rs.remoteIDs {
+			fileParts = append(fileParts, FilePart{
+				RemoteID:  remoteID,
+				StorageID: rs.storage.ID,
 			})
-			if err != nil {
-				errs <- fmt.Errorf("failed to check storage rediness (%s): %v", s.ID, err)
-				return
-			}
-			if !resp.Ready {
-				return
-			}
+		}
+	}
+	m.discardFileParts(fileParts)
+}
+
+// prepareLoaderForUpload splits the file into one part per ready storage and places
+// every part on the given number of distinct storages, in distinct zones when possible.
+func (m *manager) prepareLoaderForUpload(ctx context.Context, info FileInfo, replicas int) (*loader, error) {
+	// every part takes at least a byte, so a file smaller than the minimum of storages
+	// is kept whole and a file of fewer bytes than storages spans fewer of them
+	if info.Size < int64(m.minStorages) || info.Size < int64(replicas) {
+		return m.prepareLoaderForPart(ctx, 0, info.Size, replicas)
+	}
+	span := m.span
+	if (span == 0 || int64(span) > info.Size) && info.Size <= math.MaxInt32 {
+		span = int(info.Size)
+	}
+
+	// every storage keeps one replica of as many parts as the replication factor
+	ready, err := m.reserveStorages(ctx, info.Size/int64(m.minStorages), replicas, span)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ready) < m.minStorages || len(ready) < replicas {
+		m.releaseStorages(ready)
+		return nil, fmt.Errorf("not enough file parts")
+	}
 
+	ldr := NewLoader(m.log, info.Size)
+	ldr.SetParallelism(m.uploadParallelism)
+	ldr.SetFailover(m.replaceFilePart, m.uploadRetries, m.uploadRetryBackoff)
+
+	zones := make([]string, 0, len(ready))
+	for _, rs := range ready {
+		zones = append(zones, rs.storage.Zone)
+	}
+	// every storage gives one of its reserved parts to each part placed on it
+	taken := make([]int, len(ready))
+	for seq, storages := range assignReplicas(zones, replicas) {
+		for _, i := range storages {
+			rs := ready[i]
 			ldr.AddFilePart(&FilePart{
-				RemoteID:  resp.Id,
-				StorageID: s.ID,
-				Client:    client,
+				Seq:       seq,
+				RemoteID:  rs.remoteIDs[taken[i]],
+				StorageID: rs.storage.ID,
+				Client:    rs.client,
 			})
-		}(ctx, *s, maxPartSize)
+			taken[i]++
+		}
 	}
-	wg.Wait()
+	ldr.SortFileParts()
 
-	close(errs)
-	if err = helpers.ReadErrors(errs); err != nil {
+	return ldr, nil
+}
+
+// prepareErasureLoaderForUpload places every data and parity shard on a distinct storage.
+func (m *manager) prepareErasureLoaderForUpload(ctx context.Context, info FileInfo, dataShards, parityShards int) (*loader, error) {
+	totalShards := dataShards + parityShards
+	ready, err := m.reserveStorages(ctx, shardSize(info.Size, dataShards), 1, totalShards)
+	if err != nil {
 		return nil, err
 	}
 
-	if ldr.LenFileParts() < m.minStorages {
-		return nil, fmt.Errorf("not enough file parts")
+	if len(ready) < m.minStorages || len(ready) < totalShards {
+		m.releaseStorages(ready)
+		return nil, fmt.Errorf("not enough storages for %d shards", totalShards)
+	}
+
+	ldr := NewErasureLoader(m.log, info.Size, dataShards, parityShards)
+	ldr.SetFailover(m.replaceFilePart, m.uploadRetries, m.uploadRetryBackoff)
+	for seq, rs := range ready[:totalShards] {
+		ldr.AddFilePart(&FilePart{
+			Seq:       seq,
+			RemoteID:  rs.remoteIDs[0],
+			StorageID: rs.storage.ID,
+			Client:    rs.client,
+		})
 	}
+	ldr.SortFileParts()
 
 	return ldr, nil
 }
 
+// holdFileParts records the parts of the loader as reserved for the file, the replacements
+// found during upload are recorded too. Parts are saved only when the whole file is sent,
+// the reservations keep the garbage collector from taking the parts sent early for orphans.
+func (m *manager) holdFileParts(ctx context.Context, fileID string, ldr *loader) error {
+	if err := m.reserveFileParts(ctx, fileID, ldr.GetFileParts()); err != nil {
+		return err
+	}
+
+	ldr.SetFailover(func(ctx context.Context, seq int, size int64, exclude []string) (*FilePart, error) {
+		part, err := m.replaceFilePart(ctx, seq, size, exclude)
+		if err != nil {
+			return nil, err
+		}
+		if err = m.reserveFileParts(ctx, fileID, []FilePart{*part}); err != nil {
+			m.discardFileParts([]FilePart{*part})
+			return nil, err
+		}
+		return part, nil
+	}, m.uploadRetries, m.uploadRetryBackoff)
+
+	return nil
+}
+
+func (m *manager) reserveFileParts(ctx context.Context, fileID string, fileParts []FilePart) error {
+	reservations := make([]repository.PartReservation, 0, len(fileParts))
+	for _, fp := range fileParts {
+		reservations = append(reservations, repository.NewPartReservation(fileID, fp.StorageID, fp.RemoteID))
+	}
+	return m.repo.CreatePartReservations(ctx, reservations)
+}
+
 func (m *manager) prepareLoaderForDownload(ctx context.Context, file *repository.File) (*loader, error) {
 	fileParts, err := m.repo.FindFileParts(ctx, file.ID)
 	if err != nil {
@@ -223,6 +745,9 @@ func (m *manager) prepareLoaderForDownload(ctx context.Context, file *repository
 	}
 
 	ldr := NewLoader(m.log, file.Size)
+	if file.Encoding == repository.FileEncodingErasure {
+		ldr = NewErasureLoader(m.log, file.Size, file.DataShards, file.ParityShards)
+	}
 
 	var wg sync.WaitGroup
 	errs := make(chan error, len(fileParts))
@@ -237,6 +762,12 @@ func (m *manager) prepareLoaderForDownload(ctx context.Context, file *repository
 				return
 			}
 
+			// parts of a dead storage are read from the other copies until they're repaired
+			if storage.State == repository.StorageStateDead {
+				errs <- fmt.Errorf("storage %s is dead", storage.ID)
+				return
+			}
+
 			client, err := m.clientFactory.NewStorageClient(ctx, storage.Host)
 			if err != nil {
 				errs <- fmt.Errorf("failed to connect to storage (%s): %v", storage.ID, err)
@@ -254,6 +785,7 @@ func (m *manager) prepareLoaderForDownload(ctx context.Context, file *repository
 			}
 
 			if !resp.Exists {
+				m.queueRepair(ctx, fp, repository.PartStatusMissing)
 				errs <- fmt.Errorf("file part doens't exist: %s", fp.ID)
 				return
 			}
@@ -271,15 +803,94 @@ func (m *manager) prepareLoaderForDownload(ctx context.Context, file *repository
 	wg.Wait()
 
 	close(errs)
-	if err = helpers.ReadErrors(errs); err != nil {
-		return nil, err
-	}
+	err = helpers.ReadErrors(errs)
+
+	ldr.SortFileParts()
 
-	if ldr.LenFileParts() != len(fileParts) {
+	// a lost replica is fine as long as every part has another one,
+	// a lost shard is fine as long as the file can be rebuilt
+	enough := hasAllSeqs(ldr.GetFileParts(), fileParts)
+	if file.Encoding == repository.FileEncodingErasure {
+		enough = ldr.LenFileParts() >= file.DataShards
+	}
+	if !enough {
+		if err != nil {
+			return nil, err
+		}
 		return nil, fmt.Errorf("not enough parts")
 	}
-
-	ldr.SortFileParts()
+	if err != nil {
+		m.log.With("err", err).Warnf("file %s has unavailable replicas", file.ID)
+	}
 
 	return ldr, nil
 }
+
+// queueRepair makes the repairer restore a part found lost while the file is read.
+func (m *manager) queueRepair(ctx context.Context, fp repository.FilePart, reason repository.PartStatus) {
+	repair := repository.NewPartRepair(fp.ID, reason)
+	if err := m.repo.CreatePartRepair(ctx, &repair); err != nil {
+		m.log.With("err", err).Error("failed to create part repair")
+	}
+}
+
+// hasAllSeqs reports whether every seq of the stored parts has at least one available replica.
+func hasAllSeqs(available []FilePart, stored []*repository.FilePart) bool {
+	seqs := make(map[int]bool, len(available))
+	for _, fp := range available {
+		seqs[fp.Seq] = true
+	}
+	for _, fp := range stored {
+		if !seqs[fp.Seq] {
+			return false
+		}
+	}
+	return true
+}
+
+// lockKeys takes the keys, waiting up to wait while they're busy, and renews their leases
+// until the returned function is called. The returned context is cancelled if they're lost.
+func lockKeys(
+	ctx context.Context,
+	log *zap.SugaredLogger,
+	c cache.Cache,
+	wait time.Duration,
+	keys []string,
+) (context.Context, func(), error) {
+	var token string
+	var err error
+	if wait > 0 {
+		waitCtx, cancel := context.WithTimeout(ctx, wait)
+		token, err = c.LockContext(waitCtx, keys)
+		cancel()
+	} else {
+		token, err = c.Lock(keys)
+	}
+	if err != nil {
+		return nil, nil, ErrBusy
+	}
+
+	ctx, unlock := cache.Hold(ctx, log, c, token, keys)
+	return ctx, unlock, nil
+}
+
+// runLeased runs a pass of the background job while it holds the cluster-wide lease
+// of the job, so every job runs on one uploader at a time. The pass is skipped when
+// another uploader holds the lease and cancelled once the lease is lost. It returns
+// whether the pass ran.
+func runLeased(
+	ctx context.Context,
+	log *zap.SugaredLogger,
+	c cache.Cache,
+	job string,
+	pass func(ctx context.Context),
+) bool {
+	ctx, unlock, err := lockKeys(ctx, log, c, 0, []string{"job:" + job})
+	if err != nil {
+		return false
+	}
+	defer unlock()
+
+	pass(ctx)
+	return true
+}
@@ -0,0 +1,31 @@
+package manager
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/blkmlk/file-storage/internal/services/cache"
+)
+
+func TestRunLeased(t *testing.T) {
+	ctx := context.Background()
+	log := zap.NewNop().Sugar()
+	c := cache.NewMapCache()
+
+	ran := runLeased(ctx, log, c, "scrubber", func(ctx context.Context) {
+		// another uploader skips the job while the lease is held
+		require.False(t, runLeased(ctx, log, c, "scrubber", func(context.Context) {
+			t.Error("the job runs twice at a time")
+		}))
+
+		// other jobs have leases of their own
+		require.True(t, runLeased(ctx, log, c, "monitor", func(context.Context) {}))
+	})
+	require.True(t, ran)
+
+	// the lease is released after the pass
+	require.True(t, runLeased(ctx, log, c, "scrubber", func(context.Context) {}))
+}
@@ -0,0 +1,100 @@
+package manager
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/blkmlk/file-storage/env"
+	"github.com/blkmlk/file-storage/internal/services/cache"
+	"github.com/blkmlk/file-storage/internal/services/repository"
+)
+
+const (
+	DefaultStorageSuspectAfter = time.Second * 15
+	DefaultStorageDeadAfter    = time.Minute * 5
+	MonitorInterval            = time.Second * 5
+)
+
+// monitorMetrics counts storages declared dead and the parts queued for repair because of them.
+var monitorMetrics = expvar.NewMap("monitor")
+
+// Monitor tracks the liveness of storages by their heartbeats. A storage which stops
+// sending them becomes suspect and gets no new parts, and once it's dead all its parts
+// are queued for repair.
+type Monitor interface {
+	Run(ctx context.Context) error
+}
+
+func NewMonitor(
+	log *zap.SugaredLogger,
+	repo repository.Repository,
+	cache cache.Cache,
+) (Monitor, error) {
+	suspectAfter, err := time.ParseDuration(env.GetOptional(env.StorageSuspectAfter, DefaultStorageSuspectAfter.String()))
+	if err != nil || suspectAfter <= 0 {
+		return nil, fmt.Errorf("%s is not a positive duration", env.StorageSuspectAfter)
+	}
+
+	deadAfter, err := time.ParseDuration(env.GetOptional(env.StorageDeadAfter, DefaultStorageDeadAfter.String()))
+	if err != nil || deadAfter < suspectAfter {
+		return nil, fmt.Errorf("%s is not a duration longer than %s", env.StorageDeadAfter, env.StorageSuspectAfter)
+	}
+
+	return &monitor{
+		log:          log,
+		repo:         repo,
+		cache:        cache,
+		suspectAfter: suspectAfter,
+		deadAfter:    deadAfter,
+	}, nil
+}
+
+type monitor struct {
+	log          *zap.SugaredLogger
+	repo         repository.Repository
+	cache        cache.Cache
+	suspectAfter time.Duration
+	deadAfter    time.Duration
+}
+
+func (m *monitor) Run(ctx context.Context) error {
+	ticker := time.NewTicker(MonitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		runLeased(ctx, m.log, m.cache, "monitor", m.updateStates)
+	}
+}
+
+// updateStates moves storages which stopped sending heartbeats to the suspect
+// and dead states and queues the parts of the dead ones for repair.
+func (m *monitor) updateStates(ctx context.Context) {
+	now := time.Now()
+	dead, err := m.repo.UpdateStorageStates(ctx, now.Add(-m.suspectAfter), now.Add(-m.deadAfter))
+	if err != nil {
+		m.log.With("err", err).Error("failed to update storage states")
+		return
+	}
+
+	for _, s := range dead {
+		m.log.Errorf("storage %s on %s is dead, last seen at %s", s.ID, s.Host, s.LastSeenAt.Format(time.RFC3339))
+		monitorMetrics.Add("dead", 1)
+
+		queued, err := m.repo.CreateStorageRepairs(ctx, s.ID)
+		if err != nil {
+			m.log.With("err", err).Errorf("failed to queue parts of storage %s for repair", s.ID)
+			continue
+		}
+		monitorMetrics.Add("queued", queued)
+	}
+}
@@ -0,0 +1,329 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/blkmlk/file-storage/internal/services/repository"
+)
+
+const (
+	MaxUploadPartNumber = 10000
+)
+
+var (
+	ErrUploadNotFound    = errors.New("upload not found")
+	ErrInvalidPartNumber = errors.New("invalid part number")
+	ErrPartNotFound      = errors.New("part not found")
+)
+
+// UploadedPart describes a part of a multipart upload. Every part is kept as one
+// file part with seq equal to its number, so parts may be uploaded in any order.
+type UploadedPart struct {
+	Number int
+	Size   int64
+	Hash   string
+	MD5    string
+}
+
+func (m *manager) InitiateUpload(ctx context.Context, info FileInfo) (string, error) {
+	replicas := m.replicas
+	if info.Replicas > 0 {
+		replicas = info.Replicas
+	}
+
+	// the name is reserved until the upload is completed or aborted
+	file := repository.NewFile()
+	file.Name = &info.Name
+	file.ContentType = info.ContentType
+	file.Replicas = replicas
+	file.Status = repository.FileStatusUploading
+	// an upload which replaces the file of the name, or adds a version of it,
+	// doesn't hold the name until it's completed
+	file.Noncurrent = m.versioning || info.Overwrite
+
+	if err := m.repo.CreateFile(ctx, &file); err != nil {
+		if errors.Is(err, repository.ErrAlreadyExists) {
+			return "", ErrExists
+		}
+		return "", err
+	}
+	return file.ID, nil
+}
+
+func (m *manager) UploadPart(ctx context.Context, uploadID string, number int, size int64, reader io.Reader) (*UploadedPart, error) {
+	if number < 1 || number > MaxUploadPartNumber {
+		return nil, ErrInvalidPartNumber
+	}
+
+	ctx, unlock, err := lockKeys(ctx, m.log, m.cache, m.lockWait, []string{fmt.Sprintf("%s/%d", uploadID, number)})
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	file, err := m.getUpload(ctx, uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	ldr, err := m.prepareLoaderForPart(ctx, number, size, file.Replicas)
+	if err != nil {
+		return nil, err
+	}
+
+	sums := newChecksumReader(reader, Checksums{})
+	err = ldr.Upload(ctx, sums)
+	m.cleanupUpload(ldr, err)
+	if err != nil {
+		return nil, err
+	}
+
+	fileParts := ldr.GetFileParts()
+	dbFileParts := make([]repository.FilePart, 0, len(fileParts))
+	for _, fp := range fileParts {
+		part := repository.NewFilePart(file.ID, fp.RemoteID, fp.Seq, fp.Size, fp.StorageID, fp.Hash)
+		part.MD5 = sums.MD5()
+		dbFileParts = append(dbFileParts, part)
+	}
+
+	// a part uploaded again replaces the previous one
+	deletions, err := m.repo.ReplaceFileParts(ctx, file.ID, []int{number}, dbFileParts)
+	if err != nil {
+		m.discardFileParts(fileParts)
+		// the upload was completed or aborted while the part was uploaded
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, ErrUploadNotFound
+		}
+		return nil, err
+	}
+	deleteParts(ctx, m.log, m.repo, m.clientFactory, deletions)
+
+	return &UploadedPart{
+		Number: number,
+		Size:   fileParts[0].Size,
+		Hash:   fileParts[0].Hash,
+		MD5:    sums.MD5(),
+	}, nil
+}
+
+func (m *manager) ListParts(ctx context.Context, uploadID string) ([]UploadedPart, error) {
+	file, err := m.getUpload(ctx, uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.listParts(ctx, file.ID)
+}
+
+// CompleteUpload makes the file available by its name. When numbers are given,
+// only these parts make up the file and the others are deleted.
+func (m *manager) CompleteUpload(ctx context.Context, uploadID string, numbers []int) error {
+	ctx, unlock, err := lockKeys(ctx, m.log, m.cache, m.lockWait, []string{uploadID})
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	file, err := m.getUpload(ctx, uploadID)
+	if err != nil {
+		return err
+	}
+
+	// parts being uploaded lock only their numbers, so the upload stops taking
+	// parts before they are listed and goes back to uploading if it fails
+	if err = m.closeUpload(ctx, file.ID); err != nil {
+		return err
+	}
+	completed := false
+	defer func() {
+		if completed {
+			return
+		}
+		err := m.repo.UpdateFileStatus(context.Background(), file.ID, repository.FileStatusCompleting, repository.FileStatusUploading)
+		if err != nil {
+			m.log.With("err", err).Errorf("failed to reopen upload %s", file.ID)
+		}
+	}()
+
+	parts, err := m.listParts(ctx, file.ID)
+	if err != nil {
+		return err
+	}
+
+	if len(numbers) > 0 {
+		listed := make(map[int]bool, len(numbers))
+		for _, n := range numbers {
+			listed[n] = true
+		}
+
+		var kept []UploadedPart
+		var unlisted []int
+		for _, p := range parts {
+			if listed[p.Number] {
+				kept = append(kept, p)
+				delete(listed, p.Number)
+			} else {
+				unlisted = append(unlisted, p.Number)
+			}
+		}
+		if len(listed) > 0 {
+			return ErrPartNotFound
+		}
+
+		if len(unlisted) > 0 {
+			deletions, err := m.repo.ReplaceFileParts(ctx, file.ID, unlisted, nil)
+			if err != nil {
+				return err
+			}
+			deleteParts(ctx, m.log, m.repo, m.clientFactory, deletions)
+		}
+		parts = kept
+	}
+
+	if len(parts) == 0 {
+		return ErrPartNotFound
+	}
+
+	var size int64
+	for _, p := range parts {
+		size += p.Size
+	}
+
+	mode := repository.ReplaceNone
+	switch {
+	case file.Noncurrent && m.versioning:
+		mode = repository.ReplaceSupersede
+	case file.Noncurrent:
+		mode = repository.ReplaceDelete
+	}
+
+	replaced, deletions, err := m.repo.ReplaceFile(ctx, file.ID, repository.UpdateFileInfoInput{
+		Name:        *file.Name,
+		ContentType: file.ContentType,
+		Size:        size,
+		Hash:        multipartHash(parts),
+		MD5:         multipartMD5(parts),
+		Replicas:    file.Replicas,
+		Encoding:    repository.FileEncodingReplication,
+		Status:      repository.FileStatusUploaded,
+	}, mode, nil)
+	if err != nil {
+		return err
+	}
+	completed = true
+	m.reads.remove(replaced)
+
+	deleteParts(ctx, m.log, m.repo, m.clientFactory, deletions)
+
+	return nil
+}
+
+func (m *manager) AbortUpload(ctx context.Context, uploadID string) error {
+	ctx, unlock, err := lockKeys(ctx, m.log, m.cache, m.lockWait, []string{uploadID})
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	file, err := m.getUpload(ctx, uploadID)
+	if err != nil {
+		return err
+	}
+
+	// parts still being uploaded are discarded instead of outliving the file
+	if err = m.closeUpload(ctx, file.ID); err != nil {
+		return err
+	}
+
+	deletions, err := m.repo.DeleteFile(ctx, file.ID)
+	if err != nil {
+		return err
+	}
+	deleteParts(ctx, m.log, m.repo, m.clientFactory, deletions)
+
+	return nil
+}
+
+func (m *manager) getUpload(ctx context.Context, uploadID string) (*repository.File, error) {
+	file, err := m.repo.GetFile(ctx, uploadID)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return nil, ErrUploadNotFound
+		}
+		return nil, err
+	}
+
+	if file.Status != repository.FileStatusUploading {
+		return nil, ErrUploadNotFound
+	}
+	return file, nil
+}
+
+// closeUpload makes the upload refuse new parts, it waits for the parts being saved.
+func (m *manager) closeUpload(ctx context.Context, fileID string) error {
+	err := m.repo.UpdateFileStatus(ctx, fileID, repository.FileStatusUploading, repository.FileStatusCompleting)
+	if errors.Is(err, repository.ErrNotFound) {
+		return ErrUploadNotFound
+	}
+	return err
+}
+
+func (m *manager) listParts(ctx context.Context, fileID string) ([]UploadedPart, error) {
+	fileParts, err := m.repo.FindFileParts(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[int]bool, len(fileParts))
+	parts := make([]UploadedPart, 0, len(fileParts))
+	for _, fp := range fileParts {
+		if seen[fp.Seq] {
+			continue
+		}
+		seen[fp.Seq] = true
+
+		parts = append(parts, UploadedPart{
+			Number: fp.Seq,
+			Size:   fp.Size,
+			Hash:   fp.Hash,
+			MD5:    fp.MD5,
+		})
+	}
+
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].Number < parts[j].Number
+	})
+
+	return parts, nil
+}
+
+// prepareLoaderForPart places the whole part on the given number of storages
+// picked by the placement policy.
+func (m *manager) prepareLoaderForPart(ctx context.Context, seq int, size int64, replicas int) (*loader, error) {
+	ready, err := m.reserveStorages(ctx, size, 1, replicas)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ready) < replicas {
+		m.releaseStorages(ready)
+		return nil, fmt.Errorf("not enough storages for %d replicas", replicas)
+	}
+
+	ldr := NewLoader(m.log, size)
+	ldr.SetFailover(m.replaceFilePart, m.uploadRetries, m.uploadRetryBackoff)
+	for _, rs := range ready[:replicas] {
+		ldr.AddFilePart(&FilePart{
+			Seq:       seq,
+			RemoteID:  rs.remoteIDs[0],
+			StorageID: rs.storage.ID,
+			Client:    rs.client,
+		})
+	}
+
+	return ldr, nil
+}
@@ -0,0 +1,214 @@
+package manager
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/blkmlk/file-storage/env"
+	"github.com/blkmlk/file-storage/internal/services/repository"
+)
+
+const (
+	PlacementRoundRobin = "round-robin"
+	PlacementWeighted   = "weighted"
+	PlacementRandom     = "random-k"
+	PlacementZone       = "zone"
+)
+
+// PlacementPolicy decides which storages take the parts of a file. Parts go to the
+// first storages of the order which are ready to take them.
+type PlacementPolicy interface {
+	// Order returns the storages in the order they should take parts. The storages
+	// in avoid keep other copies of the parts, they aren't among the given ones.
+	Order(storages []*repository.Storage, avoid []*repository.Storage) []*repository.Storage
+}
+
+// NewPlacementPolicy returns the policy set by PLACEMENT_POLICY, weighted by default.
+func NewPlacementPolicy() (PlacementPolicy, error) {
+	switch name := env.GetOptional(env.PlacementPolicy, PlacementWeighted); name {
+	case PlacementRoundRobin:
+		return &roundRobinPolicy{}, nil
+	case PlacementWeighted:
+		return weightedPolicy{}, nil
+	case PlacementRandom:
+		return randomPolicy{}, nil
+	case PlacementZone:
+		return zonePolicy{}, nil
+	default:
+		return nil, fmt.Errorf("%s is unknown: %s", env.PlacementPolicy, name)
+	}
+}
+
+// roundRobinPolicy starts every file on the storage next to the one the previous file
+// started on, so files are spread evenly whatever their size.
+type roundRobinPolicy struct {
+	locker sync.Mutex
+	next   int
+}
+
+func (p *roundRobinPolicy) Order(storages []*repository.Storage, _ []*repository.Storage) []*repository.Storage {
+	if len(storages) == 0 {
+		return nil
+	}
+
+	sorted := append([]*repository.Storage(nil), storages...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	p.locker.Lock()
+	start := p.next % len(sorted)
+	p.next = start + 1
+	p.locker.Unlock()
+
+	return append(sorted[start:], sorted[:start]...)
+}
+
+// weightedPolicy picks storages at random weighted by their free space,
+// so small storages don't fill up first.
+type weightedPolicy struct{}
+
+func (weightedPolicy) Order(storages []*repository.Storage, _ []*repository.Storage) []*repository.Storage {
+	weights := make([]int64, len(storages))
+	for i, s := range storages {
+		weights[i] = s.FreeBytes
+	}
+
+	result := make([]*repository.Storage, 0, len(storages))
+	for _, i := range weightedOrder(weights) {
+		result = append(result, storages[i])
+	}
+	return result
+}
+
+// randomPolicy picks storages uniformly at random. Together with PLACEMENT_SPAN
+// it places every file on k random storages.
+type randomPolicy struct{}
+
+func (randomPolicy) Order(storages []*repository.Storage, _ []*repository.Storage) []*repository.Storage {
+	result := append([]*repository.Storage(nil), storages...)
+	rand.Shuffle(len(result), func(i, j int) {
+		result[i], result[j] = result[j], result[i]
+	})
+	return result
+}
+
+// zonePolicy takes storages from every zone in turn, so the first storages of the
+// order are in different zones. Zones of the storages to avoid go last. Within a zone
+// storages are weighted by their free space. Replicas of a part are spread over
+// zones by assignReplicas.
+type zonePolicy struct{}
+
+func (zonePolicy) Order(storages []*repository.Storage, avoid []*repository.Storage) []*repository.Storage {
+	avoided := make(map[string]bool, len(avoid))
+	for _, s := range avoid {
+		avoided[s.Zone] = true
+	}
+
+	var zones []string
+	byZone := make(map[string][]*repository.Storage)
+	for _, s := range (weightedPolicy{}).Order(storages, nil) {
+		if _, ok := byZone[s.Zone]; !ok {
+			zones = append(zones, s.Zone)
+		}
+		byZone[s.Zone] = append(byZone[s.Zone], s)
+	}
+
+	sort.SliceStable(zones, func(i, j int) bool {
+		return !avoided[zones[i]] && avoided[zones[j]]
+	})
+
+	result := make([]*repository.Storage, 0, len(storages))
+	for len(result) < len(storages) {
+		for _, zone := range zones {
+			if len(byZone[zone]) == 0 {
+				continue
+			}
+			result = append(result, byZone[zone][0])
+			byZone[zone] = byZone[zone][1:]
+		}
+	}
+	return result
+}
+
+// assignReplicas places the replicas of as many parts as there are storages, so that
+// every storage keeps the given number of replicas of distinct parts. The replicas of
+// a part go to distinct zones whenever the zones have room for it, and earlier storages
+// are preferred. It returns the indices of the storages of every part.
+func assignReplicas(zones []string, replicas int) [][]int {
+	left := make([]int, len(zones))
+	zoneLeft := make(map[string]int)
+	for i, zone := range zones {
+		left[i] = replicas
+		zoneLeft[zone] += replicas
+	}
+
+	result := make([][]int, len(zones))
+	for seq := range result {
+		taken := make(map[int]bool, replicas)
+		inZone := make(map[string]bool, replicas)
+		take := func(i int) {
+			taken[i] = true
+			inZone[zones[i]] = true
+			left[i]--
+			zoneLeft[zones[i]]--
+			result[seq] = append(result[seq], i)
+		}
+
+		// a storage with as many replicas left as parts must take every part,
+		// otherwise its replicas can't go to distinct parts
+		parts := len(zones) - seq
+		for i := range zones {
+			if left[i] == parts {
+				take(i)
+			}
+		}
+
+		// the zones with the most replicas left go first, they are the hardest to spread
+		better := func(i, j int) bool {
+			if inZone[zones[i]] != inZone[zones[j]] {
+				return !inZone[zones[i]]
+			}
+			if zoneLeft[zones[i]] != zoneLeft[zones[j]] {
+				return zoneLeft[zones[i]] > zoneLeft[zones[j]]
+			}
+			return left[i] > left[j]
+		}
+		for len(result[seq]) < replicas {
+			best := -1
+			for i := range zones {
+				if taken[i] || left[i] == 0 {
+					continue
+				}
+				if best < 0 || better(i, best) {
+					best = i
+				}
+			}
+			take(best)
+		}
+	}
+	return result
+}
+
+// weightedOrder returns a random order of indices where an index comes first with
+// a probability proportional to its weight. Unknown weights count as the smallest one.
+func weightedOrder(weights []int64) []int {
+	keys := make([]float64, len(weights))
+	order := make([]int, len(weights))
+	for i, w := range weights {
+		if w < 1 {
+			w = 1
+		}
+		// the smallest of exponential variables with the given rates wins
+		// with a probability proportional to its rate
+		keys[i] = rand.ExpFloat64() / float64(w)
+		order[i] = i
+	}
+
+	sort.Slice(order, func(i, j int) bool {
+		return keys[order[i]] < keys[order[j]]
+	})
+	return order
+}
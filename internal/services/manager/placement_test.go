@@ -0,0 +1,169 @@
+package manager
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/blkmlk/file-storage/env"
+	"github.com/blkmlk/file-storage/internal/services/repository"
+)
+
+func TestWeightedOrder(t *testing.T) {
+	weights := []int64{1 << 30, 1 << 20, 0}
+
+	first := make(map[int]int)
+	for i := 0; i < 1000; i++ {
+		order := weightedOrder(weights)
+
+		sorted := append([]int(nil), order...)
+		sort.Ints(sorted)
+		require.Equal(t, []int{0, 1, 2}, sorted)
+
+		first[order[0]]++
+	}
+
+	// the storage with a thousand times more free space almost always goes first
+	require.Greater(t, first[0], 950)
+	require.Less(t, first[2], 10)
+}
+
+func testStorages(zones ...string) []*repository.Storage {
+	storages := make([]*repository.Storage, 0, len(zones))
+	for i, zone := range zones {
+		storages = append(storages, &repository.Storage{
+			ID:   strconv.Itoa(i),
+			Zone: zone,
+		})
+	}
+	return storages
+}
+
+func storageIDs(storages []*repository.Storage) []string {
+	ids := make([]string, 0, len(storages))
+	for _, s := range storages {
+		ids = append(ids, s.ID)
+	}
+	return ids
+}
+
+func TestNewPlacementPolicy(t *testing.T) {
+	for _, name := range []string{PlacementRoundRobin, PlacementWeighted, PlacementRandom, PlacementZone} {
+		t.Setenv(env.PlacementPolicy, name)
+		_, err := NewPlacementPolicy()
+		require.NoError(t, err)
+	}
+
+	t.Setenv(env.PlacementPolicy, "unknown")
+	_, err := NewPlacementPolicy()
+	require.Error(t, err)
+}
+
+func TestRoundRobinPolicy(t *testing.T) {
+	policy := &roundRobinPolicy{}
+	storages := testStorages("", "", "")
+
+	require.Equal(t, []string{"0", "1", "2"}, storageIDs(policy.Order(storages, nil)))
+	require.Equal(t, []string{"1", "2", "0"}, storageIDs(policy.Order(storages, nil)))
+	require.Equal(t, []string{"2", "0", "1"}, storageIDs(policy.Order(storages, nil)))
+	require.Equal(t, []string{"1", "0"}, storageIDs(policy.Order(storages[:2], nil)))
+}
+
+func TestRandomPolicy(t *testing.T) {
+	ordered := randomPolicy{}.Order(testStorages("", "", "", ""), nil)
+
+	ids := storageIDs(ordered)
+	sort.Strings(ids)
+	require.Equal(t, []string{"0", "1", "2", "3"}, ids)
+}
+
+func TestZonePolicy(t *testing.T) {
+	storages := testStorages("a", "a", "a", "b", "b", "c")
+
+	// neighbours are in different zones until a zone runs out of storages
+	ordered := zonePolicy{}.Order(storages, nil)
+	require.Len(t, ordered, len(storages))
+	for i := 1; i < 3; i++ {
+		require.NotEqual(t, ordered[i-1].Zone, ordered[i].Zone)
+	}
+	for i := 3; i < 5; i++ {
+		require.NotEqual(t, ordered[i-1].Zone, ordered[i].Zone)
+	}
+
+	// zones of the other copies go last
+	avoid := testStorages("a", "b")
+	ordered = zonePolicy{}.Order(storages, avoid)
+	require.Equal(t, "c", ordered[0].Zone)
+}
+
+// checkReplicas checks that every storage keeps the given number of replicas of distinct
+// parts and returns how many parts have more than one replica in a zone.
+func checkReplicas(t *testing.T, zones []string, replicas int, assigned [][]int) int {
+	require.Len(t, assigned, len(zones))
+
+	used := make([]int, len(zones))
+	crowded := 0
+	for seq, storages := range assigned {
+		require.Len(t, storages, replicas, "part %d", seq)
+
+		seen := make(map[int]bool)
+		inZone := make(map[string]bool)
+		for _, i := range storages {
+			require.False(t, seen[i], "part %d has two replicas on storage %d", seq, i)
+			seen[i] = true
+			used[i]++
+
+			if inZone[zones[i]] {
+				crowded++
+			}
+			inZone[zones[i]] = true
+		}
+	}
+	for i := range used {
+		require.Equal(t, replicas, used[i], "storage %d", i)
+	}
+	return crowded
+}
+
+func TestAssignReplicas(t *testing.T) {
+	// the order of the zone policy, the last part wraps around to the first storages
+	zones := []string{"a", "b", "c", "a", "b", "a"}
+	require.Zero(t, checkReplicas(t, zones, 2, assignReplicas(zones, 2)))
+
+	// a storage of zone c isn't ready, so the zones don't interleave any more
+	zones = []string{"a", "b", "a", "b", "c", "a", "c", "b"}
+	require.Zero(t, checkReplicas(t, zones, 2, assignReplicas(zones, 2)))
+
+	// zone a can't have fewer than two replicas of some part
+	zones = []string{"a", "b", "a", "a"}
+	require.Equal(t, 2, checkReplicas(t, zones, 2, assignReplicas(zones, 2)))
+
+	// without zones every part still gets distinct storages
+	zones = []string{"", "", "", ""}
+	checkReplicas(t, zones, 3, assignReplicas(zones, 3))
+
+	// whenever every zone has at most one replica per part, parts don't share zones
+	names := []string{"a", "b", "c", "d"}
+	for i := 0; i < 1000; i++ {
+		zones := make([]string, 1+rand.Intn(12))
+		count := make(map[string]int)
+		for j := range zones {
+			zones[j] = names[rand.Intn(len(names))]
+			count[zones[j]]++
+		}
+		replicas := 1 + rand.Intn(len(zones))
+
+		spreadable := len(count) >= replicas
+		for _, c := range count {
+			spreadable = spreadable && c*replicas <= len(zones)
+		}
+
+		crowded := checkReplicas(t, zones, replicas, assignReplicas(zones, replicas))
+		if spreadable {
+			require.Zero(t, crowded, "zones %v, %d replicas", zones, replicas)
+		}
+	}
+}
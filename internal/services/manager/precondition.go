@@ -0,0 +1,60 @@
+package manager
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/blkmlk/file-storage/internal/services/repository"
+)
+
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// Precondition makes a write fail with ErrPreconditionFailed unless the current file
+// of the name matches it. It's checked when the file takes the name, so concurrent
+// writers of the name don't need to lock it.
+type Precondition struct {
+	// IfMatch lists the ETags one of which the current file must have, "*" matches any file
+	IfMatch []string
+	// IfNoneMatch lists the ETags the current file mustn't have, "*" requires that there's no file
+	IfNoneMatch []string
+}
+
+// check tests the current file of the name, which is nil when there's none.
+func (p Precondition) check(current *repository.File) error {
+	if len(p.IfMatch) > 0 && !matchETags(p.IfMatch, current, false) {
+		return ErrPreconditionFailed
+	}
+	if len(p.IfNoneMatch) > 0 && matchETags(p.IfNoneMatch, current, true) {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+// matchETags reports whether the file has one of the ETags. The ETag of a file is its hash,
+// or its ID when the hash isn't known, and its MD5 for S3 clients. If-Match compares ETags strongly, so a weak one never
+// matches, and If-None-Match compares them weakly (RFC 9110, section 8.8.3.2).
+func matchETags(etags []string, file *repository.File, weak bool) bool {
+	if file == nil {
+		return false
+	}
+
+	etag := file.Hash
+	if etag == "" {
+		etag = file.ID
+	}
+
+	for _, e := range etags {
+		e = strings.TrimSpace(e)
+		if strings.HasPrefix(e, "W/") {
+			if !weak {
+				continue
+			}
+			e = strings.TrimPrefix(e, "W/")
+		}
+		e = strings.Trim(e, `"`)
+		if e == "*" || e == etag || (file.MD5 != "" && e == file.MD5) {
+			return true
+		}
+	}
+	return false
+}
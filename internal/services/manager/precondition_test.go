@@ -0,0 +1,47 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/blkmlk/file-storage/internal/services/repository"
+)
+
+func TestPrecondition(t *testing.T) {
+	file := &repository.File{ID: "id", Hash: "hash", MD5: "md5"}
+	unhashed := &repository.File{ID: "id"}
+
+	tests := []struct {
+		name         string
+		precondition Precondition
+		current      *repository.File
+		ok           bool
+	}{
+		{name: "none", current: file, ok: true},
+		{name: "none without file", ok: true},
+		{name: "if-none-match any without file", precondition: Precondition{IfNoneMatch: []string{"*"}}, ok: true},
+		{name: "if-none-match any", precondition: Precondition{IfNoneMatch: []string{"*"}}, current: file},
+		{name: "if-none-match other", precondition: Precondition{IfNoneMatch: []string{`"other"`}}, current: file, ok: true},
+		{name: "if-none-match same", precondition: Precondition{IfNoneMatch: []string{`"hash"`}}, current: file},
+		{name: "if-none-match weak", precondition: Precondition{IfNoneMatch: []string{`W/"hash"`}}, current: file},
+		{name: "if-match any", precondition: Precondition{IfMatch: []string{"*"}}, current: file, ok: true},
+		{name: "if-match any without file", precondition: Precondition{IfMatch: []string{"*"}}},
+		{name: "if-match same", precondition: Precondition{IfMatch: []string{`"other"`, `"hash"`}}, current: file, ok: true},
+		{name: "if-match weak", precondition: Precondition{IfMatch: []string{`W/"hash"`}}, current: file},
+		{name: "if-match md5", precondition: Precondition{IfMatch: []string{`"md5"`}}, current: file, ok: true},
+		{name: "if-match other", precondition: Precondition{IfMatch: []string{`"other"`}}, current: file},
+		{name: "if-match id without hash", precondition: Precondition{IfMatch: []string{`"id"`}}, current: unhashed, ok: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.precondition.check(tt.current)
+			if tt.ok {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, ErrPreconditionFailed)
+			}
+		})
+	}
+}
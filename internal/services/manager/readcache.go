@@ -0,0 +1,162 @@
+package manager
+
+import (
+	"container/list"
+	"expvar"
+	"sync"
+)
+
+const (
+	DefaultReadCacheMaxObject = 1 << 20
+)
+
+// readCacheMetrics counts hits and misses of the read cache, evictions and the bytes it keeps.
+var readCacheMetrics = expvar.NewMap("readcache")
+
+func init() {
+	readCacheMetrics.Set("hit_rate", expvar.Func(func() any {
+		hits, misses := metricValue(readCacheMetrics, "hits"), metricValue(readCacheMetrics, "misses")
+		if hits+misses == 0 {
+			return 0.0
+		}
+		return float64(hits) / float64(hits+misses)
+	}))
+}
+
+func metricValue(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// readCache keeps the content of small files in memory and evicts the least recently
+// used ones when it's full. Files are keyed by their ID and hash, so an entry is
+// never stale: a changed file has another hash and a deleted one isn't looked up.
+type readCache struct {
+	locker    sync.Mutex
+	maxBytes  int64
+	maxObject int64
+	size      int64
+	order     *list.List
+	entries   map[string]*list.Element
+	// byFile indexes the entries by file, so the entries of a file are removed at once
+	byFile map[string][]*list.Element
+}
+
+type readCacheEntry struct {
+	key    string
+	fileID string
+	data   []byte
+}
+
+// newReadCache returns nil when maxBytes isn't positive, a nil cache keeps nothing.
+func newReadCache(maxBytes, maxObject int64) *readCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	if maxObject > maxBytes {
+		maxObject = maxBytes
+	}
+
+	return &readCache{
+		maxBytes:  maxBytes,
+		maxObject: maxObject,
+		order:     list.New(),
+		entries:   make(map[string]*list.Element),
+		byFile:    make(map[string][]*list.Element),
+	}
+}
+
+// fits reports whether a file of the size is kept by the cache.
+func (c *readCache) fits(size int64, hash string) bool {
+	return c != nil && hash != "" && size <= c.maxObject
+}
+
+func (c *readCache) get(fileID, hash string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	el, ok := c.entries[readCacheKey(fileID, hash)]
+	if !ok {
+		readCacheMetrics.Add("misses", 1)
+		return nil, false
+	}
+
+	readCacheMetrics.Add("hits", 1)
+	c.order.MoveToFront(el)
+	return el.Value.(*readCacheEntry).data, true
+}
+
+func (c *readCache) add(fileID, hash string, data []byte) {
+	if !c.fits(int64(len(data)), hash) {
+		return
+	}
+
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	key := readCacheKey(fileID, hash)
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+
+	for c.size+int64(len(data)) > c.maxBytes {
+		c.removeElement(c.order.Back())
+		readCacheMetrics.Add("evictions", 1)
+	}
+
+	el := c.order.PushFront(&readCacheEntry{
+		key:    key,
+		fileID: fileID,
+		data:   data,
+	})
+	c.entries[key] = el
+	c.byFile[fileID] = append(c.byFile[fileID], el)
+	c.size += int64(len(data))
+	readCacheMetrics.Add("bytes", int64(len(data)))
+}
+
+// remove drops all the entries of the file.
+func (c *readCache) remove(fileID string) {
+	if c == nil {
+		return
+	}
+
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	for len(c.byFile[fileID]) > 0 {
+		c.removeElement(c.byFile[fileID][0])
+	}
+}
+
+func (c *readCache) removeElement(el *list.Element) {
+	entry := c.order.Remove(el).(*readCacheEntry)
+	delete(c.entries, entry.key)
+
+	// a file has an entry per hash it had while it was read, that's rarely more than one
+	elements := c.byFile[entry.fileID]
+	for i := range elements {
+		if elements[i] == el {
+			elements = append(elements[:i], elements[i+1:]...)
+			break
+		}
+	}
+	if len(elements) == 0 {
+		delete(c.byFile, entry.fileID)
+	} else {
+		c.byFile[entry.fileID] = elements
+	}
+
+	c.size -= int64(len(entry.data))
+	readCacheMetrics.Add("bytes", -int64(len(entry.data)))
+}
+
+func readCacheKey(fileID, hash string) string {
+	return fileID + "/" + hash
+}
@@ -0,0 +1,69 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadCache(t *testing.T) {
+	c := newReadCache(10, 4)
+
+	require.True(t, c.fits(4, "hash"))
+	require.False(t, c.fits(5, "hash"))
+	require.False(t, c.fits(1, ""))
+
+	c.add("file-1", "hash-1", []byte("1111"))
+	c.add("file-2", "hash-2", []byte("2222"))
+	c.add("file-3", "hash-3", []byte("33333"))
+
+	data, ok := c.get("file-1", "hash-1")
+	require.True(t, ok)
+	require.Equal(t, []byte("1111"), data)
+
+	// another hash is another content of the file
+	_, ok = c.get("file-1", "hash-0")
+	require.False(t, ok)
+
+	// file-2 is the least recently used one
+	c.add("file-3", "hash-3", []byte("333"))
+	_, ok = c.get("file-2", "hash-2")
+	require.False(t, ok)
+	_, ok = c.get("file-1", "hash-1")
+	require.True(t, ok)
+	require.Equal(t, int64(7), c.size)
+
+	c.remove("file-1")
+	_, ok = c.get("file-1", "hash-1")
+	require.False(t, ok)
+	_, ok = c.get("file-3", "hash-3")
+	require.True(t, ok)
+	require.Equal(t, int64(3), c.size)
+
+	// every content of the file is dropped
+	c.add("file-4", "hash-4", []byte("44"))
+	c.add("file-4", "hash-5", []byte("55"))
+	c.remove("file-4")
+	_, ok = c.get("file-4", "hash-4")
+	require.False(t, ok)
+	_, ok = c.get("file-4", "hash-5")
+	require.False(t, ok)
+	require.Equal(t, int64(3), c.size)
+
+	// evicted entries leave the index too
+	c.add("file-5", "hash-5", []byte("5555"))
+	c.add("file-6", "hash-6", []byte("6666"))
+	c.add("file-7", "hash-7", []byte("7777"))
+	require.Len(t, c.byFile, len(c.entries))
+}
+
+func TestReadCache_Disabled(t *testing.T) {
+	c := newReadCache(0, 4)
+	require.Nil(t, c)
+
+	require.False(t, c.fits(1, "hash"))
+	c.add("file-1", "hash-1", []byte("1"))
+	_, ok := c.get("file-1", "hash-1")
+	require.False(t, ok)
+	c.remove("file-1")
+}
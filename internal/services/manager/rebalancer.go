@@ -0,0 +1,449 @@
+package manager
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/blkmlk/file-storage/env"
+	"github.com/blkmlk/file-storage/internal/services/cache"
+	"github.com/blkmlk/file-storage/internal/services/repository"
+)
+
+const (
+	DefaultRebalanceInterval  = time.Minute * 10
+	DefaultRebalanceThreshold = 0.1
+	// DefaultRebalanceRate is the number of bytes moved per second
+	DefaultRebalanceRate = 16 << 20
+	RebalanceBatchSize   = 100
+)
+
+// rebalanceMetrics counts moved parts and bytes, failed moves and retired storages.
+var rebalanceMetrics = expvar.NewMap("rebalancer")
+
+// Rebalancer moves parts from the storages which are fuller than the others to the
+// emptiest ones, so new storages share the data which is stored already. It also moves
+// all the parts away from draining storages and retires them once they're empty.
+type Rebalancer interface {
+	Run(ctx context.Context) error
+	Progress() RebalanceProgress
+}
+
+// RebalanceProgress is the state of the current or the last rebalancing.
+type RebalanceProgress struct {
+	Running      bool
+	StartedAt    time.Time
+	FinishedAt   time.Time
+	PlannedBytes int64
+	MovedParts   int
+	MovedBytes   int64
+	FailedParts  int
+	LastError    string
+}
+
+func NewRebalancer(
+	log *zap.SugaredLogger,
+	repo repository.Repository,
+	cache cache.Cache,
+	clientFactory ClientFactory,
+	placement PlacementPolicy,
+) (Rebalancer, error) {
+	interval, err := time.ParseDuration(env.GetOptional(env.RebalanceInterval, DefaultRebalanceInterval.String()))
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("%s is not a positive duration", env.RebalanceInterval)
+	}
+
+	threshold, err := strconv.ParseFloat(env.GetOptional(env.RebalanceThreshold, strconv.FormatFloat(DefaultRebalanceThreshold, 'f', -1, 64)), 64)
+	if err != nil || threshold <= 0 || threshold >= 1 {
+		return nil, fmt.Errorf("%s is not a fraction in (0, 1)", env.RebalanceThreshold)
+	}
+
+	rate, err := strconv.ParseInt(env.GetOptional(env.RebalanceRate, strconv.Itoa(DefaultRebalanceRate)), 10, 64)
+	if err != nil || rate < 1 {
+		return nil, fmt.Errorf("%s is not positive integer", env.RebalanceRate)
+	}
+
+	return &rebalancer{
+		log:           log,
+		repo:          repo,
+		cache:         cache,
+		clientFactory: clientFactory,
+		placement:     placement,
+		interval:      interval,
+		threshold:     threshold,
+		rate:          rate,
+	}, nil
+}
+
+type rebalancer struct {
+	log           *zap.SugaredLogger
+	repo          repository.Repository
+	cache         cache.Cache
+	clientFactory ClientFactory
+	placement     PlacementPolicy
+	interval      time.Duration
+	// threshold is how far the usage of a storage may be from the average one
+	threshold float64
+	// rate is the number of bytes moved per second
+	rate int64
+
+	locker   sync.Mutex
+	progress RebalanceProgress
+}
+
+func (r *rebalancer) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		runLeased(ctx, r.log, r.cache, "rebalancer", func(ctx context.Context) {
+			if err := r.drainStorages(ctx); err != nil {
+				r.log.With("err", err).Error("failed to drain storages")
+			}
+
+			if err := r.rebalance(ctx); err != nil {
+				r.log.With("err", err).Error("failed to rebalance storages")
+			}
+		})
+	}
+}
+
+func (r *rebalancer) Progress() RebalanceProgress {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	return r.progress
+}
+
+func (r *rebalancer) update(fn func(p *RebalanceProgress)) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	fn(&r.progress)
+}
+
+// storageLoad is how many bytes a storage keeps over the average usage.
+// Storages which keep less than the average have a negative excess.
+type storageLoad struct {
+	storage *repository.Storage
+	excess  int64
+}
+
+// planRebalance returns the loads of the storages which report their capacity, the fullest
+// go first, and the number of bytes to move from the storages which are over the threshold.
+func planRebalance(storages []*repository.Storage, threshold float64) ([]*storageLoad, int64) {
+	var used, total int64
+	for _, s := range storages {
+		if s.TotalBytes > 0 {
+			used += s.UsedBytes
+			total += s.TotalBytes
+		}
+	}
+	if total == 0 {
+		return nil, 0
+	}
+	average := float64(used) / float64(total)
+
+	var (
+		loads   []*storageLoad
+		planned int64
+	)
+	for _, s := range storages {
+		if s.TotalBytes == 0 {
+			continue
+		}
+		load := &storageLoad{
+			storage: s,
+			excess:  s.UsedBytes - int64(average*float64(s.TotalBytes)),
+		}
+		if float64(load.excess) > threshold*float64(s.TotalBytes) {
+			planned += load.excess
+		}
+		loads = append(loads, load)
+	}
+
+	sort.Slice(loads, func(i, j int) bool {
+		return loads[i].excess > loads[j].excess
+	})
+	return loads, planned
+}
+
+// rebalance moves parts from the storages over the threshold until they get down to
+// the average usage. Parts go to the storages below the average.
+func (r *rebalancer) rebalance(ctx context.Context) error {
+	storages, err := r.repo.FindStorages(ctx)
+	if err != nil {
+		return err
+	}
+
+	loads, planned := planRebalance(storages, r.threshold)
+	if planned == 0 {
+		return nil
+	}
+
+	r.log.Infof("rebalancing %d bytes", planned)
+	r.update(func(p *RebalanceProgress) {
+		*p = RebalanceProgress{
+			Running:      true,
+			StartedAt:    time.Now(),
+			PlannedBytes: planned,
+		}
+	})
+	defer r.update(func(p *RebalanceProgress) {
+		p.Running = false
+		p.FinishedAt = time.Now()
+	})
+
+	for _, source := range loads {
+		if float64(source.excess) <= r.threshold*float64(source.storage.TotalBytes) {
+			break
+		}
+		if err = r.moveExcess(ctx, source, loads); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// moveExcess moves parts of the source until it keeps no more than the average.
+func (r *rebalancer) moveExcess(ctx context.Context, source *storageLoad, loads []*storageLoad) error {
+	var skip []string
+	for source.excess > 0 {
+		parts, err := r.repo.FindStorageParts(ctx, source.storage.ID, source.excess, skip, RebalanceBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(parts) == 0 {
+			return nil
+		}
+
+		for _, fp := range parts {
+			if fp.Size > source.excess {
+				continue
+			}
+
+			// only the storages below the average take parts
+			targets := make(map[string]*storageLoad)
+			var exclude []string
+			for _, load := range loads {
+				if load.excess < 0 {
+					targets[load.storage.ID] = load
+				} else {
+					exclude = append(exclude, load.storage.ID)
+				}
+			}
+			if len(targets) == 0 {
+				return nil
+			}
+
+			targetID, err := r.movePart(ctx, fp, exclude)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				skip = append(skip, fp.ID)
+				rebalanceMetrics.Add("failed", 1)
+				r.log.With("err", err).Warnf("failed to move part %s from storage %s", fp.ID, fp.StorageID)
+				r.update(func(p *RebalanceProgress) {
+					p.FailedParts++
+					p.LastError = err.Error()
+				})
+				continue
+			}
+
+			source.excess -= fp.Size
+			if target, ok := targets[targetID]; ok {
+				target.excess += fp.Size
+			}
+			rebalanceMetrics.Add("moved", 1)
+			rebalanceMetrics.Add("moved_bytes", fp.Size)
+			r.update(func(p *RebalanceProgress) {
+				p.MovedParts++
+				p.MovedBytes += fp.Size
+			})
+
+			if err = r.throttle(ctx, fp.Size); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// drainStorages moves the parts away from the draining storages.
+func (r *rebalancer) drainStorages(ctx context.Context) error {
+	storages, err := r.repo.FindDrainingStorages(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range storages {
+		if err = r.drainStorage(ctx, s); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			r.log.With("err", err).Errorf("failed to drain storage %s", s.ID)
+		}
+	}
+
+	return nil
+}
+
+// drainStorage moves all the parts of uploaded files away from the storage and retires
+// it when it keeps no parts. Parts of a dead storage are restored by the repairer instead.
+func (r *rebalancer) drainStorage(ctx context.Context, s *repository.Storage) error {
+	if s.State != repository.StorageStateDead {
+		var skip []string
+		for {
+			parts, err := r.repo.FindStorageParts(ctx, s.ID, math.MaxInt64, skip, RebalanceBatchSize)
+			if err != nil {
+				return err
+			}
+			if len(parts) == 0 {
+				break
+			}
+
+			for _, fp := range parts {
+				if _, err = r.movePart(ctx, fp, nil); err != nil {
+					if ctx.Err() != nil {
+						return ctx.Err()
+					}
+					skip = append(skip, fp.ID)
+					rebalanceMetrics.Add("failed", 1)
+					r.log.With("err", err).Warnf("failed to move part %s from draining storage %s", fp.ID, s.ID)
+					continue
+				}
+
+				rebalanceMetrics.Add("drained", 1)
+				rebalanceMetrics.Add("drained_bytes", fp.Size)
+				if err = r.throttle(ctx, fp.Size); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// parts which failed to move and parts of unfinished uploads are left for the next run
+	count, err := r.repo.CountStorageParts(ctx, s.ID)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		r.log.Infof("draining storage %s keeps %d parts", s.ID, count)
+		return nil
+	}
+
+	if err = r.repo.RetireStorage(ctx, s.ID); err != nil {
+		return err
+	}
+	rebalanceMetrics.Add("retired", 1)
+	r.log.Infof("storage %s is drained and safe to remove", s.ID)
+
+	return nil
+}
+
+// throttle waits for the time the given number of bytes takes to move at the rate,
+// so moves keep the storages serving files.
+func (r *rebalancer) throttle(ctx context.Context, size int64) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Duration(float64(size) / float64(r.rate) * float64(time.Second))):
+		return nil
+	}
+}
+
+// movePart copies the part to a storage picked by the placement policy, verifies the copy
+// against the hash of the part, switches the file part to it and deletes the source.
+// It returns the ID of the storage the part is moved to.
+func (r *rebalancer) movePart(ctx context.Context, fp *repository.FilePart, exclude []string) (string, error) {
+	file, err := r.repo.GetFile(ctx, fp.FileID)
+	if err != nil {
+		return "", err
+	}
+
+	keys := []string{file.ID}
+	if file.Name != nil {
+		keys = append(keys, *file.Name)
+	}
+	ctx, unlock, err := lockKeys(ctx, r.log, r.cache, 0, keys)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	// the part may be replaced while the file isn't locked
+	if fp, err = r.repo.GetFilePart(ctx, fp.ID); err != nil {
+		return "", err
+	}
+
+	fileParts, err := r.repo.FindFileParts(ctx, file.ID)
+	if err != nil {
+		return "", err
+	}
+
+	// the part must not share a storage with other copies of it or, for an
+	// erasure-coded file, with other shards
+	exclude = append(exclude, fp.StorageID)
+	for _, other := range fileParts {
+		if file.Encoding == repository.FileEncodingErasure || other.Seq == fp.Seq {
+			exclude = append(exclude, other.StorageID)
+		}
+	}
+
+	storage, err := r.repo.GetStorage(ctx, fp.StorageID)
+	if err != nil {
+		return "", err
+	}
+	client, err := r.clientFactory.NewStorageClient(ctx, storage.Host)
+	if err != nil {
+		return "", err
+	}
+
+	source := FilePart{
+		Seq:       fp.Seq,
+		RemoteID:  fp.RemoteID,
+		StorageID: fp.StorageID,
+		Client:    client,
+		Size:      fp.Size,
+		Hash:      fp.Hash,
+	}
+
+	// shards are copied as they are, so the loader works as a replicating one
+	ldr := NewLoader(r.log, fp.Size)
+	ldr.AddFilePart(&source)
+
+	target, err := reservePart(ctx, r.repo, r.clientFactory, r.placement, fp.Seq, fp.Size, exclude)
+	if err != nil {
+		return "", err
+	}
+
+	if err = ldr.RebuildPart(ctx, source, target); err != nil {
+		discardFileParts(r.log, r.repo, r.clientFactory, []FilePart{*target})
+		return "", err
+	}
+
+	part := repository.NewFilePart(file.ID, target.RemoteID, target.Seq, target.Size, target.StorageID, target.Hash)
+	deletion, err := r.repo.ReplaceFilePart(ctx, fp.ID, part)
+	if err != nil {
+		discardFileParts(r.log, r.repo, r.clientFactory, []FilePart{*target})
+		return "", err
+	}
+	deleteParts(ctx, r.log, r.repo, r.clientFactory, []*repository.PartDeletion{deletion})
+
+	r.log.Infof("part %d of file %s is moved from storage %s to %s", fp.Seq, file.ID, fp.StorageID, target.StorageID)
+	return target.StorageID, nil
+}
@@ -0,0 +1,39 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/blkmlk/file-storage/internal/services/repository"
+)
+
+func TestPlanRebalance(t *testing.T) {
+	storages := []*repository.Storage{
+		{ID: "full", TotalBytes: 1000, UsedBytes: 900},
+		{ID: "half", TotalBytes: 2000, UsedBytes: 1000},
+		{ID: "new", TotalBytes: 1000, UsedBytes: 100},
+		// storages which didn't report their capacity yet are left alone
+		{ID: "unknown"},
+	}
+
+	loads, planned := planRebalance(storages, 0.1)
+	require.Len(t, loads, 3)
+
+	// the average usage is a half
+	require.Equal(t, "full", loads[0].storage.ID)
+	require.EqualValues(t, 400, loads[0].excess)
+	require.Equal(t, "half", loads[1].storage.ID)
+	require.EqualValues(t, 0, loads[1].excess)
+	require.Equal(t, "new", loads[2].storage.ID)
+	require.EqualValues(t, -400, loads[2].excess)
+	require.EqualValues(t, 400, planned)
+
+	// nothing is moved when the storages are within the threshold
+	_, planned = planRebalance(storages, 0.5)
+	require.Zero(t, planned)
+
+	loads, planned = planRebalance(storages[3:], 0.1)
+	require.Empty(t, loads)
+	require.Zero(t, planned)
+}
@@ -0,0 +1,218 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/blkmlk/file-storage/internal/services/cache"
+	"github.com/blkmlk/file-storage/internal/services/repository"
+)
+
+const (
+	RepairInterval  = time.Second * 30
+	RepairBatchSize = 10
+)
+
+// repairMetrics counts repaired parts and failed attempts.
+var repairMetrics = expvar.NewMap("repairer")
+
+// Repairer restores the parts queued for repair onto other storages, so files keep
+// their replication factor or parity after a part is lost.
+type Repairer interface {
+	Run(ctx context.Context) error
+}
+
+func NewRepairer(
+	log *zap.SugaredLogger,
+	repo repository.Repository,
+	cache cache.Cache,
+	clientFactory ClientFactory,
+	placement PlacementPolicy,
+) Repairer {
+	return &repairer{
+		log:           log,
+		repo:          repo,
+		cache:         cache,
+		clientFactory: clientFactory,
+		placement:     placement,
+	}
+}
+
+type repairer struct {
+	log           *zap.SugaredLogger
+	repo          repository.Repository
+	cache         cache.Cache
+	clientFactory ClientFactory
+	placement     PlacementPolicy
+}
+
+func (r *repairer) Run(ctx context.Context) error {
+	ticker := time.NewTicker(RepairInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		runLeased(ctx, r.log, r.cache, "repairer", r.repairParts)
+	}
+}
+
+// repairParts repairs a batch of the parts which are due.
+func (r *repairer) repairParts(ctx context.Context) {
+	repairs, err := r.repo.FindPartRepairs(ctx, time.Now().Add(-RepairInterval), RepairBatchSize)
+	if err != nil {
+		r.log.With("err", err).Error("failed to find part repairs")
+		return
+	}
+
+	// a repair which is stopped because the lease is lost isn't a failed one
+	for _, pr := range repairs {
+		if ctx.Err() != nil {
+			return
+		}
+		if err = r.repairPart(ctx, pr); err == nil || ctx.Err() != nil {
+			continue
+		}
+
+		repairMetrics.Add("failed", 1)
+		r.log.With("err", err).Warnf("failed to repair part %s", pr.FilePartID)
+		if err = r.repo.UpdatePartRepairAttempt(ctx, pr.ID, err.Error()); err != nil && !errors.Is(err, repository.ErrNotFound) {
+			r.log.With("err", err).Error("failed to update part repair")
+		}
+	}
+}
+
+// repairPart writes the lost part to a storage which keeps no other copy of it and
+// swaps the file part for the new one. The repair is removed with the old part.
+func (r *repairer) repairPart(ctx context.Context, pr *repository.PartRepair) error {
+	fp, err := r.repo.GetFilePart(ctx, pr.FilePartID)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return r.repo.RemovePartRepair(ctx, pr.ID)
+		}
+		return err
+	}
+
+	file, err := r.repo.GetFile(ctx, fp.FileID)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{file.ID}
+	if file.Name != nil {
+		keys = append(keys, *file.Name)
+	}
+	ctx, unlock, err := lockKeys(ctx, r.log, r.cache, 0, keys)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// the part may be back, e.g. when its storage is restored,
+	// but a dead storage isn't asked
+	hosts := make(map[string]string)
+	if pr.Reason != repository.PartStatusDead {
+		status, err := verifyFilePart(ctx, r.repo, r.clientFactory, hosts, fp)
+		switch status {
+		case repository.PartStatusOK:
+			r.log.Infof("part %d of file %s on storage %s doesn't need a repair", fp.Seq, file.ID, fp.StorageID)
+			return r.repo.RemovePartRepair(ctx, pr.ID)
+		case repository.PartStatusUnavailable:
+			return fmt.Errorf("part can't be verified: %w", err)
+		}
+	}
+
+	fileParts, err := r.repo.FindFileParts(ctx, file.ID)
+	if err != nil {
+		return err
+	}
+
+	ldr, exclude := r.prepareLoaderForRepair(ctx, file, fileParts, fp, hosts)
+
+	target, err := reservePart(ctx, r.repo, r.clientFactory, r.placement, fp.Seq, fp.Size, exclude)
+	if err != nil {
+		return err
+	}
+
+	lost := FilePart{
+		Seq:       fp.Seq,
+		RemoteID:  fp.RemoteID,
+		StorageID: fp.StorageID,
+		Size:      fp.Size,
+		Hash:      fp.Hash,
+	}
+	if err = ldr.RebuildPart(ctx, lost, target); err != nil {
+		discardFileParts(r.log, r.repo, r.clientFactory, []FilePart{*target})
+		return err
+	}
+
+	part := repository.NewFilePart(file.ID, target.RemoteID, target.Seq, target.Size, target.StorageID, target.Hash)
+	deletion, err := r.repo.ReplaceFilePart(ctx, fp.ID, part)
+	if err != nil {
+		discardFileParts(r.log, r.repo, r.clientFactory, []FilePart{*target})
+		return err
+	}
+	deleteParts(ctx, r.log, r.repo, r.clientFactory, []*repository.PartDeletion{deletion})
+
+	repairMetrics.Add("repaired", 1)
+	r.log.Infof("part %d of file %s is restored from storage %s to %s", fp.Seq, file.ID, fp.StorageID, target.StorageID)
+
+	return nil
+}
+
+// prepareLoaderForRepair adds the parts the lost one is restored from: the other replicas
+// of the same seq or, for an erasure-coded file, the other shards. It returns the storages
+// which keep them, as the restored part must not share a storage with them.
+func (r *repairer) prepareLoaderForRepair(
+	ctx context.Context,
+	file *repository.File,
+	fileParts []*repository.FilePart,
+	lost *repository.FilePart,
+	hosts map[string]string,
+) (*loader, []string) {
+	erasure := file.Encoding == repository.FileEncodingErasure
+
+	ldr := NewLoader(r.log, file.Size)
+	if erasure {
+		ldr = NewErasureLoader(r.log, file.Size, file.DataShards, file.ParityShards)
+	}
+
+	exclude := []string{lost.StorageID}
+	for _, fp := range fileParts {
+		if fp.ID == lost.ID || (!erasure && fp.Seq != lost.Seq) {
+			continue
+		}
+		exclude = append(exclude, fp.StorageID)
+
+		// an unavailable copy is skipped, the part is restored from the others
+		host, err := storageHost(ctx, r.repo, hosts, fp.StorageID)
+		if err != nil {
+			continue
+		}
+		client, err := r.clientFactory.NewStorageClient(ctx, host)
+		if err != nil {
+			continue
+		}
+
+		ldr.AddFilePart(&FilePart{
+			Seq:       fp.Seq,
+			RemoteID:  fp.RemoteID,
+			StorageID: fp.StorageID,
+			Client:    client,
+			Size:      fp.Size,
+			Hash:      fp.Hash,
+		})
+	}
+	ldr.SortFileParts()
+
+	return ldr, exclude
+}
@@ -0,0 +1,208 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/blkmlk/file-storage/env"
+	"github.com/blkmlk/file-storage/internal/services/cache"
+	"github.com/blkmlk/file-storage/internal/services/repository"
+	"github.com/blkmlk/file-storage/protocol"
+)
+
+const (
+	DefaultScrubInterval = time.Hour * 24 * 7
+	DefaultScrubRate     = 10
+	ScrubBatchSize       = 100
+	ScrubIdleInterval    = time.Minute
+	// VerifyResponseTime is longer than MaxResponseTime as the storage reads the whole part
+	VerifyResponseTime = time.Minute
+)
+
+// scrubMetrics counts verified parts by their status.
+var scrubMetrics = expvar.NewMap("scrubber")
+
+// Scrubber verifies stored parts against the hashes saved at upload, so the parts
+// which are lost or corrupted on storages are found before they're read.
+type Scrubber interface {
+	Run(ctx context.Context) error
+}
+
+func NewScrubber(
+	log *zap.SugaredLogger,
+	repo repository.Repository,
+	cache cache.Cache,
+	clientFactory ClientFactory,
+) (Scrubber, error) {
+	interval, err := time.ParseDuration(env.GetOptional(env.ScrubInterval, DefaultScrubInterval.String()))
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("%s is not a positive duration", env.ScrubInterval)
+	}
+
+	rate, err := strconv.Atoi(env.GetOptional(env.ScrubRate, strconv.Itoa(DefaultScrubRate)))
+	if err != nil || rate < 1 {
+		return nil, fmt.Errorf("%s is not positive integer", env.ScrubRate)
+	}
+
+	return &scrubber{
+		log:           log,
+		repo:          repo,
+		cache:         cache,
+		clientFactory: clientFactory,
+		interval:      interval,
+		rate:          rate,
+	}, nil
+}
+
+type scrubber struct {
+	log           *zap.SugaredLogger
+	repo          repository.Repository
+	cache         cache.Cache
+	clientFactory ClientFactory
+	// interval is how often every part is verified
+	interval time.Duration
+	// rate is the number of parts verified per second
+	rate int
+}
+
+func (s *scrubber) Run(ctx context.Context) error {
+	limiter := time.NewTicker(time.Second / time.Duration(s.rate))
+	defer limiter.Stop()
+
+	for {
+		// the scrubber waits while another uploader scrubs or there is nothing to verify
+		var scrubbed int
+		runLeased(ctx, s.log, s.cache, "scrubber", func(ctx context.Context) {
+			scrubbed = s.scrubBatch(ctx, limiter)
+		})
+
+		if scrubbed == 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(ScrubIdleInterval):
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// scrubBatch verifies a batch of the parts which are due and returns their number.
+func (s *scrubber) scrubBatch(ctx context.Context, limiter *time.Ticker) int {
+	parts, err := s.repo.FindPartsToVerify(ctx, time.Now().Add(-s.interval), ScrubBatchSize)
+	if err != nil {
+		s.log.With("err", err).Error("failed to find parts to verify")
+	}
+
+	hosts := make(map[string]string)
+	for _, fp := range parts {
+		select {
+		case <-ctx.Done():
+			return len(parts)
+		case <-limiter.C:
+		}
+
+		s.scrubPart(ctx, hosts, fp)
+	}
+	return len(parts)
+}
+
+// scrubPart verifies the part, records the outcome and queues the part for repair
+// when it's lost or corrupted.
+func (s *scrubber) scrubPart(ctx context.Context, hosts map[string]string, fp *repository.FilePart) {
+	status, err := verifyFilePart(ctx, s.repo, s.clientFactory, hosts, fp)
+	if ctx.Err() != nil {
+		return
+	}
+
+	if err := s.repo.UpdatePartVerification(ctx, fp.ID, status); err != nil {
+		// the part is deleted with its file while it's verified
+		if !errors.Is(err, repository.ErrNotFound) {
+			s.log.With("err", err).Error("failed to update part verification")
+		}
+		return
+	}
+	scrubMetrics.Add(string(status), 1)
+
+	switch status {
+	case repository.PartStatusUnavailable:
+		s.log.With("err", err).Warnf("failed to verify part %s on storage %s", fp.RemoteID, fp.StorageID)
+		return
+	case repository.PartStatusOK:
+		return
+	}
+
+	s.log.With("err", err).Errorf("part %d of file %s on storage %s is %s", fp.Seq, fp.FileID, fp.StorageID, status)
+
+	repair := repository.NewPartRepair(fp.ID, status)
+	if err := s.repo.CreatePartRepair(ctx, &repair); err != nil {
+		s.log.With("err", err).Error("failed to create part repair")
+	}
+}
+
+// verifyFilePart asks the storage to read the part again. The error explains why
+// the part isn't ok. Hosts of storages are cached in the given map.
+func verifyFilePart(
+	ctx context.Context,
+	repo repository.Repository,
+	clientFactory ClientFactory,
+	hosts map[string]string,
+	fp *repository.FilePart,
+) (repository.PartStatus, error) {
+	host, err := storageHost(ctx, repo, hosts, fp.StorageID)
+	if err != nil {
+		return repository.PartStatusUnavailable, err
+	}
+
+	client, err := clientFactory.NewStorageClient(ctx, host)
+	if err != nil {
+		return repository.PartStatusUnavailable, err
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, VerifyResponseTime)
+	defer cancel()
+
+	resp, err := client.VerifyFilePart(reqCtx, &protocol.VerifyFilePartRequest{
+		Id: fp.RemoteID,
+	})
+	if err != nil {
+		return repository.PartStatusUnavailable, err
+	}
+
+	if !resp.Exists {
+		return repository.PartStatusMissing, fmt.Errorf("part %s is not found", fp.RemoteID)
+	}
+
+	if err = checkPart(FilePart{
+		Seq:       fp.Seq,
+		RemoteID:  fp.RemoteID,
+		StorageID: fp.StorageID,
+		Size:      fp.Size,
+		Hash:      fp.Hash,
+	}, resp.Size, resp.Hash); err != nil {
+		return repository.PartStatusCorrupted, err
+	}
+
+	return repository.PartStatusOK, nil
+}
+
+func storageHost(ctx context.Context, repo repository.Repository, hosts map[string]string, storageID string) (string, error) {
+	if host, ok := hosts[storageID]; ok {
+		return host, nil
+	}
+
+	storage, err := repo.GetStorage(ctx, storageID)
+	if err != nil {
+		return "", err
+	}
+	hosts[storageID] = storage.Host
+	return storage.Host, nil
+}
@@ -0,0 +1,78 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/blkmlk/file-storage/internal/mocks"
+	"github.com/blkmlk/file-storage/internal/services/repository"
+	"github.com/blkmlk/file-storage/protocol"
+)
+
+// hostClientFactory returns the mocked storage of the host.
+type hostClientFactory map[string]*mocks.Storage
+
+func (f hostClientFactory) NewStorageClient(ctx context.Context, host string) (protocol.StorageClient, error) {
+	return f[host], nil
+}
+
+func TestScrubber_VerifyPart(t *testing.T) {
+	ctx := context.Background()
+
+	client := mocks.NewStorage(ctx)
+	storageID := uuid.NewString()
+
+	fullSize := int64(2*ChunkSize + 10)
+	ldr := NewLoader(zap.NewNop().Sugar(), fullSize)
+	for seq := 0; seq < 3; seq++ {
+		resp, err := client.CheckReadiness(ctx, &protocol.CheckReadinessRequest{})
+		require.NoError(t, err)
+
+		ldr.AddFilePart(&FilePart{
+			Seq:       seq,
+			RemoteID:  resp.Id,
+			StorageID: storageID,
+			Client:    client,
+		})
+	}
+
+	buff := make([]byte, fullSize)
+	_, err := rand.Read(buff)
+	require.NoError(t, err)
+	require.NoError(t, ldr.Upload(ctx, bytes.NewReader(buff)))
+
+	factory := hostClientFactory{"host": client}
+	hosts := map[string]string{storageID: "host"}
+
+	fileParts := ldr.GetFileParts()
+	client.Corrupt(fileParts[1].RemoteID)
+	_, err = client.DeleteFilePart(ctx, &protocol.DeleteFilePartRequest{Id: fileParts[2].RemoteID})
+	require.NoError(t, err)
+
+	expected := []repository.PartStatus{
+		repository.PartStatusOK,
+		repository.PartStatusCorrupted,
+		repository.PartStatusMissing,
+	}
+	for i, fp := range fileParts {
+		part := repository.NewFilePart(uuid.NewString(), fp.RemoteID, fp.Seq, fp.Size, fp.StorageID, fp.Hash)
+
+		status, err := verifyFilePart(ctx, nil, factory, hosts, &part)
+		require.Equal(t, expected[i], status)
+
+		switch status {
+		case repository.PartStatusOK:
+			require.NoError(t, err)
+		case repository.PartStatusCorrupted:
+			require.ErrorIs(t, err, ErrCorrupted)
+		default:
+			require.Error(t, err)
+		}
+	}
+}
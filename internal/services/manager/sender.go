@@ -0,0 +1,249 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/blkmlk/file-storage/protocol"
+)
+
+const (
+	// UploadBufferChunks is how many chunks may wait to be sent to the replicas of a part.
+	UploadBufferChunks = 64
+	// DefaultUploadParallelism is how many parts are sent at the same time by default.
+	DefaultUploadParallelism = 4
+)
+
+var chunkPool = sync.Pool{
+	New: func() any {
+		return make([]byte, ChunkSize)
+	},
+}
+
+// uploadError keeps the first failure of an upload and cancels the rest of it.
+type uploadError struct {
+	locker sync.Mutex
+	err    error
+	cancel context.CancelFunc
+}
+
+func (e *uploadError) set(err error) {
+	e.locker.Lock()
+	if e.err == nil {
+		e.err = err
+	}
+	e.locker.Unlock()
+	e.cancel()
+}
+
+func (e *uploadError) get() error {
+	e.locker.Lock()
+	defer e.locker.Unlock()
+	return e.err
+}
+
+// partSender sends chunks to the replicas of a part in background, so the input
+// may be read further while storages receive the data. At most UploadBufferChunks
+// chunks are queued, which bounds the memory used by a part.
+// With a failover the sent data is spooled, so a replica can be moved to another storage.
+type partSender struct {
+	ctx      context.Context
+	log      *zap.SugaredLogger
+	replicas []*FilePart
+	size     int64
+	streams  []protocol.Storage_UploadFileClient
+	chunks   chan []byte
+	done     chan struct{}
+	fail     func(error)
+	failover *failover
+	spool    *spool
+	sent     int64
+	err      error
+}
+
+func newPartSender(
+	ctx context.Context,
+	log *zap.SugaredLogger,
+	replicas []*FilePart,
+	size int64,
+	fo *failover,
+	fail func(error),
+) (*partSender, error) {
+	s := &partSender{
+		ctx:      ctx,
+		log:      log,
+		replicas: replicas,
+		size:     size,
+		streams:  make([]protocol.Storage_UploadFileClient, len(replicas)),
+		chunks:   make(chan []byte, UploadBufferChunks),
+		done:     make(chan struct{}),
+		fail:     fail,
+		failover: fo,
+	}
+
+	if fo != nil {
+		var err error
+		if s.spool, err = newSpool(); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, part := range replicas {
+		stream, err := part.Client.UploadFile(ctx)
+		if err != nil {
+			if err = s.recover(i, err); err != nil {
+				s.closeSpool()
+				return nil, err
+			}
+			continue
+		}
+		s.streams[i] = stream
+	}
+
+	go s.run()
+	return s, nil
+}
+
+func (s *partSender) run() {
+	defer close(s.done)
+	defer s.closeSpool()
+
+	// chunks are drained after a failure, so a blocked reader is released
+	for data := range s.chunks {
+		if s.err == nil {
+			s.err = s.send(data)
+			if s.err != nil {
+				s.fail(s.err)
+			}
+		}
+		chunkPool.Put(data[:cap(data)])
+	}
+	if s.err != nil {
+		return
+	}
+
+	for i := range s.streams {
+		resp, err := s.streams[i].CloseAndRecv()
+		for err != nil {
+			if err = s.recover(i, err); err != nil {
+				s.err = err
+				s.fail(err)
+				return
+			}
+			resp, err = s.streams[i].CloseAndRecv()
+		}
+		s.replicas[i].Hash = resp.Hash
+		s.replicas[i].Size = s.sent
+	}
+}
+
+func (s *partSender) send(data []byte) error {
+	// a replacement gets the chunk from the spool
+	if s.spool != nil {
+		if err := s.spool.Write(data); err != nil {
+			return err
+		}
+	}
+
+	for i, stream := range s.streams {
+		err := stream.Send(&protocol.UploadFileRequest{
+			Id:   s.replicas[i].RemoteID,
+			Data: data,
+		})
+		if err != nil {
+			if err = s.recover(i, err); err != nil {
+				return err
+			}
+		}
+	}
+	s.sent += int64(len(data))
+	return nil
+}
+
+func (s *partSender) closeSpool() {
+	if s.spool != nil {
+		s.spool.Close()
+		s.spool = nil
+	}
+}
+
+// Send queues a chunk taken from chunkPool, the chunk is returned to the pool once it's sent.
+func (s *partSender) Send(ctx context.Context, data []byte) error {
+	select {
+	case s.chunks <- data:
+		return nil
+	case <-ctx.Done():
+		chunkPool.Put(data[:cap(data)])
+		return ctx.Err()
+	}
+}
+
+// Pump queues size bytes of the reader, a negative size means the part ends with the reader.
+func (s *partSender) Pump(ctx context.Context, reader io.Reader, size int64) error {
+	for queued := int64(0); size < 0 || queued < size; {
+		chunk := int64(ChunkSize)
+		if size >= 0 && size-queued < chunk {
+			chunk = size - queued
+		}
+
+		data := chunkPool.Get().([]byte)[:chunk]
+
+		var err error
+		eof := false
+		if size < 0 {
+			var n int
+			n, err = io.ReadFull(reader, data)
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				data, err, eof = data[:n], nil, true
+			}
+		} else {
+			err = readFull(reader, data)
+		}
+
+		if err != nil || len(data) == 0 {
+			chunkPool.Put(data[:cap(data)])
+			return err
+		}
+
+		if err = s.Send(ctx, data); err != nil {
+			return err
+		}
+		queued += int64(len(data))
+
+		if eof {
+			break
+		}
+	}
+	return nil
+}
+
+// readAhead copies size bytes of the reader to a spool, so the part can be sent
+// while the reader goes on.
+func readAhead(reader io.Reader, size int64) (*spool, error) {
+	s, err := newSpool()
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := io.CopyN(s.file, reader, size)
+	s.size = n
+	if err != nil {
+		s.Close()
+		if errors.Is(err, io.EOF) {
+			return nil, ErrSizeMismatch
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close waits until the queued chunks are sent and the replicas are saved.
+func (s *partSender) Close() error {
+	close(s.chunks)
+	<-s.done
+	return s.err
+}
@@ -0,0 +1,86 @@
+package manager
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	"github.com/blkmlk/file-storage/internal/services/repository"
+)
+
+// storeStream uploads a stream of unknown length as parts of streamPartSize bytes.
+// Storages for a part are reserved only when its first bytes arrive and every part
+// is saved as soon as it's uploaded. It returns the size of the stream.
+func (m *manager) storeStream(ctx context.Context, fileID string, replicas int, reader io.Reader) (int64, error) {
+	var (
+		size int64
+		seqs []int
+	)
+
+	first := make([]byte, ChunkSize)
+	for seq := 0; ; seq++ {
+		n, err := io.ReadFull(reader, first)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, m.dropStreamParts(ctx, fileID, seqs, err)
+		}
+		if n == 0 {
+			return size, nil
+		}
+
+		partSize, err := m.storeStreamPart(ctx, fileID, seq, replicas,
+			io.MultiReader(bytes.NewReader(first[:n]), io.LimitReader(reader, m.streamPartSize-int64(n))))
+		if err != nil {
+			return 0, m.dropStreamParts(ctx, fileID, seqs, err)
+		}
+
+		seqs = append(seqs, seq)
+		size += partSize
+
+		if partSize < m.streamPartSize {
+			return size, nil
+		}
+	}
+}
+
+func (m *manager) storeStreamPart(ctx context.Context, fileID string, seq, replicas int, reader io.Reader) (int64, error) {
+	ldr, err := m.prepareLoaderForPart(ctx, seq, m.streamPartSize, replicas)
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := ldr.UploadStream(ctx, reader)
+	m.cleanupUpload(ldr, err)
+	if err != nil {
+		return 0, err
+	}
+
+	fileParts := ldr.GetFileParts()
+	dbFileParts := make([]repository.FilePart, 0, len(fileParts))
+	for _, fp := range fileParts {
+		part := repository.NewFilePart(fileID, fp.RemoteID, fp.Seq, fp.Size, fp.StorageID, fp.Hash)
+		dbFileParts = append(dbFileParts, part)
+	}
+
+	if err = m.repo.CreateFileParts(ctx, dbFileParts); err != nil {
+		m.discardFileParts(fileParts)
+		return 0, err
+	}
+	return size, nil
+}
+
+// dropStreamParts deletes the parts saved before the stream failed and returns the failure.
+func (m *manager) dropStreamParts(ctx context.Context, fileID string, seqs []int, cause error) error {
+	if len(seqs) == 0 {
+		return cause
+	}
+
+	deletions, err := m.repo.ReplaceFileParts(ctx, fileID, seqs, nil)
+	if err != nil {
+		m.log.With("err", err).Errorf("failed to drop parts of file %s", fileID)
+		return cause
+	}
+	deleteParts(ctx, m.log, m.repo, m.clientFactory, deletions)
+
+	return cause
+}
@@ -9,8 +9,40 @@ import (
 type FileStatus string
 
 const (
-	FileStatusCreated  FileStatus = "created"
-	FileStatusUploaded FileStatus = "uploaded"
+	FileStatusCreated   FileStatus = "created"
+	FileStatusUploading FileStatus = "uploading"
+	// FileStatusCompleting is set while a multipart upload is completed, it takes no more parts
+	FileStatusCompleting FileStatus = "completing"
+	FileStatusUploaded   FileStatus = "uploaded"
+)
+
+type FileEncoding string
+
+const (
+	FileEncodingReplication FileEncoding = "replication"
+	FileEncodingErasure     FileEncoding = "erasure"
+)
+
+// StorageState tells whether a storage sends heartbeats. A suspect storage missed
+// some of them, a dead one is gone long enough to restore its parts elsewhere.
+type StorageState string
+
+const (
+	StorageStateAlive   StorageState = "alive"
+	StorageStateSuspect StorageState = "suspect"
+	StorageStateDead    StorageState = "dead"
+)
+
+// PartStatus is the outcome of the last verification of a file part.
+type PartStatus string
+
+const (
+	PartStatusOK          PartStatus = "ok"
+	PartStatusCorrupted   PartStatus = "corrupted"
+	PartStatusMissing     PartStatus = "missing"
+	PartStatusUnavailable PartStatus = "unavailable"
+	// PartStatusDead is the reason to repair the parts of a dead storage
+	PartStatusDead PartStatus = "dead"
 )
 
 type File struct {
@@ -18,10 +50,22 @@ type File struct {
 	Name        *string
 	ContentType string
 	Hash        string
-	Size        int64
-	Status      FileStatus
-	CreatedAt   time.Time
-	UpdatedAt   time.Time
+	// MD5 is the hex MD5 of the content, or the MD5 of the part MD5s followed by the
+	// number of parts for multipart uploads. S3 clients expect it as the ETag.
+	MD5          string
+	Size         int64
+	Replicas     int
+	Encoding     FileEncoding
+	DataShards   int
+	ParityShards int
+	Status       FileStatus
+	// Noncurrent is set for older versions of the name and for uploads which
+	// become its current version once completed
+	Noncurrent bool
+	// DeleteMarker is a version which hides the name without deleting older versions
+	DeleteMarker bool
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
 }
 
 func NewFile() File {
@@ -30,6 +74,8 @@ func NewFile() File {
 		ID:        uuid.NewString(),
 		Name:      nil,
 		Hash:      "",
+		Replicas:  1,
+		Encoding:  FileEncodingReplication,
 		Status:    FileStatusCreated,
 		CreatedAt: now,
 		UpdatedAt: now,
@@ -37,15 +83,20 @@ func NewFile() File {
 }
 
 type FilePart struct {
-	ID        string
-	FileID    string
-	RemoteID  string
-	Seq       int
-	Size      int64
-	Hash      string
+	ID       string
+	FileID   string
+	RemoteID string
+	Seq      int
+	Size     int64
+	Hash     string
+	// MD5 is only known for parts of multipart uploads, it makes up the MD5 of the file
+	MD5       string
 	StorageID string
-	CreatedAt time.Time
-	UpdatedAt time.Time
+	// VerifiedAt is nil until the scrubber checks the part for the first time.
+	VerifiedAt   *time.Time
+	VerifyStatus PartStatus
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
 }
 
 func NewFilePart(fileID, remoteID string, seq int, size int64, storageID, hash string) FilePart {
@@ -64,16 +115,111 @@ func NewFilePart(fileID, remoteID string, seq int, size int64, storageID, hash s
 }
 
 type Storage struct {
-	ID        string
-	Host      string
-	CreatedAt time.Time
-	UpdatedAt time.Time
+	ID   string
+	Host string
+	// Zone is the failure domain of the storage, e.g. a rack
+	Zone       string
+	LastSeenAt time.Time
+	State      StorageState
+	// the capacity is the one reported by the last heartbeat, it's zero until then
+	TotalBytes int64
+	UsedBytes  int64
+	FreeBytes  int64
+	// a draining storage takes no new parts and its parts are moved away,
+	// it's retired once it keeps none of them
+	DrainingAt *time.Time
+	RetiredAt  *time.Time
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
 }
 
 func NewStorage(id, host string) Storage {
+	now := time.Now()
 	return Storage{
-		ID:        id,
-		Host:      host,
+		ID:         id,
+		Host:       host,
+		LastSeenAt: now,
+		State:      StorageStateAlive,
+		CreatedAt:  now,
+	}
+}
+
+// PartReservation is a part reserved on a storage for a file which is being uploaded.
+// It lives until the file is uploaded or deleted, so the garbage collector doesn't take
+// the parts sent early for orphans while the rest of the file is sent.
+type PartReservation struct {
+	StorageID string
+	RemoteID  string
+	FileID    string
+	CreatedAt time.Time
+}
+
+func NewPartReservation(fileID, storageID, remoteID string) PartReservation {
+	return PartReservation{
+		StorageID: storageID,
+		RemoteID:  remoteID,
+		FileID:    fileID,
 		CreatedAt: time.Now(),
 	}
 }
+
+// PartDeletion is a file part which is removed from the DB but may still be kept by its storage.
+type PartDeletion struct {
+	ID        string
+	StorageID string
+	RemoteID  string
+	Attempts  int
+	LastError string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func NewPartDeletion(storageID, remoteID string) PartDeletion {
+	now := time.Now()
+	return PartDeletion{
+		ID:        uuid.NewString(),
+		StorageID: storageID,
+		RemoteID:  remoteID,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+// PartRepair is a file part which is lost or corrupted and has to be restored.
+type PartRepair struct {
+	ID         string
+	FilePartID string
+	Reason     PartStatus
+	Attempts   int
+	LastError  string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+func NewPartRepair(filePartID string, reason PartStatus) PartRepair {
+	now := time.Now()
+	return PartRepair{
+		ID:         uuid.NewString(),
+		FilePartID: filePartID,
+		Reason:     reason,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+}
+
+type Bucket struct {
+	ID        string
+	Name      string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func NewBucket(name string) Bucket {
+	now := time.Now()
+	return Bucket{
+		ID:        uuid.NewString(),
+		Name:      name,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
@@ -2,6 +2,7 @@ package repository
 
 import (
 	"context"
+	"strings"
 	"time"
 
 	"gorm.io/gorm/clause"
@@ -22,25 +23,83 @@ var (
 )
 
 type UpdateFileInfoInput struct {
-	Name        string
-	ContentType string
-	Size        int64
-	Status      FileStatus
+	Name         string
+	ContentType  string
+	Size         int64
+	Hash         string
+	MD5          string
+	Replicas     int
+	Encoding     FileEncoding
+	DataShards   int
+	ParityShards int
+	Status       FileStatus
 }
 
+// ReplaceMode tells what happens to the current file of a name when another file takes the name.
+type ReplaceMode int
+
+const (
+	// ReplaceNone fails with ErrAlreadyExists
+	ReplaceNone ReplaceMode = iota
+	// ReplaceSupersede keeps the current file as a noncurrent version
+	ReplaceSupersede
+	// ReplaceDelete deletes the current file and queues its parts for deletion
+	ReplaceDelete
+)
+
 type Repository interface {
 	CreateFile(ctx context.Context, file *File) error
 	UpdateFileInfo(ctx context.Context, id string, input UpdateFileInfoInput) error
+	UpdateFileStatus(ctx context.Context, id string, from, to FileStatus) error
+	ReplaceFile(ctx context.Context, id string, input UpdateFileInfoInput, mode ReplaceMode, check func(current *File) error) (string, []*PartDeletion, error)
 	GetFile(ctx context.Context, id string) (*File, error)
 	GetFileByName(ctx context.Context, name string) (*File, error)
+	GetFileVersion(ctx context.Context, name, id string) (*File, error)
+	FindFileVersions(ctx context.Context, name string) ([]*File, error)
+	CreateDeleteMarker(ctx context.Context, marker *File) (string, error)
+	DeleteFile(ctx context.Context, id string) ([]*PartDeletion, error)
+	DeleteFileVersion(ctx context.Context, name, id string) ([]*PartDeletion, error)
+	FindExpiredUploads(ctx context.Context, updatedBefore time.Time, limit int) ([]*File, error)
+	FindFilesByPrefix(ctx context.Context, prefix, startAfter string, limit int) ([]*File, error)
+
+	CreateBucket(ctx context.Context, bucket *Bucket) error
+	GetBucket(ctx context.Context, name string) (*Bucket, error)
+	FindBuckets(ctx context.Context) ([]*Bucket, error)
+	DeleteBucket(ctx context.Context, name string) error
 
 	CreateOrUpdateStorage(ctx context.Context, storage *Storage) error
 	GetStorage(ctx context.Context, id string) (*Storage, error)
 	FindStorages(ctx context.Context) ([]*Storage, error)
+	UpdateStorageStates(ctx context.Context, suspectBefore, deadBefore time.Time) ([]*Storage, error)
+	UpdateStorageUsage(ctx context.Context, id string, totalBytes, usedBytes, freeBytes int64) error
+	DrainStorage(ctx context.Context, id string) error
+	FindDrainingStorages(ctx context.Context) ([]*Storage, error)
+	CountStorageParts(ctx context.Context, id string) (int64, error)
+	RetireStorage(ctx context.Context, id string) error
 
 	CreateFilePart(ctx context.Context, filePart *FilePart) error
 	CreateFileParts(ctx context.Context, fileParts []FilePart) error
+	GetFilePart(ctx context.Context, id string) (*FilePart, error)
 	FindFileParts(ctx context.Context, fileID string) ([]*FilePart, error)
+	ReplaceFileParts(ctx context.Context, fileID string, seqs []int, fileParts []FilePart) ([]*PartDeletion, error)
+	ReplaceFilePart(ctx context.Context, id string, filePart FilePart) (*PartDeletion, error)
+	FindPartsToVerify(ctx context.Context, verifiedBefore time.Time, limit int) ([]*FilePart, error)
+	FindKnownRemoteIDs(ctx context.Context, storageID string, remoteIDs []string) ([]string, error)
+	FindStorageParts(ctx context.Context, storageID string, maxSize int64, skip []string, limit int) ([]*FilePart, error)
+	UpdatePartVerification(ctx context.Context, id string, status PartStatus) error
+
+	CreatePartRepair(ctx context.Context, repair *PartRepair) error
+	CreateStorageRepairs(ctx context.Context, storageID string) (int64, error)
+	FindPartRepairs(ctx context.Context, olderThan time.Time, limit int) ([]*PartRepair, error)
+	UpdatePartRepairAttempt(ctx context.Context, id string, lastError string) error
+	RemovePartRepair(ctx context.Context, id string) error
+
+	CreatePartReservations(ctx context.Context, reservations []PartReservation) error
+
+	CreatePartDeletions(ctx context.Context, deletions []PartDeletion) error
+	FindPartDeletions(ctx context.Context, olderThan time.Time, limit int) ([]*PartDeletion, error)
+	UpdatePartDeletionAttempt(ctx context.Context, id string, lastError string) error
+	RemovePartDeletion(ctx context.Context, id string) error
 }
 
 type storage struct {
@@ -65,16 +124,28 @@ func (s storage) CreateFile(ctx context.Context, file *File) error {
 }
 
 func (s storage) UpdateFileInfo(ctx context.Context, id string, input UpdateFileInfoInput) error {
-	tx := s.db.WithContext(ctx).Table("files").Where("id = ?", id).
-		Updates(map[string]any{
-			"name":         input.Name,
-			"content_type": input.ContentType,
-			"size":         input.Size,
-			"status":       input.Status,
-			"updated_at":   time.Now(),
-		})
+	values := map[string]any{
+		"name":          input.Name,
+		"content_type":  input.ContentType,
+		"size":          input.Size,
+		"hash":          input.Hash,
+		"md5":           input.MD5,
+		"replicas":      input.Replicas,
+		"data_shards":   input.DataShards,
+		"parity_shards": input.ParityShards,
+		"status":        input.Status,
+		"updated_at":    time.Now(),
+	}
+	if input.Encoding != "" {
+		values["encoding"] = input.Encoding
+	}
+
+	tx := s.db.WithContext(ctx).Table("files").Where("id = ?", id).Updates(values)
 
 	if tx.Error != nil {
+		if e, ok := tx.Error.(*pgconn.PgError); ok && e.Code == ConstraintErrorCode {
+			return ErrAlreadyExists
+		}
 		return tx.Error
 	}
 
@@ -85,6 +156,142 @@ func (s storage) UpdateFileInfo(ctx context.Context, id string, input UpdateFile
 	return nil
 }
 
+// UpdateFileStatus moves the file from one status to another. It fails with
+// ErrNotFound when the file doesn't have the from status.
+func (s storage) UpdateFileStatus(ctx context.Context, id string, from, to FileStatus) error {
+	tx := s.db.WithContext(ctx).Table("files").
+		Where("id = ? AND status = ?", id, from).
+		Updates(map[string]any{
+			"status":     to,
+			"updated_at": time.Now(),
+		})
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ReplaceFile updates the file like UpdateFileInfo and makes it the current file of the name
+// in one transaction. The current file, nil when there's none, is passed to check first and
+// the error of check is returned as is. Writers of the same name wait for each other, so
+// the current file can't change until the transaction ends. It returns the ID of the replaced
+// file, empty when there was none, and the deletions of its parts.
+func (s storage) ReplaceFile(
+	ctx context.Context,
+	id string,
+	input UpdateFileInfoInput,
+	mode ReplaceMode,
+	check func(current *File) error,
+) (string, []*PartDeletion, error) {
+	values := map[string]any{
+		"name":          input.Name,
+		"content_type":  input.ContentType,
+		"size":          input.Size,
+		"hash":          input.Hash,
+		"md5":           input.MD5,
+		"replicas":      input.Replicas,
+		"data_shards":   input.DataShards,
+		"parity_shards": input.ParityShards,
+		"status":        input.Status,
+		"noncurrent":    false,
+		"updated_at":    time.Now(),
+	}
+	if input.Encoding != "" {
+		values["encoding"] = input.Encoding
+	}
+
+	var replaced string
+	var deletions []*PartDeletion
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", input.Name).Error; err != nil {
+			return err
+		}
+
+		// uploads which hold the name aren't current files yet, so they aren't replaced
+		var current File
+		res := tx.Table("files").
+			Where("name = ? AND NOT noncurrent AND status = ? AND id <> ?", input.Name, FileStatusUploaded, id).
+			Find(&current)
+		if res.Error != nil {
+			return res.Error
+		}
+		exists := res.RowsAffected > 0
+
+		if check != nil {
+			var file *File
+			if exists && !current.DeleteMarker {
+				file = &current
+			}
+			if err := check(file); err != nil {
+				return err
+			}
+		}
+
+		if exists {
+			switch mode {
+			case ReplaceSupersede:
+				if err := tx.Table("files").Where("id = ?", current.ID).Update("noncurrent", true).Error; err != nil {
+					return err
+				}
+			case ReplaceDelete:
+				var err error
+				if deletions, err = queuePartDeletions(tx, current.ID); err != nil {
+					return err
+				}
+				if err = tx.Where("id = ?", current.ID).Delete(&File{}).Error; err != nil {
+					return err
+				}
+			default:
+				return ErrAlreadyExists
+			}
+			replaced = current.ID
+		}
+
+		res = tx.Table("files").Where("id = ?", id).Updates(values)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrNotFound
+		}
+
+		// the parts of an uploaded file are known by its file parts
+		return tx.Where("file_id = ?", id).Delete(&PartReservation{}).Error
+	})
+	if err != nil {
+		if e, ok := err.(*pgconn.PgError); ok && e.Code == ConstraintErrorCode {
+			return "", nil, ErrAlreadyExists
+		}
+		return "", nil, err
+	}
+
+	return replaced, deletions, nil
+}
+
+// queuePartDeletions records the deletions of all the parts of the file.
+func queuePartDeletions(tx *gorm.DB, fileID string) ([]*PartDeletion, error) {
+	var fileParts []*FilePart
+	if err := tx.Table("file_parts").Where("file_id = ?", fileID).Find(&fileParts).Error; err != nil {
+		return nil, err
+	}
+
+	var deletions []*PartDeletion
+	for _, fp := range fileParts {
+		deletion := NewPartDeletion(fp.StorageID, fp.RemoteID)
+		deletions = append(deletions, &deletion)
+	}
+
+	if len(deletions) > 0 {
+		if err := tx.CreateInBatches(deletions, len(deletions)).Error; err != nil {
+			return nil, err
+		}
+	}
+	return deletions, nil
+}
+
 func (s storage) GetFile(ctx context.Context, id string) (*File, error) {
 	var file File
 	tx := s.db.WithContext(ctx).Table("files").Where("id = ?", id).Find(&file)
@@ -100,7 +307,8 @@ func (s storage) GetFile(ctx context.Context, id string) (*File, error) {
 
 func (s storage) GetFileByName(ctx context.Context, name string) (*File, error) {
 	var file File
-	tx := s.db.WithContext(ctx).Table("files").Where("name = ?", name).Find(&file)
+	tx := s.db.WithContext(ctx).Table("files").
+		Where("name = ? AND status = ? AND NOT noncurrent AND NOT delete_marker", name, FileStatusUploaded).Find(&file)
 	if tx.Error != nil {
 		return nil, tx.Error
 	}
@@ -111,7 +319,226 @@ func (s storage) GetFileByName(ctx context.Context, name string) (*File, error)
 	return &file, nil
 }
 
+// GetFileVersion returns the uploaded version of the name, current or not.
+// Delete markers have no content, so they aren't returned.
+func (s storage) GetFileVersion(ctx context.Context, name, id string) (*File, error) {
+	var file File
+	tx := s.db.WithContext(ctx).Table("files").
+		Where("id = ? AND name = ? AND status = ? AND NOT delete_marker", id, name, FileStatusUploaded).Find(&file)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return nil, ErrNotFound
+	}
+
+	return &file, nil
+}
+
+// FindFileVersions returns all the versions of the name and its delete markers, the newest first.
+func (s storage) FindFileVersions(ctx context.Context, name string) ([]*File, error) {
+	var files []*File
+	tx := s.db.WithContext(ctx).Table("files").
+		Where("name = ? AND status = ?", name, FileStatusUploaded).
+		Order("updated_at DESC, id").
+		Find(&files)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return files, nil
+}
+
+// CreateDeleteMarker hides the current version of the marker's name behind the marker
+// and returns the ID of the hidden version. It fails with ErrNotFound when the name has
+// no current version. It waits for the writers of the name like ReplaceFile.
+func (s storage) CreateDeleteMarker(ctx context.Context, marker *File) (string, error) {
+	marker.DeleteMarker = true
+	marker.Status = FileStatusUploaded
+	marker.Noncurrent = false
+
+	var hidden File
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", *marker.Name).Error; err != nil {
+			return err
+		}
+
+		res := tx.Table("files").
+			Where("name = ? AND NOT noncurrent AND NOT delete_marker AND status = ?", *marker.Name, FileStatusUploaded).
+			Find(&hidden)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrNotFound
+		}
+
+		if err := tx.Table("files").Where("id = ?", hidden.ID).Update("noncurrent", true).Error; err != nil {
+			return err
+		}
+		return tx.Create(marker).Error
+	})
+	if err != nil {
+		if e, ok := err.(*pgconn.PgError); ok && e.Code == ConstraintErrorCode {
+			return "", ErrAlreadyExists
+		}
+		return "", err
+	}
+	return hidden.ID, nil
+}
+
+// DeleteFile removes the file with its parts and queues the parts for deletion from storages.
+func (s storage) DeleteFile(ctx context.Context, id string) ([]*PartDeletion, error) {
+	var deletions []*PartDeletion
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		if deletions, err = queuePartDeletions(tx, id); err != nil {
+			return err
+		}
+
+		res := tx.Where("id = ?", id).Delete(&File{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return deletions, nil
+}
+
+// DeleteFileVersion removes the version of the name with its parts. When it's the current
+// one, the newest of the remaining versions becomes current.
+func (s storage) DeleteFileVersion(ctx context.Context, name, id string) ([]*PartDeletion, error) {
+	var deletions []*PartDeletion
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// the version which becomes current isn't changed by other writers of the name
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", name).Error; err != nil {
+			return err
+		}
+
+		var file File
+		res := tx.Table("files").Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND name = ? AND status = ?", id, name, FileStatusUploaded).Find(&file)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrNotFound
+		}
+
+		var err error
+		if deletions, err = queuePartDeletions(tx, id); err != nil {
+			return err
+		}
+
+		if err = tx.Where("id = ?", id).Delete(&File{}).Error; err != nil {
+			return err
+		}
+
+		if file.Noncurrent {
+			return nil
+		}
+
+		return tx.Exec(`
+			UPDATE files SET noncurrent = false WHERE id = (
+				SELECT id FROM files WHERE name = ? AND status = ? AND noncurrent
+			ORDER BY updated_at DESC, id LIMIT 1
+			)`, name, FileStatusUploaded).Error
+	})
+	if err != nil {
+		if e, ok := err.(*pgconn.PgError); ok && e.Code == ConstraintErrorCode {
+			return nil, ErrAlreadyExists
+		}
+		return nil, err
+	}
+
+	return deletions, nil
+}
+
+// FindExpiredUploads returns the files which were prepared or initiated for an upload and
+// weren't changed since updatedBefore, neither they got new parts since then.
+func (s storage) FindExpiredUploads(ctx context.Context, updatedBefore time.Time, limit int) ([]*File, error) {
+	var files []*File
+	tx := s.db.WithContext(ctx).Table("files").
+		Where("status IN ? AND updated_at < ?", []FileStatus{FileStatusCreated, FileStatusUploading, FileStatusCompleting}, updatedBefore).
+		Where("NOT EXISTS (SELECT 1 FROM file_parts WHERE file_parts.file_id = files.id AND file_parts.created_at >= ?)", updatedBefore).
+		Order("updated_at").
+		Limit(limit).
+		Find(&files)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return files, nil
+}
+
+// FindFilesByPrefix returns uploaded files whose names start with the prefix
+// and come after startAfter in byte order.
+func (s storage) FindFilesByPrefix(ctx context.Context, prefix, startAfter string, limit int) ([]*File, error) {
+	var files []*File
+	tx := s.db.WithContext(ctx).Table("files").
+		Where("status = ? AND NOT noncurrent AND NOT delete_marker", FileStatusUploaded).
+		Where(`name COLLATE "C" LIKE ?`, escapeLike(prefix)+"%").
+		Where(`name COLLATE "C" > ?`, startAfter).
+		Order(`name COLLATE "C"`).
+		Limit(limit).
+		Find(&files)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return files, nil
+}
+
+func (s storage) CreateBucket(ctx context.Context, bucket *Bucket) error {
+	tx := s.db.WithContext(ctx).Create(bucket)
+	if tx.Error != nil {
+		if e, ok := tx.Error.(*pgconn.PgError); ok && e.Code == ConstraintErrorCode {
+			return ErrAlreadyExists
+		}
+		return tx.Error
+	}
+	return nil
+}
+
+func (s storage) GetBucket(ctx context.Context, name string) (*Bucket, error) {
+	var bucket Bucket
+	tx := s.db.WithContext(ctx).Table("buckets").Where("name = ?", name).Find(&bucket)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return nil, ErrNotFound
+	}
+	return &bucket, nil
+}
+
+func (s storage) FindBuckets(ctx context.Context) ([]*Bucket, error) {
+	var buckets []*Bucket
+	if err := s.db.WithContext(ctx).Table("buckets").Order("name").Find(&buckets).Error; err != nil {
+		return nil, err
+	}
+	return buckets, nil
+}
+
+func (s storage) DeleteBucket(ctx context.Context, name string) error {
+	tx := s.db.WithContext(ctx).Where("name = ?", name).Delete(&Bucket{})
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// CreateOrUpdateStorage registers the storage or, when it's known already, marks it alive.
+// Registrations and heartbeats both go here.
 func (s storage) CreateOrUpdateStorage(ctx context.Context, fileStorage *Storage) error {
+	now := time.Now()
 	return s.db.Clauses(clause.OnConflict{
 		Columns: []clause.Column{{Name: "id"}},
 		DoUpdates: []clause.Assignment{
@@ -119,9 +546,21 @@ func (s storage) CreateOrUpdateStorage(ctx context.Context, fileStorage *Storage
 				Column: clause.Column{Name: "host"},
 				Value:  fileStorage.Host,
 			},
+			{
+				Column: clause.Column{Name: "zone"},
+				Value:  fileStorage.Zone,
+			},
+			{
+				Column: clause.Column{Name: "last_seen_at"},
+				Value:  now,
+			},
+			{
+				Column: clause.Column{Name: "state"},
+				Value:  StorageStateAlive,
+			},
 			{
 				Column: clause.Column{Name: "updated_at"},
-				Value:  time.Now(),
+				Value:  now,
 			},
 		},
 	}).WithContext(ctx).Create(fileStorage).Error
@@ -139,14 +578,121 @@ func (s storage) GetStorage(ctx context.Context, id string) (*Storage, error) {
 	return &result, nil
 }
 
+// FindStorages returns the storages which are alive and aren't drained, so new parts
+// aren't placed on the others.
 func (s storage) FindStorages(ctx context.Context) ([]*Storage, error) {
 	var result []*Storage
-	if err := s.db.WithContext(ctx).Table("storages").Find(&result).Error; err != nil {
-		return nil, err
+	tx := s.db.WithContext(ctx).Table("storages").
+		Where("state = ? AND draining_at IS NULL AND retired_at IS NULL", StorageStateAlive).
+		Find(&result)
+	if tx.Error != nil {
+		return nil, tx.Error
 	}
 	return result, nil
 }
 
+// UpdateStorageUsage saves the capacity reported by the storage.
+func (s storage) UpdateStorageUsage(ctx context.Context, id string, totalBytes, usedBytes, freeBytes int64) error {
+	tx := s.db.WithContext(ctx).Table("storages").Where("id = ?", id).Updates(map[string]interface{}{
+		"total_bytes": totalBytes,
+		"used_bytes":  usedBytes,
+		"free_bytes":  freeBytes,
+		"updated_at":  time.Now(),
+	})
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DrainStorage makes the storage take no new parts, so they can be moved away from it.
+// Draining a storage twice isn't an error.
+func (s storage) DrainStorage(ctx context.Context, id string) error {
+	tx := s.db.WithContext(ctx).Table("storages").
+		Where("id = ? AND retired_at IS NULL", id).
+		Updates(map[string]interface{}{
+			"draining_at": gorm.Expr("COALESCE(draining_at, ?)", time.Now()),
+			"updated_at":  time.Now(),
+		})
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// FindDrainingStorages returns the storages which are drained but aren't retired yet.
+func (s storage) FindDrainingStorages(ctx context.Context) ([]*Storage, error) {
+	var result []*Storage
+	tx := s.db.WithContext(ctx).Table("storages").
+		Where("draining_at IS NOT NULL AND retired_at IS NULL").
+		Order("draining_at").
+		Find(&result)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return result, nil
+}
+
+func (s storage) CountStorageParts(ctx context.Context, id string) (int64, error) {
+	var count int64
+	tx := s.db.WithContext(ctx).Table("file_parts").Where("storage_id = ?", id).Count(&count)
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+	return count, nil
+}
+
+// RetireStorage marks the drained storage as safe to remove. It fails with ErrNotFound
+// when the storage isn't draining or still keeps parts.
+func (s storage) RetireStorage(ctx context.Context, id string) error {
+	tx := s.db.WithContext(ctx).Exec(`
+		UPDATE storages SET retired_at = ?, updated_at = ?
+		WHERE id = ? AND draining_at IS NOT NULL AND retired_at IS NULL
+			AND NOT EXISTS (SELECT 1 FROM file_parts WHERE storage_id = ?)`,
+		time.Now(), time.Now(), id, id)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UpdateStorageStates marks the storages which weren't seen since suspectBefore as suspect
+// and since deadBefore as dead. It returns the storages which have just died.
+func (s storage) UpdateStorageStates(ctx context.Context, suspectBefore, deadBefore time.Time) ([]*Storage, error) {
+	var dead []*Storage
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Table("storages").
+			Where("state = ? AND last_seen_at < ?", StorageStateAlive, suspectBefore).
+			Updates(map[string]any{
+				"state":      StorageStateSuspect,
+				"updated_at": time.Now(),
+			}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&dead).Clauses(clause.Returning{}).
+			Where("state <> ? AND last_seen_at < ?", StorageStateDead, deadBefore).
+			Updates(map[string]any{
+				"state":      StorageStateDead,
+				"updated_at": time.Now(),
+			}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dead, nil
+}
+
 func (s storage) CreateFilePart(ctx context.Context, filePart *FilePart) error {
 	tx := s.db.WithContext(ctx).Create(filePart)
 	if tx.Error != nil {
@@ -166,6 +712,18 @@ func (s storage) CreateFileParts(ctx context.Context, fileParts []FilePart) erro
 	return nil
 }
 
+func (s storage) GetFilePart(ctx context.Context, id string) (*FilePart, error) {
+	var filePart FilePart
+	tx := s.db.WithContext(ctx).Table("file_parts").Where("id = ?", id).Find(&filePart)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	if tx.RowsAffected == 0 {
+		return nil, ErrNotFound
+	}
+	return &filePart, nil
+}
+
 func (s storage) FindFileParts(ctx context.Context, fileID string) ([]*FilePart, error) {
 	var fileParts []*FilePart
 	tx := s.db.WithContext(ctx).Table("file_parts").
@@ -175,3 +733,272 @@ func (s storage) FindFileParts(ctx context.Context, fileID string) ([]*FilePart,
 	}
 	return fileParts, nil
 }
+
+// ReplaceFileParts removes the parts with the given seqs, queues them for deletion
+// from storages and creates the new parts in their place. New parts are only taken
+// while the file is created or uploading, otherwise it fails with ErrNotFound.
+func (s storage) ReplaceFileParts(ctx context.Context, fileID string, seqs []int, fileParts []FilePart) ([]*PartDeletion, error) {
+	var deletions []*PartDeletion
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// the file is locked, so its status can't change until the parts are replaced
+		var file File
+		res := tx.Table("files").Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", fileID).Find(&file)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		if len(fileParts) > 0 && file.Status != FileStatusCreated && file.Status != FileStatusUploading {
+			return ErrNotFound
+		}
+		if len(seqs) > 0 {
+			var oldFileParts []*FilePart
+			err := tx.Table("file_parts").Where("file_id = ? AND seq IN ?", fileID, seqs).
+				Find(&oldFileParts).Error
+			if err != nil {
+				return err
+			}
+
+			err = tx.Where("file_id = ? AND seq IN ?", fileID, seqs).Delete(&FilePart{}).Error
+			if err != nil {
+				return err
+			}
+
+			for _, fp := range oldFileParts {
+				deletion := NewPartDeletion(fp.StorageID, fp.RemoteID)
+				deletions = append(deletions, &deletion)
+			}
+		}
+
+		if len(deletions) > 0 {
+			if err := tx.CreateInBatches(deletions, len(deletions)).Error; err != nil {
+				return err
+			}
+		}
+
+		if len(fileParts) > 0 {
+			if err := tx.CreateInBatches(fileParts, len(fileParts)).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return deletions, nil
+}
+
+// ReplaceFilePart swaps a single replica or shard for a new one and queues the old one
+// for deletion from its storage. Its repair, if any, is removed with it.
+func (s storage) ReplaceFilePart(ctx context.Context, id string, filePart FilePart) (*PartDeletion, error) {
+	var deletion PartDeletion
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var old FilePart
+		res := tx.Table("file_parts").Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ?", id).Find(&old)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrNotFound
+		}
+
+		if err := tx.Where("id = ?", id).Delete(&FilePart{}).Error; err != nil {
+			return err
+		}
+
+		deletion = NewPartDeletion(old.StorageID, old.RemoteID)
+		if err := tx.Create(&deletion).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&filePart).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &deletion, nil
+}
+
+// FindPartsToVerify returns the parts which were never verified or verified
+// before the given time, the least recently verified go first.
+func (s storage) FindPartsToVerify(ctx context.Context, verifiedBefore time.Time, limit int) ([]*FilePart, error) {
+	var fileParts []*FilePart
+	tx := s.db.WithContext(ctx).Table("file_parts").
+		Where("verified_at IS NULL OR verified_at < ?", verifiedBefore).
+		Order("verified_at NULLS FIRST").
+		Limit(limit).
+		Find(&fileParts)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return fileParts, nil
+}
+
+// FindKnownRemoteIDs returns the remote IDs of the storage which are kept as file parts,
+// reserved for files being uploaded or queued for deletion.
+func (s storage) FindKnownRemoteIDs(ctx context.Context, storageID string, remoteIDs []string) ([]string, error) {
+	var known []string
+	if len(remoteIDs) == 0 {
+		return known, nil
+	}
+
+	tx := s.db.WithContext(ctx).Raw(`
+		SELECT remote_id FROM file_parts WHERE storage_id = ? AND remote_id IN ?
+		UNION
+		SELECT remote_id FROM part_reservations WHERE storage_id = ? AND remote_id IN ?
+		UNION
+		SELECT remote_id FROM part_deletions WHERE storage_id = ? AND remote_id IN ?`,
+		storageID, remoteIDs, storageID, remoteIDs, storageID, remoteIDs).Scan(&known)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return known, nil
+}
+
+// FindStorageParts returns the parts of uploaded files which the storage keeps and which
+// aren't larger than maxSize, the largest go first. The parts with the IDs to skip aren't returned.
+func (s storage) FindStorageParts(ctx context.Context, storageID string, maxSize int64, skip []string, limit int) ([]*FilePart, error) {
+	var fileParts []*FilePart
+	tx := s.db.WithContext(ctx).Table("file_parts").
+		Select("file_parts.*").
+		Joins("JOIN files ON files.id = file_parts.file_id").
+		Where("file_parts.storage_id = ? AND files.status = ? AND file_parts.size <= ?", storageID, FileStatusUploaded, maxSize)
+	if len(skip) > 0 {
+		tx = tx.Where("file_parts.id NOT IN ?", skip)
+	}
+	tx = tx.Order("file_parts.size DESC").Limit(limit).Find(&fileParts)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return fileParts, nil
+}
+
+func (s storage) UpdatePartVerification(ctx context.Context, id string, status PartStatus) error {
+	tx := s.db.WithContext(ctx).Table("file_parts").Where("id = ?", id).
+		Updates(map[string]any{
+			"verified_at":   time.Now(),
+			"verify_status": status,
+		})
+
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if tx.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// CreatePartRepair queues the part for repair, a part which is queued already is left as is.
+func (s storage) CreatePartRepair(ctx context.Context, repair *PartRepair) error {
+	return s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "file_part_id"}},
+		DoNothing: true,
+	}).Create(repair).Error
+}
+
+// CreateStorageRepairs queues all the parts kept by the storage for repair.
+func (s storage) CreateStorageRepairs(ctx context.Context, storageID string) (int64, error) {
+	tx := s.db.WithContext(ctx).Exec(`
+		INSERT INTO part_repairs (id, file_part_id, reason)
+		SELECT uuid_generate_v4(), id, ? FROM file_parts WHERE storage_id = ?
+		ON CONFLICT (file_part_id) DO NOTHING`, PartStatusDead, storageID)
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+	return tx.RowsAffected, nil
+}
+
+func (s storage) FindPartRepairs(ctx context.Context, olderThan time.Time, limit int) ([]*PartRepair, error) {
+	var repairs []*PartRepair
+	tx := s.db.WithContext(ctx).Table("part_repairs").
+		Where("updated_at < ?", olderThan).
+		Order("updated_at").
+		Limit(limit).
+		Find(&repairs)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return repairs, nil
+}
+
+func (s storage) UpdatePartRepairAttempt(ctx context.Context, id string, lastError string) error {
+	tx := s.db.WithContext(ctx).Table("part_repairs").Where("id = ?", id).
+		Updates(map[string]any{
+			"attempts":   gorm.Expr("attempts + 1"),
+			"last_error": lastError,
+			"updated_at": time.Now(),
+		})
+
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if tx.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s storage) RemovePartRepair(ctx context.Context, id string) error {
+	return s.db.WithContext(ctx).Where("id = ?", id).Delete(&PartRepair{}).Error
+}
+
+func (s storage) CreatePartReservations(ctx context.Context, reservations []PartReservation) error {
+	if len(reservations) == 0 {
+		return nil
+	}
+	return s.db.WithContext(ctx).CreateInBatches(reservations, len(reservations)).Error
+}
+
+func (s storage) CreatePartDeletions(ctx context.Context, deletions []PartDeletion) error {
+	return s.db.WithContext(ctx).CreateInBatches(deletions, len(deletions)).Error
+}
+
+func (s storage) FindPartDeletions(ctx context.Context, olderThan time.Time, limit int) ([]*PartDeletion, error) {
+	var deletions []*PartDeletion
+	tx := s.db.WithContext(ctx).Table("part_deletions").
+		Where("updated_at < ?", olderThan).
+		Order("updated_at").
+		Limit(limit).
+		Find(&deletions)
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return deletions, nil
+}
+
+func (s storage) UpdatePartDeletionAttempt(ctx context.Context, id string, lastError string) error {
+	tx := s.db.WithContext(ctx).Table("part_deletions").Where("id = ?", id).
+		Updates(map[string]any{
+			"attempts":   gorm.Expr("attempts + 1"),
+			"last_error": lastError,
+			"updated_at": time.Now(),
+		})
+
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if tx.RowsAffected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s storage) RemovePartDeletion(ctx context.Context, id string) error {
+	return s.db.WithContext(ctx).Where("id = ?", id).Delete(&PartDeletion{}).Error
+}
+
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+}
@@ -2,7 +2,9 @@ package repository_test
 
 import (
 	"context"
+	"errors"
 	"testing"
+	"time"
 
 	repository2 "github.com/blkmlk/file-storage/internal/services/repository"
 
@@ -58,6 +60,7 @@ func (t *testSuite) TestCreateUpdateAndGetFile() {
 		Name:        "name-1",
 		ContentType: "application/zip",
 		Size:        100,
+		Hash:        "hash",
 		Status:      repository2.FileStatusUploaded,
 	})
 	t.Require().NoError(err)
@@ -75,6 +78,7 @@ func (t *testSuite) TestCreateUpdateAndGetFile() {
 	t.Require().Equal(repository2.FileStatusUploaded, foundFile.Status)
 	t.Require().NotNil(foundFile.Name)
 	t.Require().Equal("name-1", *foundFile.Name)
+	t.Require().Equal("hash", foundFile.Hash)
 
 	foundFile, err = t.repository.GetFileByName(ctx, "unknown")
 	t.Require().ErrorIs(err, repository2.ErrNotFound)
@@ -109,6 +113,142 @@ func (t *testSuite) TestCreateFileParts() {
 	t.Require().Len(uniqueIDs, len(foundFileParts))
 }
 
+func (t *testSuite) TestCreateFilePartReplicas() {
+	ctx := context.Background()
+	file := repository2.NewFile()
+
+	err := t.repository.CreateFile(ctx, &file)
+	t.Require().NoError(err)
+
+	storage1 := repository2.NewStorage(uuid.NewString(), "127.0.0.1:9998")
+	err = t.repository.CreateOrUpdateStorage(ctx, &storage1)
+	t.Require().NoError(err)
+
+	storage2 := repository2.NewStorage(uuid.NewString(), "127.0.0.1:9999")
+	err = t.repository.CreateOrUpdateStorage(ctx, &storage2)
+	t.Require().NoError(err)
+
+	filePart := repository2.NewFilePart(file.ID, uuid.NewString(), 0, 100, storage1.ID, uuid.NewString())
+	err = t.repository.CreateFilePart(ctx, &filePart)
+	t.Require().NoError(err)
+
+	filePart = repository2.NewFilePart(file.ID, uuid.NewString(), 0, 100, storage2.ID, uuid.NewString())
+	err = t.repository.CreateFilePart(ctx, &filePart)
+	t.Require().NoError(err)
+
+	filePart = repository2.NewFilePart(file.ID, uuid.NewString(), 0, 100, storage2.ID, uuid.NewString())
+	err = t.repository.CreateFilePart(ctx, &filePart)
+	t.Require().ErrorIs(err, repository2.ErrAlreadyExists)
+
+	foundFileParts, err := t.repository.FindFileParts(ctx, file.ID)
+	t.Require().NoError(err)
+	t.Require().Len(foundFileParts, 2)
+}
+
+func (t *testSuite) TestDeleteFile() {
+	ctx := context.Background()
+	file := repository2.NewFile()
+
+	err := t.repository.CreateFile(ctx, &file)
+	t.Require().NoError(err)
+
+	storage := repository2.NewStorage(uuid.NewString(), "127.0.0.1:9999")
+	err = t.repository.CreateOrUpdateStorage(ctx, &storage)
+	t.Require().NoError(err)
+
+	for i := 0; i < 3; i++ {
+		filePart := repository2.NewFilePart(file.ID, uuid.NewString(), i, 100, storage.ID, uuid.NewString())
+		err = t.repository.CreateFilePart(ctx, &filePart)
+		t.Require().NoError(err)
+	}
+
+	deletions, err := t.repository.DeleteFile(ctx, file.ID)
+	t.Require().NoError(err)
+	t.Require().Len(deletions, 3)
+
+	_, err = t.repository.GetFile(ctx, file.ID)
+	t.Require().ErrorIs(err, repository2.ErrNotFound)
+
+	foundFileParts, err := t.repository.FindFileParts(ctx, file.ID)
+	t.Require().NoError(err)
+	t.Require().Empty(foundFileParts)
+
+	_, err = t.repository.DeleteFile(ctx, file.ID)
+	t.Require().ErrorIs(err, repository2.ErrNotFound)
+
+	err = t.repository.UpdatePartDeletionAttempt(ctx, deletions[0].ID, "unreachable")
+	t.Require().NoError(err)
+
+	err = t.repository.RemovePartDeletion(ctx, deletions[1].ID)
+	t.Require().NoError(err)
+
+	foundDeletions, err := t.repository.FindPartDeletions(ctx, time.Now().Add(time.Minute), 10)
+	t.Require().NoError(err)
+	t.Require().Len(foundDeletions, 2)
+	t.Require().Equal(deletions[2].ID, foundDeletions[0].ID)
+	t.Require().Equal(1, foundDeletions[1].Attempts)
+	t.Require().Equal("unreachable", foundDeletions[1].LastError)
+}
+
+func (t *testSuite) TestReplaceFileParts() {
+	ctx := context.Background()
+	file := repository2.NewFile()
+	name := "multipart"
+	file.Name = &name
+	file.Status = repository2.FileStatusUploading
+
+	err := t.repository.CreateFile(ctx, &file)
+	t.Require().NoError(err)
+
+	_, err = t.repository.GetFileByName(ctx, name)
+	t.Require().ErrorIs(err, repository2.ErrNotFound)
+
+	storage := repository2.NewStorage(uuid.NewString(), "127.0.0.1:9999")
+	err = t.repository.CreateOrUpdateStorage(ctx, &storage)
+	t.Require().NoError(err)
+
+	for i := 1; i <= 3; i++ {
+		filePart := repository2.NewFilePart(file.ID, uuid.NewString(), i, 100, storage.ID, uuid.NewString())
+		err = t.repository.CreateFilePart(ctx, &filePart)
+		t.Require().NoError(err)
+	}
+
+	newPart := repository2.NewFilePart(file.ID, uuid.NewString(), 2, 200, storage.ID, uuid.NewString())
+	deletions, err := t.repository.ReplaceFileParts(ctx, file.ID, []int{2}, []repository2.FilePart{newPart})
+	t.Require().NoError(err)
+	t.Require().Len(deletions, 1)
+
+	deletions, err = t.repository.ReplaceFileParts(ctx, file.ID, []int{3}, nil)
+	t.Require().NoError(err)
+	t.Require().Len(deletions, 1)
+
+	foundFileParts, err := t.repository.FindFileParts(ctx, file.ID)
+	t.Require().NoError(err)
+	t.Require().Len(foundFileParts, 2)
+	for _, fp := range foundFileParts {
+		if fp.Seq == 2 {
+			t.Require().Equal(newPart.ID, fp.ID)
+		}
+	}
+
+	err = t.repository.UpdateFileStatus(ctx, file.ID, repository2.FileStatusUploading, repository2.FileStatusCompleting)
+	t.Require().NoError(err)
+	err = t.repository.UpdateFileStatus(ctx, file.ID, repository2.FileStatusUploading, repository2.FileStatusCompleting)
+	t.Require().ErrorIs(err, repository2.ErrNotFound)
+
+	// a completing upload takes no more parts but unlisted ones can still be removed
+	latePart := repository2.NewFilePart(file.ID, uuid.NewString(), 4, 100, storage.ID, uuid.NewString())
+	_, err = t.repository.ReplaceFileParts(ctx, file.ID, []int{4}, []repository2.FilePart{latePart})
+	t.Require().ErrorIs(err, repository2.ErrNotFound)
+
+	deletions, err = t.repository.ReplaceFileParts(ctx, file.ID, []int{1}, nil)
+	t.Require().NoError(err)
+	t.Require().Len(deletions, 1)
+
+	_, err = t.repository.ReplaceFileParts(ctx, uuid.NewString(), []int{1}, nil)
+	t.Require().ErrorIs(err, repository2.ErrNotFound)
+}
+
 func (t *testSuite) TestCreateStorage() {
 	ctx := context.Background()
 
@@ -133,4 +273,521 @@ func (t *testSuite) TestCreateStorage() {
 	foundStorage, err := t.repository.GetStorage(ctx, storage.ID)
 	t.Require().NoError(err)
 	t.Require().Equal(foundStorages[0], foundStorage)
+
+	storage.Zone = "rack-1"
+	t.Require().NoError(t.repository.CreateOrUpdateStorage(ctx, &storage))
+	foundStorage, err = t.repository.GetStorage(ctx, storage.ID)
+	t.Require().NoError(err)
+	t.Require().Equal("rack-1", foundStorage.Zone)
+
+	t.Require().NoError(t.repository.UpdateStorageUsage(ctx, storage.ID, 1000, 400, 500))
+	foundStorage, err = t.repository.GetStorage(ctx, storage.ID)
+	t.Require().NoError(err)
+	t.Require().EqualValues(1000, foundStorage.TotalBytes)
+	t.Require().EqualValues(400, foundStorage.UsedBytes)
+	t.Require().EqualValues(500, foundStorage.FreeBytes)
+
+	err = t.repository.UpdateStorageUsage(ctx, uuid.NewString(), 1000, 400, 500)
+	t.Require().ErrorIs(err, repository2.ErrNotFound)
+}
+
+func (t *testSuite) TestBuckets() {
+	ctx := context.Background()
+
+	bucket := repository2.NewBucket("bucket-1")
+	t.Require().NoError(t.repository.CreateBucket(ctx, &bucket))
+	t.Require().ErrorIs(t.repository.CreateBucket(ctx, &bucket), repository2.ErrAlreadyExists)
+
+	found, err := t.repository.GetBucket(ctx, "bucket-1")
+	t.Require().NoError(err)
+	t.Require().Equal(bucket.ID, found.ID)
+
+	buckets, err := t.repository.FindBuckets(ctx)
+	t.Require().NoError(err)
+	t.Require().Len(buckets, 1)
+
+	t.Require().NoError(t.repository.DeleteBucket(ctx, "bucket-1"))
+	t.Require().ErrorIs(t.repository.DeleteBucket(ctx, "bucket-1"), repository2.ErrNotFound)
+
+	_, err = t.repository.GetBucket(ctx, "bucket-1")
+	t.Require().ErrorIs(err, repository2.ErrNotFound)
+}
+
+func (t *testSuite) TestFindFilesByPrefix() {
+	ctx := context.Background()
+
+	for _, name := range []string{"b/a_1", "b/a/2", "b/ab", "b/c", "bb/a"} {
+		file := repository2.NewFile()
+		t.Require().NoError(t.repository.CreateFile(ctx, &file))
+		t.Require().NoError(t.repository.UpdateFileInfo(ctx, file.ID, repository2.UpdateFileInfoInput{
+			Name:   name,
+			Status: repository2.FileStatusUploaded,
+		}))
+	}
+
+	names := func(files []*repository2.File) []string {
+		var result []string
+		for _, f := range files {
+			result = append(result, *f.Name)
+		}
+		return result
+	}
+
+	files, err := t.repository.FindFilesByPrefix(ctx, "b/", "", 10)
+	t.Require().NoError(err)
+	t.Require().Equal([]string{"b/a/2", "b/a_1", "b/ab", "b/c"}, names(files))
+
+	files, err = t.repository.FindFilesByPrefix(ctx, "b/a_", "", 10)
+	t.Require().NoError(err)
+	t.Require().Equal([]string{"b/a_1"}, names(files))
+
+	files, err = t.repository.FindFilesByPrefix(ctx, "b/", "b/a_1", 2)
+	t.Require().NoError(err)
+	t.Require().Equal([]string{"b/ab", "b/c"}, names(files))
+}
+
+func (t *testSuite) TestCreatePartDeletions() {
+	ctx := context.Background()
+
+	storage := repository2.NewStorage(uuid.NewString(), "127.0.0.1:5000")
+	t.Require().NoError(t.repository.CreateOrUpdateStorage(ctx, &storage))
+
+	deletions := []repository2.PartDeletion{
+		repository2.NewPartDeletion(storage.ID, uuid.NewString()),
+		repository2.NewPartDeletion(storage.ID, uuid.NewString()),
+	}
+	t.Require().NoError(t.repository.CreatePartDeletions(ctx, deletions))
+
+	found, err := t.repository.FindPartDeletions(ctx, time.Now().Add(time.Minute), 10)
+	t.Require().NoError(err)
+	t.Require().Len(found, 2)
+}
+
+func (t *testSuite) TestPartVerification() {
+	ctx := context.Background()
+
+	storage := repository2.NewStorage(uuid.NewString(), "127.0.0.1:5000")
+	t.Require().NoError(t.repository.CreateOrUpdateStorage(ctx, &storage))
+
+	file := repository2.NewFile()
+	t.Require().NoError(t.repository.CreateFile(ctx, &file))
+
+	var fileParts []repository2.FilePart
+	for i := 0; i < 3; i++ {
+		fileParts = append(fileParts, repository2.NewFilePart(file.ID, uuid.NewString(), i, 100, storage.ID, uuid.NewString()))
+	}
+	t.Require().NoError(t.repository.CreateFileParts(ctx, fileParts))
+
+	found, err := t.repository.FindPartsToVerify(ctx, time.Now(), 10)
+	t.Require().NoError(err)
+	t.Require().Len(found, 3)
+
+	t.Require().NoError(t.repository.UpdatePartVerification(ctx, fileParts[0].ID, repository2.PartStatusOK))
+	t.Require().NoError(t.repository.UpdatePartVerification(ctx, fileParts[1].ID, repository2.PartStatusCorrupted))
+	t.Require().ErrorIs(t.repository.UpdatePartVerification(ctx, uuid.NewString(), repository2.PartStatusOK), repository2.ErrNotFound)
+
+	// parts which were never verified go first
+	found, err = t.repository.FindPartsToVerify(ctx, time.Now().Add(time.Minute), 10)
+	t.Require().NoError(err)
+	t.Require().Len(found, 3)
+	t.Require().Equal(fileParts[2].ID, found[0].ID)
+	t.Require().Nil(found[0].VerifiedAt)
+
+	found, err = t.repository.FindPartsToVerify(ctx, time.Now().Add(-time.Minute), 10)
+	t.Require().NoError(err)
+	t.Require().Len(found, 1)
+	t.Require().Equal(fileParts[2].ID, found[0].ID)
+
+	repair := repository2.NewPartRepair(fileParts[1].ID, repository2.PartStatusCorrupted)
+	t.Require().NoError(t.repository.CreatePartRepair(ctx, &repair))
+
+	// a part is queued only once
+	repair = repository2.NewPartRepair(fileParts[1].ID, repository2.PartStatusMissing)
+	t.Require().NoError(t.repository.CreatePartRepair(ctx, &repair))
+}
+
+func (t *testSuite) TestPartRepairs() {
+	ctx := context.Background()
+
+	storage := repository2.NewStorage(uuid.NewString(), "127.0.0.1:5000")
+	t.Require().NoError(t.repository.CreateOrUpdateStorage(ctx, &storage))
+
+	file := repository2.NewFile()
+	t.Require().NoError(t.repository.CreateFile(ctx, &file))
+
+	filePart := repository2.NewFilePart(file.ID, uuid.NewString(), 0, 100, storage.ID, uuid.NewString())
+	t.Require().NoError(t.repository.CreateFilePart(ctx, &filePart))
+
+	found, err := t.repository.GetFilePart(ctx, filePart.ID)
+	t.Require().NoError(err)
+	t.Require().Equal(filePart.RemoteID, found.RemoteID)
+
+	_, err = t.repository.GetFilePart(ctx, uuid.NewString())
+	t.Require().ErrorIs(err, repository2.ErrNotFound)
+
+	repair := repository2.NewPartRepair(filePart.ID, repository2.PartStatusMissing)
+	t.Require().NoError(t.repository.CreatePartRepair(ctx, &repair))
+	t.Require().NoError(t.repository.UpdatePartRepairAttempt(ctx, repair.ID, "storage is unavailable"))
+
+	repairs, err := t.repository.FindPartRepairs(ctx, time.Now().Add(time.Minute), 10)
+	t.Require().NoError(err)
+	t.Require().Len(repairs, 1)
+	t.Require().Equal(1, repairs[0].Attempts)
+	t.Require().Equal("storage is unavailable", repairs[0].LastError)
+
+	// the repair is removed with the replaced part
+	newPart := repository2.NewFilePart(file.ID, uuid.NewString(), 0, 100, storage.ID, filePart.Hash)
+	deletion, err := t.repository.ReplaceFilePart(ctx, filePart.ID, newPart)
+	t.Require().NoError(err)
+	t.Require().Equal(filePart.RemoteID, deletion.RemoteID)
+
+	repairs, err = t.repository.FindPartRepairs(ctx, time.Now().Add(time.Minute), 10)
+	t.Require().NoError(err)
+	t.Require().Empty(repairs)
+
+	fileParts, err := t.repository.FindFileParts(ctx, file.ID)
+	t.Require().NoError(err)
+	t.Require().Len(fileParts, 1)
+	t.Require().Equal(newPart.ID, fileParts[0].ID)
+
+	_, err = t.repository.ReplaceFilePart(ctx, filePart.ID, repository2.NewFilePart(file.ID, uuid.NewString(), 0, 100, storage.ID, ""))
+	t.Require().ErrorIs(err, repository2.ErrNotFound)
+}
+
+func (t *testSuite) TestStorageStates() {
+	ctx := context.Background()
+
+	storage := repository2.NewStorage(uuid.NewString(), "127.0.0.1:5000")
+	t.Require().NoError(t.repository.CreateOrUpdateStorage(ctx, &storage))
+
+	file := repository2.NewFile()
+	t.Require().NoError(t.repository.CreateFile(ctx, &file))
+
+	filePart := repository2.NewFilePart(file.ID, uuid.NewString(), 0, 100, storage.ID, uuid.NewString())
+	t.Require().NoError(t.repository.CreateFilePart(ctx, &filePart))
+
+	// the storage was seen a moment ago, so it becomes suspect but isn't dead yet
+	dead, err := t.repository.UpdateStorageStates(ctx, time.Now().Add(time.Minute), time.Now().Add(-time.Minute))
+	t.Require().NoError(err)
+	t.Require().Empty(dead)
+
+	found, err := t.repository.GetStorage(ctx, storage.ID)
+	t.Require().NoError(err)
+	t.Require().Equal(repository2.StorageStateSuspect, found.State)
+
+	storages, err := t.repository.FindStorages(ctx)
+	t.Require().NoError(err)
+	t.Require().Empty(storages)
+
+	dead, err = t.repository.UpdateStorageStates(ctx, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	t.Require().NoError(err)
+	t.Require().Len(dead, 1)
+	t.Require().Equal(storage.ID, dead[0].ID)
+
+	// a dead storage is reported once
+	dead, err = t.repository.UpdateStorageStates(ctx, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	t.Require().NoError(err)
+	t.Require().Empty(dead)
+
+	queued, err := t.repository.CreateStorageRepairs(ctx, storage.ID)
+	t.Require().NoError(err)
+	t.Require().EqualValues(1, queued)
+
+	repairs, err := t.repository.FindPartRepairs(ctx, time.Now().Add(time.Minute), 10)
+	t.Require().NoError(err)
+	t.Require().Len(repairs, 1)
+	t.Require().Equal(repository2.PartStatusDead, repairs[0].Reason)
+
+	// a heartbeat brings the storage back
+	t.Require().NoError(t.repository.CreateOrUpdateStorage(ctx, &storage))
+	storages, err = t.repository.FindStorages(ctx)
+	t.Require().NoError(err)
+	t.Require().Len(storages, 1)
+}
+
+func (t *testSuite) TestFindStorageParts() {
+	ctx := context.Background()
+
+	storage := repository2.NewStorage(uuid.NewString(), "127.0.0.1:5000")
+	t.Require().NoError(t.repository.CreateOrUpdateStorage(ctx, &storage))
+
+	file := repository2.NewFile()
+	t.Require().NoError(t.repository.CreateFile(ctx, &file))
+
+	small := repository2.NewFilePart(file.ID, uuid.NewString(), 0, 100, storage.ID, "")
+	large := repository2.NewFilePart(file.ID, uuid.NewString(), 1, 200, storage.ID, "")
+	t.Require().NoError(t.repository.CreateFileParts(ctx, []repository2.FilePart{small, large}))
+
+	// parts of files which aren't uploaded aren't moved
+	parts, err := t.repository.FindStorageParts(ctx, storage.ID, 1000, nil, 10)
+	t.Require().NoError(err)
+	t.Require().Empty(parts)
+
+	t.Require().NoError(t.repository.UpdateFileInfo(ctx, file.ID, repository2.UpdateFileInfoInput{
+		Name:     uuid.NewString(),
+		Size:     300,
+		Replicas: 1,
+		Status:   repository2.FileStatusUploaded,
+	}))
+
+	parts, err = t.repository.FindStorageParts(ctx, storage.ID, 1000, nil, 10)
+	t.Require().NoError(err)
+	t.Require().Len(parts, 2)
+	t.Require().Equal(large.ID, parts[0].ID)
+
+	parts, err = t.repository.FindStorageParts(ctx, storage.ID, 150, nil, 10)
+	t.Require().NoError(err)
+	t.Require().Len(parts, 1)
+	t.Require().Equal(small.ID, parts[0].ID)
+
+	parts, err = t.repository.FindStorageParts(ctx, storage.ID, 1000, []string{large.ID}, 10)
+	t.Require().NoError(err)
+	t.Require().Len(parts, 1)
+	t.Require().Equal(small.ID, parts[0].ID)
+}
+
+func (t *testSuite) TestDrainStorage() {
+	ctx := context.Background()
+
+	storage := repository2.NewStorage(uuid.NewString(), "127.0.0.1:5000")
+	t.Require().NoError(t.repository.CreateOrUpdateStorage(ctx, &storage))
+
+	file := repository2.NewFile()
+	t.Require().NoError(t.repository.CreateFile(ctx, &file))
+
+	filePart := repository2.NewFilePart(file.ID, uuid.NewString(), 0, 100, storage.ID, "")
+	t.Require().NoError(t.repository.CreateFilePart(ctx, &filePart))
+
+	// a storage is retired only after it's drained
+	t.Require().ErrorIs(t.repository.RetireStorage(ctx, storage.ID), repository2.ErrNotFound)
+
+	t.Require().NoError(t.repository.DrainStorage(ctx, storage.ID))
+	t.Require().NoError(t.repository.DrainStorage(ctx, storage.ID))
+	t.Require().ErrorIs(t.repository.DrainStorage(ctx, uuid.NewString()), repository2.ErrNotFound)
+
+	storages, err := t.repository.FindStorages(ctx)
+	t.Require().NoError(err)
+	t.Require().Empty(storages)
+
+	draining, err := t.repository.FindDrainingStorages(ctx)
+	t.Require().NoError(err)
+	t.Require().Len(draining, 1)
+
+	count, err := t.repository.CountStorageParts(ctx, storage.ID)
+	t.Require().NoError(err)
+	t.Require().EqualValues(1, count)
+	t.Require().ErrorIs(t.repository.RetireStorage(ctx, storage.ID), repository2.ErrNotFound)
+
+	_, err = t.repository.DeleteFile(ctx, file.ID)
+	t.Require().NoError(err)
+	t.Require().NoError(t.repository.RetireStorage(ctx, storage.ID))
+
+	draining, err = t.repository.FindDrainingStorages(ctx)
+	t.Require().NoError(err)
+	t.Require().Empty(draining)
+
+	found, err := t.repository.GetStorage(ctx, storage.ID)
+	t.Require().NoError(err)
+	t.Require().NotNil(found.RetiredAt)
+}
+
+func (t *testSuite) TestGarbageLookups() {
+	ctx := context.Background()
+
+	storage := repository2.NewStorage(uuid.NewString(), "127.0.0.1:5000")
+	t.Require().NoError(t.repository.CreateOrUpdateStorage(ctx, &storage))
+
+	file := repository2.NewFile()
+	t.Require().NoError(t.repository.CreateFile(ctx, &file))
+
+	expired, err := t.repository.FindExpiredUploads(ctx, time.Now().Add(-time.Minute), 10)
+	t.Require().NoError(err)
+	t.Require().Empty(expired)
+
+	expired, err = t.repository.FindExpiredUploads(ctx, time.Now().Add(time.Minute), 10)
+	t.Require().NoError(err)
+	t.Require().Len(expired, 1)
+	t.Require().Equal(file.ID, expired[0].ID)
+
+	filePart := repository2.NewFilePart(file.ID, uuid.NewString(), 0, 100, storage.ID, "")
+	t.Require().NoError(t.repository.CreateFilePart(ctx, &filePart))
+
+	// an upload which gets parts isn't abandoned
+	expired, err = t.repository.FindExpiredUploads(ctx, time.Now().Add(-time.Second), 10)
+	t.Require().NoError(err)
+	t.Require().Empty(expired)
+
+	deletion := repository2.NewPartDeletion(storage.ID, uuid.NewString())
+	t.Require().NoError(t.repository.CreatePartDeletions(ctx, []repository2.PartDeletion{deletion}))
+
+	orphan := uuid.NewString()
+	known, err := t.repository.FindKnownRemoteIDs(ctx, storage.ID, []string{filePart.RemoteID, deletion.RemoteID, orphan})
+	t.Require().NoError(err)
+	t.Require().ElementsMatch([]string{filePart.RemoteID, deletion.RemoteID}, known)
+
+	known, err = t.repository.FindKnownRemoteIDs(ctx, uuid.NewString(), []string{filePart.RemoteID})
+	t.Require().NoError(err)
+	t.Require().Empty(known)
+
+	// a part sent early is known while the rest of the file is sent
+	upload := repository2.NewFile()
+	t.Require().NoError(t.repository.CreateFile(ctx, &upload))
+
+	reservation := repository2.NewPartReservation(upload.ID, storage.ID, uuid.NewString())
+	t.Require().NoError(t.repository.CreatePartReservations(ctx, []repository2.PartReservation{reservation}))
+
+	known, err = t.repository.FindKnownRemoteIDs(ctx, storage.ID, []string{reservation.RemoteID})
+	t.Require().NoError(err)
+	t.Require().Equal([]string{reservation.RemoteID}, known)
+
+	// the uploaded file doesn't keep its reservations
+	_, _, err = t.repository.ReplaceFile(ctx, upload.ID, repository2.UpdateFileInfoInput{
+		Name:     "reserved",
+		Size:     100,
+		Replicas: 1,
+		Status:   repository2.FileStatusUploaded,
+	}, repository2.ReplaceNone, nil)
+	t.Require().NoError(err)
+
+	known, err = t.repository.FindKnownRemoteIDs(ctx, storage.ID, []string{reservation.RemoteID})
+	t.Require().NoError(err)
+	t.Require().Empty(known)
+}
+
+func (t *testSuite) TestFileVersions() {
+	ctx := context.Background()
+	name := uuid.NewString()
+
+	upload := func(mode repository2.ReplaceMode) (string, string, error) {
+		file := repository2.NewFile()
+		t.Require().NoError(t.repository.CreateFile(ctx, &file))
+		replaced, _, err := t.repository.ReplaceFile(ctx, file.ID, repository2.UpdateFileInfoInput{
+			Name:     name,
+			Size:     100,
+			Replicas: 1,
+			Status:   repository2.FileStatusUploaded,
+		}, mode, nil)
+		return file.ID, replaced, err
+	}
+
+	first, replaced, err := upload(repository2.ReplaceNone)
+	t.Require().NoError(err)
+	t.Require().Empty(replaced)
+
+	_, _, err = upload(repository2.ReplaceNone)
+	t.Require().ErrorIs(err, repository2.ErrAlreadyExists)
+
+	second, replaced, err := upload(repository2.ReplaceSupersede)
+	t.Require().NoError(err)
+	t.Require().Equal(first, replaced)
+
+	file, err := t.repository.GetFileByName(ctx, name)
+	t.Require().NoError(err)
+	t.Require().Equal(second, file.ID)
+
+	file, err = t.repository.GetFileVersion(ctx, name, first)
+	t.Require().NoError(err)
+	t.Require().True(file.Noncurrent)
+
+	// the marker hides the name, but keeps its versions
+	marker := repository2.NewFile()
+	marker.Name = &name
+	hidden, err := t.repository.CreateDeleteMarker(ctx, &marker)
+	t.Require().NoError(err)
+	t.Require().Equal(second, hidden)
+	_, err = t.repository.CreateDeleteMarker(ctx, &repository2.File{ID: uuid.NewString(), Name: &name})
+	t.Require().ErrorIs(err, repository2.ErrNotFound)
+
+	_, err = t.repository.GetFileByName(ctx, name)
+	t.Require().ErrorIs(err, repository2.ErrNotFound)
+	_, err = t.repository.GetFileVersion(ctx, name, marker.ID)
+	t.Require().ErrorIs(err, repository2.ErrNotFound)
+
+	versions, err := t.repository.FindFileVersions(ctx, name)
+	t.Require().NoError(err)
+	t.Require().Len(versions, 3)
+	t.Require().Equal(marker.ID, versions[0].ID)
+	t.Require().True(versions[0].DeleteMarker)
+	t.Require().False(versions[0].Noncurrent)
+	t.Require().Equal(second, versions[1].ID)
+	t.Require().Equal(first, versions[2].ID)
+
+	// deleting the current marker makes the newest version current again
+	_, err = t.repository.DeleteFileVersion(ctx, name, marker.ID)
+	t.Require().NoError(err)
+	file, err = t.repository.GetFileByName(ctx, name)
+	t.Require().NoError(err)
+	t.Require().Equal(second, file.ID)
+
+	storage := repository2.NewStorage(uuid.NewString(), "127.0.0.1:5000")
+	t.Require().NoError(t.repository.CreateOrUpdateStorage(ctx, &storage))
+	filePart := repository2.NewFilePart(second, uuid.NewString(), 0, 100, storage.ID, "")
+	t.Require().NoError(t.repository.CreateFilePart(ctx, &filePart))
+
+	deletions, err := t.repository.DeleteFileVersion(ctx, name, second)
+	t.Require().NoError(err)
+	t.Require().Len(deletions, 1)
+	t.Require().Equal(filePart.RemoteID, deletions[0].RemoteID)
+
+	file, err = t.repository.GetFileByName(ctx, name)
+	t.Require().NoError(err)
+	t.Require().Equal(first, file.ID)
+
+	_, err = t.repository.DeleteFileVersion(ctx, name, second)
+	t.Require().ErrorIs(err, repository2.ErrNotFound)
+}
+
+func (t *testSuite) TestReplaceFile() {
+	ctx := context.Background()
+	name := uuid.NewString()
+	errMismatch := errors.New("mismatch")
+
+	storage := repository2.NewStorage(uuid.NewString(), "127.0.0.1:5000")
+	t.Require().NoError(t.repository.CreateOrUpdateStorage(ctx, &storage))
+
+	upload := func(hash string, check func(current *repository2.File) error) (string, []*repository2.PartDeletion, error) {
+		file := repository2.NewFile()
+		t.Require().NoError(t.repository.CreateFile(ctx, &file))
+		filePart := repository2.NewFilePart(file.ID, uuid.NewString(), 0, 100, storage.ID, "")
+		t.Require().NoError(t.repository.CreateFilePart(ctx, &filePart))
+
+		_, deletions, err := t.repository.ReplaceFile(ctx, file.ID, repository2.UpdateFileInfoInput{
+			Name:     name,
+			Size:     100,
+			Hash:     hash,
+			Replicas: 1,
+			Status:   repository2.FileStatusUploaded,
+		}, repository2.ReplaceDelete, check)
+		return file.ID, deletions, err
+	}
+
+	first, deletions, err := upload("hash-1", func(current *repository2.File) error {
+		t.Require().Nil(current)
+		return nil
+	})
+	t.Require().NoError(err)
+	t.Require().Empty(deletions)
+
+	_, _, err = upload("hash-2", func(current *repository2.File) error {
+		t.Require().NotNil(current)
+		t.Require().Equal(first, current.ID)
+		return errMismatch
+	})
+	t.Require().ErrorIs(err, errMismatch)
+
+	file, err := t.repository.GetFileByName(ctx, name)
+	t.Require().NoError(err)
+	t.Require().Equal(first, file.ID)
+
+	second, deletions, err := upload("hash-2", nil)
+	t.Require().NoError(err)
+	t.Require().Len(deletions, 1)
+
+	file, err = t.repository.GetFileByName(ctx, name)
+	t.Require().NoError(err)
+	t.Require().Equal(second, file.ID)
+	t.Require().Equal("hash-2", file.Hash)
+
+	_, err = t.repository.GetFile(ctx, first)
+	t.Require().ErrorIs(err, repository2.ErrNotFound)
 }
@@ -7,10 +7,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strconv"
 	"sync"
 	"time"
 
+	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/blkmlk/file-storage/env"
 
@@ -21,19 +25,41 @@ import (
 	"github.com/blkmlk/file-storage/protocol"
 )
 
+const (
+	DefaultHeartbeatInterval = time.Second * 5
+	// DefaultHighWaterMark is the share of the disk which may be filled with parts
+	DefaultHighWaterMark = 0.9
+	// DefaultPreparedTTL is how long a reservation is kept when no part is uploaded for it
+	DefaultPreparedTTL = time.Hour
+	ListFilePartsLimit = 1000
+)
+
+type reservation struct {
+	size      int64
+	createdAt time.Time
+}
+
 type Storage struct {
-	id           string
-	registryHost string
-	storageHost  string
-	fileStorage  filestorage.FileStorage
+	id                string
+	registryHost      string
+	storageHost       string
+	zone              string
+	heartbeatInterval time.Duration
+	highWaterMark     float64
+	preparedTTL       time.Duration
+	log               *zap.SugaredLogger
+	fileStorage       filestorage.FileStorage
+	uploader          protocol.UploaderClient
 
-	locker   sync.RWMutex
-	prepared map[string]bool
+	locker sync.RWMutex
+	// prepared keeps reserved parts until they're uploaded, deleted or expired
+	prepared map[string]reservation
+	reserved int64
 
 	protocol.StorageServer
 }
 
-func New(fileStorage filestorage.FileStorage) (*Storage, error) {
+func New(log *zap.SugaredLogger, fileStorage filestorage.FileStorage) (*Storage, error) {
 	registryHost, err := env.Get(env.RegistryHost)
 	if err != nil {
 		return nil, err
@@ -49,12 +75,38 @@ func New(fileStorage filestorage.FileStorage) (*Storage, error) {
 		return nil, err
 	}
 
+	heartbeatInterval, err := time.ParseDuration(env.GetOptional(env.HeartbeatInterval, DefaultHeartbeatInterval.String()))
+	if err != nil || heartbeatInterval <= 0 {
+		return nil, fmt.Errorf("%s is not a positive duration", env.HeartbeatInterval)
+	}
+
+	highWaterMark, err := strconv.ParseFloat(env.GetOptional(env.HighWaterMark, strconv.FormatFloat(DefaultHighWaterMark, 'f', -1, 64)), 64)
+	if err != nil || highWaterMark <= 0 || highWaterMark > 1 {
+		return nil, fmt.Errorf("%s is not a fraction in (0, 1]", env.HighWaterMark)
+	}
+
+	preparedTTL, err := time.ParseDuration(env.GetOptional(env.PreparedTTL, DefaultPreparedTTL.String()))
+	if err != nil || preparedTTL <= 0 {
+		return nil, fmt.Errorf("%s is not a positive duration", env.PreparedTTL)
+	}
+
+	conn, err := grpc.Dial(registryHost, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+
 	s := &Storage{
-		id:           storageID,
-		registryHost: registryHost,
-		storageHost:  storageHost,
-		fileStorage:  fileStorage,
-		prepared:     make(map[string]bool),
+		id:                storageID,
+		registryHost:      registryHost,
+		storageHost:       storageHost,
+		zone:              env.GetOptional(env.StorageZone, ""),
+		heartbeatInterval: heartbeatInterval,
+		highWaterMark:     highWaterMark,
+		preparedTTL:       preparedTTL,
+		log:               log,
+		fileStorage:       fileStorage,
+		uploader:          protocol.NewUploaderClient(conn),
+		prepared:          make(map[string]reservation),
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
@@ -68,27 +120,162 @@ func New(fileStorage filestorage.FileStorage) (*Storage, error) {
 }
 
 func (s *Storage) register(ctx context.Context) error {
-	conn, err := grpc.DialContext(ctx, s.registryHost, grpc.WithInsecure())
-	if err != nil {
-		return err
-	}
-
-	uploaderClient := protocol.NewUploaderClient(conn)
-	_, err = uploaderClient.Register(ctx, &protocol.RegisterRequest{
+	_, err := s.uploader.Register(ctx, &protocol.RegisterRequest{
 		StorageId: s.id,
 		Host:      s.storageHost,
+		Zone:      s.zone,
 	})
 	return err
 }
 
+// RunHeartbeats tells the uploader that the storage is alive until the context is done.
+// A storage which stops sending them is marked suspect and then dead.
+func (s *Storage) RunHeartbeats(ctx context.Context) error {
+	ticker := time.NewTicker(s.heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		req := &protocol.HeartbeatRequest{
+			StorageId: s.id,
+			Host:      s.storageHost,
+			Zone:      s.zone,
+		}
+
+		// the heartbeat is sent without the capacity when the disk can't be checked
+		usage, err := s.usage(ctx)
+		if err != nil {
+			s.log.With("err", err).Error("failed to get disk usage")
+		} else {
+			req.TotalBytes = usage.Total
+			req.UsedBytes = usage.Used
+			req.FreeBytes = usage.Free
+		}
+
+		reqCtx, cancel := context.WithTimeout(ctx, s.heartbeatInterval)
+		_, err = s.uploader.Heartbeat(reqCtx, req)
+		cancel()
+		if err != nil {
+			s.log.With("err", err).Warn("failed to send heartbeat")
+		}
+	}
+}
+
+// usage is the disk usage with the reserved parts counted as used.
+func (s *Storage) usage(ctx context.Context) (filestorage.Usage, error) {
+	usage, err := s.fileStorage.Usage(ctx)
+	if err != nil {
+		return usage, err
+	}
+
+	s.locker.RLock()
+	defer s.locker.RUnlock()
+
+	usage.Used += s.reserved
+	usage.Free -= s.reserved
+	return usage, nil
+}
+
+// CheckReadiness reserves space for a part of the given size. The storage isn't ready
+// when the part doesn't fit on the disk or would fill it over the high-water mark.
 func (s *Storage) CheckReadiness(ctx context.Context, request *protocol.CheckReadinessRequest) (*protocol.CheckReadinessResponse, error) {
-	//todo: check for available space
-	id := uuid.NewString()
+	usage, err := s.fileStorage.Usage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	resp := &protocol.CheckReadinessResponse{
+		TotalBytes: usage.Total,
+		UsedBytes:  usage.Used + s.reserved,
+		FreeBytes:  usage.Free - s.reserved,
+	}
+	if request.Size > resp.FreeBytes || float64(resp.UsedBytes+request.Size) > s.highWaterMark*float64(usage.Total) {
+		return resp, nil
+	}
+
+	resp.Id = uuid.NewString()
+	resp.Ready = true
+	resp.UsedBytes += request.Size
+	resp.FreeBytes -= request.Size
+	s.prepared[resp.Id] = reservation{
+		size:      request.Size,
+		createdAt: time.Now(),
+	}
+	s.reserved += request.Size
+
+	return resp, nil
+}
+
+// release frees the space reserved for the part.
+func (s *Storage) release(id string) {
 	s.locker.Lock()
 	defer s.locker.Unlock()
 
-	s.prepared[id] = true
-	return &protocol.CheckReadinessResponse{Id: id, Ready: true}, nil
+	s.reserved -= s.prepared[id].size
+	delete(s.prepared, id)
+}
+
+// RunExpiry frees the space of reservations which got no part within the TTL,
+// e.g. when the uploader failed before sending it.
+func (s *Storage) RunExpiry(ctx context.Context) error {
+	ticker := time.NewTicker(s.preparedTTL / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		expiredBefore := time.Now().Add(-s.preparedTTL)
+
+		s.locker.Lock()
+		var expired int
+		for id, r := range s.prepared {
+			if r.createdAt.Before(expiredBefore) {
+				s.reserved -= r.size
+				delete(s.prepared, id)
+				expired++
+			}
+		}
+		s.locker.Unlock()
+
+		if expired > 0 {
+			s.log.Infof("%d reservations expired", expired)
+		}
+	}
+}
+
+// ListFileParts lists the parts on disk, so the uploader can find the ones nothing refers to.
+func (s *Storage) ListFileParts(ctx context.Context, request *protocol.ListFilePartsRequest) (*protocol.ListFilePartsResponse, error) {
+	limit := int(request.Limit)
+	if limit <= 0 || limit > ListFilePartsLimit {
+		limit = ListFilePartsLimit
+	}
+
+	files, err := s.fileStorage.List(ctx, request.StartAfter, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]*protocol.StoredFilePart, 0, len(files))
+	for _, f := range files {
+		parts = append(parts, &protocol.StoredFilePart{
+			Id:         f.Name,
+			Size:       f.Size,
+			ModifiedAt: f.ModifiedAt.Unix(),
+		})
+	}
+	return &protocol.ListFilePartsResponse{Parts: parts}, nil
 }
 
 func (s *Storage) CheckFilePartExistence(ctx context.Context, request *protocol.CheckFilePartExistenceRequest) (*protocol.CheckFilePartExistenceResponse, error) {
@@ -103,6 +290,7 @@ func (s *Storage) CheckFilePartExistence(ctx context.Context, request *protocol.
 
 func (s *Storage) UploadFile(server protocol.Storage_UploadFileServer) error {
 	var writer io.WriteCloser
+	var id string
 	h := sha256.New()
 	received := 0
 	for {
@@ -116,9 +304,13 @@ func (s *Storage) UploadFile(server protocol.Storage_UploadFileServer) error {
 
 		if writer == nil {
 			writer, err = s.fileStorage.Create(server.Context(), msg.Id)
+			if errors.Is(err, filestorage.ErrAlreadyExists) {
+				return status.Error(codes.AlreadyExists, err.Error())
+			}
 			if err != nil {
 				return err
 			}
+			id = msg.Id
 		}
 		n, err := writer.Write(msg.Data)
 		if err != nil {
@@ -129,12 +321,14 @@ func (s *Storage) UploadFile(server protocol.Storage_UploadFileServer) error {
 	}
 
 	if writer == nil {
-		return fmt.Errorf("no data is written")
+		return status.Error(codes.InvalidArgument, "no data is written")
 	}
 
 	if err := writer.Close(); err != nil {
 		return err
 	}
+	// the part takes the disk space now
+	s.release(id)
 
 	return server.SendAndClose(&protocol.UploadFileResponse{
 		Hash: hex.EncodeToString(h.Sum(nil)),
@@ -149,9 +343,24 @@ func (s *Storage) GetFile(request *protocol.GetFileRequest, server protocol.Stor
 	}
 	defer file.Close()
 
+	var reader io.Reader = file
+	if request.Offset > 0 {
+		if seeker, ok := file.(io.Seeker); ok {
+			_, err = seeker.Seek(request.Offset, io.SeekStart)
+		} else {
+			_, err = io.CopyN(io.Discard, file, request.Offset)
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	}
+	if request.Length > 0 {
+		reader = io.LimitReader(reader, request.Length)
+	}
+
 	buff := make([]byte, request.ChunkSize)
 	for {
-		n, err := file.Read(buff)
+		n, err := reader.Read(buff)
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				break
@@ -167,3 +376,37 @@ func (s *Storage) GetFile(request *protocol.GetFileRequest, server protocol.Stor
 	}
 	return nil
 }
+
+// VerifyFilePart reads the part from disk again and returns its hash.
+func (s *Storage) VerifyFilePart(ctx context.Context, request *protocol.VerifyFilePartRequest) (*protocol.VerifyFilePartResponse, error) {
+	file, err := s.fileStorage.Get(ctx, request.Id)
+	if err != nil {
+		if errors.Is(err, filestorage.ErrNotFound) {
+			return &protocol.VerifyFilePartResponse{Exists: false}, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return nil, err
+	}
+
+	return &protocol.VerifyFilePartResponse{
+		Exists: true,
+		Hash:   hex.EncodeToString(h.Sum(nil)),
+		Size:   size,
+	}, nil
+}
+
+func (s *Storage) DeleteFilePart(ctx context.Context, request *protocol.DeleteFilePartRequest) (*protocol.DeleteFilePartResponse, error) {
+	s.release(request.Id)
+
+	// deleting a missing part is not an error, so deletions can be retried
+	if err := s.fileStorage.Delete(ctx, request.Id); err != nil && !errors.Is(err, filestorage.ErrNotFound) {
+		return nil, err
+	}
+	return &protocol.DeleteFilePartResponse{}, nil
+}
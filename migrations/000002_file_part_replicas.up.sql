@@ -0,0 +1,4 @@
+ALTER TABLE files ADD COLUMN replicas INTEGER NOT NULL DEFAULT 1;
+
+DROP INDEX file_parts_file_id_idx;
+CREATE UNIQUE INDEX file_parts_file_id_idx ON file_parts(file_id uuid_ops, seq, storage_id uuid_ops);
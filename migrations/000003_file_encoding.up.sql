@@ -0,0 +1,7 @@
+DROP TYPE IF EXISTS file_encoding;
+CREATE TYPE file_encoding AS ENUM('replication', 'erasure');
+
+ALTER TABLE files
+    ADD COLUMN encoding file_encoding NOT NULL DEFAULT 'replication'::file_encoding,
+    ADD COLUMN data_shards INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN parity_shards INTEGER NOT NULL DEFAULT 0;
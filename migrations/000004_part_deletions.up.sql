@@ -0,0 +1,11 @@
+CREATE TABLE part_deletions (
+    id uuid PRIMARY KEY NOT NULL DEFAULT uuid_generate_v4(),
+    storage_id uuid NOT NULL REFERENCES storages(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    remote_id varchar(255) NOT NULL DEFAULT '',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL DEFAULT NOW(),
+    updated_at timestamptz NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX part_deletions_updated_at_idx ON part_deletions(updated_at);
@@ -0,0 +1 @@
+ALTER TYPE file_status ADD VALUE IF NOT EXISTS 'uploading';
@@ -0,0 +1,10 @@
+CREATE TABLE buckets (
+    id uuid PRIMARY KEY NOT NULL DEFAULT uuid_generate_v4(),
+    name VARCHAR(63) NOT NULL UNIQUE,
+    created_at timestamptz NOT NULL DEFAULT NOW(),
+    updated_at timestamptz NOT NULL DEFAULT NOW()
+);
+
+-- objects are stored as files named "bucket/key", keys are up to 1024 bytes long
+ALTER TABLE files ALTER COLUMN name TYPE VARCHAR(1088);
+CREATE INDEX files_name_c_idx ON files(name COLLATE "C");
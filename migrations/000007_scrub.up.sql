@@ -0,0 +1,18 @@
+ALTER TABLE file_parts
+    ADD COLUMN verified_at timestamptz NULL,
+    ADD COLUMN verify_status VARCHAR(20) NOT NULL DEFAULT '';
+
+CREATE INDEX file_parts_verified_at_idx ON file_parts(verified_at NULLS FIRST);
+
+-- parts found missing or corrupted wait here until they're repaired
+CREATE TABLE part_repairs (
+    id uuid PRIMARY KEY NOT NULL DEFAULT uuid_generate_v4(),
+    file_part_id uuid NOT NULL UNIQUE REFERENCES file_parts(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    reason VARCHAR(20) NOT NULL DEFAULT '',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL DEFAULT NOW(),
+    updated_at timestamptz NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX part_repairs_updated_at_idx ON part_repairs(updated_at);
@@ -0,0 +1,8 @@
+DROP TYPE IF EXISTS storage_state;
+CREATE TYPE storage_state AS ENUM('alive', 'suspect', 'dead');
+
+ALTER TABLE storages
+    ADD COLUMN last_seen_at timestamptz NOT NULL DEFAULT NOW(),
+    ADD COLUMN state storage_state NOT NULL DEFAULT 'alive'::storage_state;
+
+CREATE INDEX file_parts_storage_id_idx ON file_parts(storage_id);
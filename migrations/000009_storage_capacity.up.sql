@@ -0,0 +1,4 @@
+ALTER TABLE storages
+    ADD COLUMN total_bytes bigint NOT NULL DEFAULT 0,
+    ADD COLUMN used_bytes bigint NOT NULL DEFAULT 0,
+    ADD COLUMN free_bytes bigint NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+ALTER TABLE storages
+    ADD COLUMN zone text NOT NULL DEFAULT '';
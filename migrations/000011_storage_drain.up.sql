@@ -0,0 +1,3 @@
+ALTER TABLE storages
+    ADD COLUMN draining_at timestamptz,
+    ADD COLUMN retired_at timestamptz;
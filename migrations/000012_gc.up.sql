@@ -0,0 +1,3 @@
+CREATE INDEX file_parts_storage_id_remote_id_idx ON file_parts(storage_id, remote_id);
+CREATE INDEX part_deletions_storage_id_remote_id_idx ON part_deletions(storage_id, remote_id);
+CREATE INDEX files_status_updated_at_idx ON files(status, updated_at);
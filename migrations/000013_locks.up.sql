@@ -0,0 +1,5 @@
+CREATE TABLE locks(
+    name text PRIMARY KEY,
+    owner text NOT NULL,
+    expires_at timestamptz NOT NULL
+);
@@ -0,0 +1 @@
+ALTER TABLE locks ADD COLUMN acquired_at timestamptz NOT NULL DEFAULT NOW();
@@ -0,0 +1,9 @@
+-- a name belongs to a single current file, its older versions and
+-- the uploads which will replace it aren't current
+ALTER TABLE files DROP CONSTRAINT files_name_key;
+ALTER TABLE files
+    ADD COLUMN noncurrent boolean NOT NULL DEFAULT false,
+    ADD COLUMN delete_marker boolean NOT NULL DEFAULT false;
+
+CREATE UNIQUE INDEX files_name_current_idx ON files(name) WHERE NOT noncurrent;
+CREATE INDEX files_name_idx ON files(name);
@@ -0,0 +1,2 @@
+ALTER TABLE files ALTER COLUMN size TYPE bigint;
+ALTER TABLE file_parts ALTER COLUMN size TYPE bigint;
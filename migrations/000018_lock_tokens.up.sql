@@ -0,0 +1 @@
+ALTER TABLE locks ADD COLUMN token text NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+ALTER TABLE files ADD COLUMN md5 text NOT NULL DEFAULT '';
+ALTER TABLE file_parts ADD COLUMN md5 text NOT NULL DEFAULT '';
@@ -0,0 +1,9 @@
+CREATE TABLE part_reservations (
+    storage_id uuid NOT NULL REFERENCES storages(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    remote_id varchar(255) NOT NULL,
+    file_id uuid NOT NULL REFERENCES files(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    created_at timestamptz NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (storage_id, remote_id)
+);
+
+CREATE INDEX part_reservations_file_id_idx ON part_reservations(file_id);
@@ -23,6 +23,7 @@ const _ = grpc.SupportPackageIsVersion7
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type UploaderClient interface {
 	Register(ctx context.Context, in *RegisterRequest, opts ...grpc.CallOption) (*RegisterResponse, error)
+	Heartbeat(ctx context.Context, in *HeartbeatRequest, opts ...grpc.CallOption) (*HeartbeatResponse, error)
 }
 
 type uploaderClient struct {
@@ -42,11 +43,21 @@ func (c *uploaderClient) Register(ctx context.Context, in *RegisterRequest, opts
 	return out, nil
 }
 
+func (c *uploaderClient) Heartbeat(ctx context.Context, in *HeartbeatRequest, opts ...grpc.CallOption) (*HeartbeatResponse, error) {
+	out := new(HeartbeatResponse)
+	err := c.cc.Invoke(ctx, "/protocol.Uploader/Heartbeat", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // UploaderServer is the server API for Uploader service.
 // All implementations must embed UnimplementedUploaderServer
 // for forward compatibility
 type UploaderServer interface {
 	Register(context.Context, *RegisterRequest) (*RegisterResponse, error)
+	Heartbeat(context.Context, *HeartbeatRequest) (*HeartbeatResponse, error)
 	mustEmbedUnimplementedUploaderServer()
 }
 
@@ -57,6 +68,9 @@ type UnimplementedUploaderServer struct {
 func (UnimplementedUploaderServer) Register(context.Context, *RegisterRequest) (*RegisterResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Register not implemented")
 }
+func (UnimplementedUploaderServer) Heartbeat(context.Context, *HeartbeatRequest) (*HeartbeatResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Heartbeat not implemented")
+}
 func (UnimplementedUploaderServer) mustEmbedUnimplementedUploaderServer() {}
 
 // UnsafeUploaderServer may be embedded to opt out of forward compatibility for this service.
@@ -88,6 +102,24 @@ func _Uploader_Register_Handler(srv interface{}, ctx context.Context, dec func(i
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Uploader_Heartbeat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HeartbeatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UploaderServer).Heartbeat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/protocol.Uploader/Heartbeat",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UploaderServer).Heartbeat(ctx, req.(*HeartbeatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Uploader_ServiceDesc is the grpc.ServiceDesc for Uploader service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -99,6 +131,10 @@ var Uploader_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Register",
 			Handler:    _Uploader_Register_Handler,
 		},
+		{
+			MethodName: "Heartbeat",
+			Handler:    _Uploader_Heartbeat_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "message.proto",
@@ -112,6 +148,9 @@ type StorageClient interface {
 	CheckFilePartExistence(ctx context.Context, in *CheckFilePartExistenceRequest, opts ...grpc.CallOption) (*CheckFilePartExistenceResponse, error)
 	UploadFile(ctx context.Context, opts ...grpc.CallOption) (Storage_UploadFileClient, error)
 	GetFile(ctx context.Context, in *GetFileRequest, opts ...grpc.CallOption) (Storage_GetFileClient, error)
+	DeleteFilePart(ctx context.Context, in *DeleteFilePartRequest, opts ...grpc.CallOption) (*DeleteFilePartResponse, error)
+	VerifyFilePart(ctx context.Context, in *VerifyFilePartRequest, opts ...grpc.CallOption) (*VerifyFilePartResponse, error)
+	ListFileParts(ctx context.Context, in *ListFilePartsRequest, opts ...grpc.CallOption) (*ListFilePartsResponse, error)
 }
 
 type storageClient struct {
@@ -206,6 +245,33 @@ func (x *storageGetFileClient) Recv() (*GetFileResponse, error) {
 	return m, nil
 }
 
+func (c *storageClient) DeleteFilePart(ctx context.Context, in *DeleteFilePartRequest, opts ...grpc.CallOption) (*DeleteFilePartResponse, error) {
+	out := new(DeleteFilePartResponse)
+	err := c.cc.Invoke(ctx, "/protocol.Storage/DeleteFilePart", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageClient) VerifyFilePart(ctx context.Context, in *VerifyFilePartRequest, opts ...grpc.CallOption) (*VerifyFilePartResponse, error) {
+	out := new(VerifyFilePartResponse)
+	err := c.cc.Invoke(ctx, "/protocol.Storage/VerifyFilePart", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *storageClient) ListFileParts(ctx context.Context, in *ListFilePartsRequest, opts ...grpc.CallOption) (*ListFilePartsResponse, error) {
+	out := new(ListFilePartsResponse)
+	err := c.cc.Invoke(ctx, "/protocol.Storage/ListFileParts", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // StorageServer is the server API for Storage service.
 // All implementations must embed UnimplementedStorageServer
 // for forward compatibility
@@ -214,6 +280,9 @@ type StorageServer interface {
 	CheckFilePartExistence(context.Context, *CheckFilePartExistenceRequest) (*CheckFilePartExistenceResponse, error)
 	UploadFile(Storage_UploadFileServer) error
 	GetFile(*GetFileRequest, Storage_GetFileServer) error
+	DeleteFilePart(context.Context, *DeleteFilePartRequest) (*DeleteFilePartResponse, error)
+	VerifyFilePart(context.Context, *VerifyFilePartRequest) (*VerifyFilePartResponse, error)
+	ListFileParts(context.Context, *ListFilePartsRequest) (*ListFilePartsResponse, error)
 	mustEmbedUnimplementedStorageServer()
 }
 
@@ -233,6 +302,15 @@ func (UnimplementedStorageServer) UploadFile(Storage_UploadFileServer) error {
 func (UnimplementedStorageServer) GetFile(*GetFileRequest, Storage_GetFileServer) error {
 	return status.Errorf(codes.Unimplemented, "method GetFile not implemented")
 }
+func (UnimplementedStorageServer) DeleteFilePart(context.Context, *DeleteFilePartRequest) (*DeleteFilePartResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteFilePart not implemented")
+}
+func (UnimplementedStorageServer) VerifyFilePart(context.Context, *VerifyFilePartRequest) (*VerifyFilePartResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method VerifyFilePart not implemented")
+}
+func (UnimplementedStorageServer) ListFileParts(context.Context, *ListFilePartsRequest) (*ListFilePartsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListFileParts not implemented")
+}
 func (UnimplementedStorageServer) mustEmbedUnimplementedStorageServer() {}
 
 // UnsafeStorageServer may be embedded to opt out of forward compatibility for this service.
@@ -329,6 +407,60 @@ func (x *storageGetFileServer) Send(m *GetFileResponse) error {
 	return x.ServerStream.SendMsg(m)
 }
 
+func _Storage_DeleteFilePart_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteFilePartRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServer).DeleteFilePart(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/protocol.Storage/DeleteFilePart",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServer).DeleteFilePart(ctx, req.(*DeleteFilePartRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Storage_VerifyFilePart_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(VerifyFilePartRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServer).VerifyFilePart(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/protocol.Storage/VerifyFilePart",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServer).VerifyFilePart(ctx, req.(*VerifyFilePartRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Storage_ListFileParts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListFilePartsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServer).ListFileParts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/protocol.Storage/ListFileParts",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServer).ListFileParts(ctx, req.(*ListFilePartsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Storage_ServiceDesc is the grpc.ServiceDesc for Storage service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -344,6 +476,18 @@ var Storage_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "CheckFilePartExistence",
 			Handler:    _Storage_CheckFilePartExistence_Handler,
 		},
+		{
+			MethodName: "DeleteFilePart",
+			Handler:    _Storage_DeleteFilePart_Handler,
+		},
+		{
+			MethodName: "VerifyFilePart",
+			Handler:    _Storage_VerifyFilePart_Handler,
+		},
+		{
+			MethodName: "ListFileParts",
+			Handler:    _Storage_ListFileParts_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{